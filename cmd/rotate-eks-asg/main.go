@@ -1,37 +1,186 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/complex64/go-utils/pkg/ctxutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gopkg.in/alecthomas/kingpin.v2"
 
+	"github.com/tenjin/rotate-eks-asg/internal/pkg/cli"
 	"github.com/tenjin/rotate-eks-asg/internal/pkg/rotator"
 )
 
 var (
-	groups  = kingpin.Arg("groups", "EKS Auto Scaling Groups to rotate. Omit to rotate all ASGs for the current cluster").Strings()
-	dryRun  = kingpin.Flag("dryrun", "Don't actually rotate nodes, just print what would be rotated").Default("false").Bool()
-	limit   = kingpin.Flag("limit", "Only rotate [limit] oldest node(s)").Uint()
-	cluster = kingpin.Flag("cluster", "Name of Kubernetes cluster to rotate").String()
+	groups    = kingpin.Arg("groups", "EKS Auto Scaling Groups or managed node groups to rotate. Omit to rotate all ASGs for the current cluster").Strings()
+	dryRun    = kingpin.Flag("dryrun", "Don't actually rotate nodes, just print what would be rotated").Default("false").Bool()
+	limit     = kingpin.Flag("limit", "Only rotate [limit] oldest node(s)").Uint()
+	outdated  = kingpin.Flag("outdated-only", "Only rotate nodes not running their ASG's current launch template version or launch configuration; same as --policy launch-outdated").Default("false").Bool()
+	policies  = kingpin.Flag("policy", "Only rotate nodes picked by one of these policies: older-than=<age>, launch-outdated, ami-outdated or kubelet-behind").Strings()
+	order     = kingpin.Flag("order", "Rotate the oldest nodes first, or take turns between availability zones and ASGs").Default(string(rotator.OrderAge)).Enum(rotator.Orders...)
+	mismatch  = kingpin.Flag("zone-mismatch", "What to do when a replacement is launched in another availability zone: warn, or pause the rotation").Default(string(rotator.ZoneMismatchWarn)).Enum(rotator.ZoneMismatches...)
+	strategy  = kingpin.Flag("strategy", "How to replace nodes: detach one at a time, surge new nodes in batches, or drain-first one at a time; prefix with <asg>= to set it for one ASG").Strings()
+	batchSize = kingpin.Flag("batch-size", "Nodes per batch with --strategy surge, as a number or percentage; prefix with <asg>= to set it for one ASG").Strings()
+	parallel  = kingpin.Flag("parallel", "Rotate up to [parallel] ASGs at once").Default("1").Uint()
+	draining  = kingpin.Flag("max-draining", "Drain at most [max-draining] nodes at once across all ASGs; 0 for no limit").Default("0").Uint()
+	groupTags = kingpin.Flag("group-tag", "Without [groups], only rotate the cluster's ASGs carrying all of these tags, as key or key=value[,value]").Strings()
+	includes  = kingpin.Flag("include-group", "Without [groups], only rotate ASGs whose name matches one of these globs or /regexps/").Strings()
+	excludes  = kingpin.Flag("exclude-group", "Without [groups], don't rotate ASGs whose name matches one of these globs or /regexps/").Strings()
+	selector  = kingpin.Flag("node-selector", "Only rotate nodes matching this label selector").Short('l').String()
+	taints    = kingpin.Flag("node-taint", "Only rotate nodes with one of these taints, as key[=value][:effect]").Strings()
+	condition = kingpin.Flag("node-condition", "Only rotate nodes in one of these conditions, as type[=status] or NotReady").Strings()
+	kubelet   = kingpin.Flag("kubelet-version", "Only rotate nodes whose kubelet version matches this constraint, e.g. '<1.21'").String()
+	gatePods  = kingpin.Flag("gate-pods", "Between nodes, wait until the pods evicted from the previous node are Running and Ready again").Default("false").Bool()
+	gateLoads = kingpin.Flag("gate-workloads", "Between nodes, wait until no Deployment or StatefulSet has unavailable replicas").Default("false").Bool()
+	daemonSet = kingpin.Flag("gate-daemonset", "Between nodes, wait until these DaemonSets, as namespace/name, are rolled out, including on the new nodes").Strings()
+	soak      = kingpin.Flag("soak", "Minimum time to wait between nodes once the health gates pass").Default("0s").Duration()
+	gateWait  = kingpin.Flag("gate-timeout", "Maximum time to wait for the health gates to pass (0 to wait forever)").Default(rotator.DefaultGateTimeout.String()).Duration()
+	gateFail  = kingpin.Flag("gate-failure", "What to do when the health gates don't pass in time: pause the rotation, or abort it").Default(string(rotator.GateFailurePause)).Enum(rotator.GateFailures...)
+	failures  = kingpin.Flag("max-failures", "Halt the rotation once this many replacement nodes failed to join or become Ready; failures are rolled back and the next node is rotated until then (default 1, or no limit with --max-failure-rate)").Default("0").Uint()
+	failRate  = kingpin.Flag("max-failure-rate", "Halt the rotation once more than this percentage of an ASG's replacements failed, counted from 3 replacements on").String()
+	cluster   = kingpin.Flag("cluster", "Name of Kubernetes cluster to rotate").String()
+	stateFile = kingpin.Flag("state-file", "Record the progress of the rotation in this file, so it can be resumed with --resume").String()
+	resume    = kingpin.Flag("resume", "Resume the interrupted rotation recorded in --state-file").Default("false").Bool()
+	output    = kingpin.Flag("output", "With --dryrun, print the rotation plan in this format").Short('o').Enum(rotator.PlanFormats...)
+	planFile  = kingpin.Flag("plan", "Rotate exactly the instances of a plan printed by --dryrun --output").ExistingFile()
+	yes       = kingpin.Flag("yes", "Don't print the plan and ask for confirmation before rotating").Short('y').Default("false").Bool()
+	step      = kingpin.Flag("step", "Ask before each node whether to rotate it, skip it, abort the rotation, or rotate the remaining nodes without asking").Default("false").Bool()
+	control   = kingpin.Flag("control-file", "While this file exists, finish the nodes being rotated and then hold the rotation until it is removed").String()
+	metrics   = kingpin.Flag("metrics-addr", "Serve Prometheus metrics about the rotation on this address, e.g. :9090").String()
+)
+
+var (
+	timeouts      rotator.Timeouts
+	drainOptions  func() (rotator.DrainOptions, error)
+	lifecycleHook *string
+	rollback      *bool
+	pdbPolicy     *string
 )
 
 func init() {
 	_ = os.Setenv("AWS_SDK_LOAD_CONFIG", "true")
+	cli.TimeoutFlags(&timeouts)
+	drainOptions = cli.DrainFlags()
+	lifecycleHook = cli.LifecycleHookFlag()
+	rollback = cli.RollbackFlag()
+	pdbPolicy = cli.PDBPolicyFlag()
 }
 
 func main() {
 	kingpin.Parse()
-	ctx, cancel := ctxutil.ContextWithCancelSignals(os.Kill, os.Interrupt)
-
-	r, err := rotator.NewRotator(*dryRun, *limit, *cluster)
+	if *resume && *stateFile == "" {
+		kingpin.Fatalf("--resume needs the --state-file of the rotation to resume")
+	}
+	batchSizes, err := rotator.ParseBatchSizes(*batchSize)
+	if err != nil {
+		kingpin.Fatalf("%s", err)
+	}
+	defaultStrategy, groupStrategies, err := rotator.ParseStrategies(*strategy)
+	if err != nil {
+		kingpin.Fatalf("%s", err)
+	}
+	discovery, err := rotator.ParseGroupSelector(*groupTags, *includes, *excludes)
+	if err != nil {
+		kingpin.Fatalf("%s", err)
+	}
+	policy, err := rotator.ParsePolicies(*policies)
+	if err != nil {
+		kingpin.Fatalf("%s", err)
+	}
+	policy.LaunchOutdated = policy.LaunchOutdated || *outdated
+	nodeSelector, err := rotator.ParseNodeSelector(*selector, *taints, *condition, *kubelet)
+	if err != nil {
+		kingpin.Fatalf("%s", err)
+	}
+	daemonSets, err := rotator.ParseDaemonSets(*daemonSet)
+	if err != nil {
+		kingpin.Fatalf("%s", err)
+	}
+	gates := rotator.Gates{
+		Pods:       *gatePods,
+		Workloads:  *gateLoads,
+		DaemonSets: daemonSets,
+		Soak:       *soak,
+		Timeout:    *gateWait,
+		OnFailure:  rotator.GateFailure(*gateFail),
+	}
+	budget := rotator.FailureBudget{MaxFailures: *failures}
+	if *failRate != "" {
+		if budget.MaxRate, err = rotator.ParseFailureRate(*failRate); err != nil {
+			kingpin.Fatalf("%s", err)
+		}
+	}
+	drain, err := drainOptions()
+	if err != nil {
+		kingpin.Fatalf("%s", err)
+	}
+	confirm := !*yes && !*dryRun
+	if confirm && !isTerminal(os.Stdin) {
+		kingpin.Fatalf("stdin is not a terminal to confirm the rotation on; pass --yes to rotate without confirmation")
+	}
+	if *step && !*dryRun && !isTerminal(os.Stdin) {
+		kingpin.Fatalf("--step needs a terminal to prompt on")
+	}
+	var rotationMetrics *rotator.Metrics
+	if *metrics != "" {
+		if rotationMetrics, err = serveMetrics(*metrics); err != nil {
+			log.Fatal(err)
+		}
+	}
+	r, err := rotator.NewRotator(*cluster, rotator.Options{
+		DryRun:          *dryRun,
+		Limit:           *limit,
+		Policies:        policy,
+		Order:           rotator.Order(*order),
+		ZoneMismatch:    rotator.ZoneMismatch(*mismatch),
+		Strategy:        defaultStrategy,
+		GroupStrategies: groupStrategies,
+		BatchSizes:      batchSizes,
+		Parallel:        *parallel,
+		MaxDraining:     *draining,
+		PDBPolicy:       rotator.PDBPolicy(*pdbPolicy),
+		Discovery:       discovery,
+		NodeSelector:    nodeSelector,
+		Drain:           &drain,
+		LifecycleHook:   *lifecycleHook,
+		Rollback:        *rollback,
+		FailureBudget:   budget,
+		Timeouts:        timeouts,
+		Gates:           gates,
+		StateFile:       *stateFile,
+		PlanFormat:      *output,
+		Confirm:         confirm,
+		Step:            *step,
+		ControlFile:     *control,
+		Metrics:         rotationMetrics,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	if len(*groups) > 0 {
+	handleSignals(r, cancel)
+	if *resume {
+		if err := r.Resume(ctx); err != nil {
+			log.Fatal(err)
+		}
+	} else if *planFile != "" {
+		plan, err := rotator.LoadPlan(*planFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := r.RotatePlan(ctx, plan); err != nil {
+			log.Fatal(err)
+		}
+	} else if len(*groups) > 0 {
 		if err := r.RotateAll(ctx, *groups); err != nil {
 			log.Fatal(err)
 		}
@@ -41,3 +190,59 @@ func main() {
 		}
 	}
 }
+
+// handleSignals lets the rotation be controlled with signals: SIGUSR1 holds
+// it after the nodes being rotated and SIGUSR2 resumes it. The first SIGINT or
+// SIGTERM stops it after the nodes being rotated; the second cancels ctx,
+// aborting them.
+func handleSignals(r *rotator.Rotator, cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		stopping := false
+		for sig := range signals {
+			switch {
+			case sig == syscall.SIGUSR1:
+				log.Printf("Received %s, holding the rotation once the nodes being rotated are done; send SIGUSR2 to resume it.", sig)
+				r.Hold()
+			case sig == syscall.SIGUSR2:
+				log.Printf("Received %s, resuming the rotation.", sig)
+				r.Release()
+			case !stopping:
+				stopping = true
+				log.Printf("Received %s, stopping once the nodes being rotated are done; send it again to abort them.", sig)
+				r.Stop(fmt.Sprintf("stopped by %s", sig))
+			default:
+				log.Printf("Received %s again, aborting the rotation.", sig)
+				signal.Stop(signals)
+				cancel()
+				return
+			}
+		}
+	}()
+}
+
+// serveMetrics serves the metrics of the rotation, along with the process
+// metrics, on addr.
+func serveMetrics(addr string) (*rotator.Metrics, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("serving metrics: %v", err)
+	}
+	m := rotator.NewMetrics(prometheus.DefaultRegisterer)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("Serving metrics failed: %s", err)
+		}
+	}()
+	log.Printf("Serving metrics on http://%s/metrics.", listener.Addr())
+	return m, nil
+}
+
+// isTerminal tells whether f is a terminal rather than a pipe or a file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/complex64/go-utils/pkg/ctxutil"
 	"gopkg.in/alecthomas/kingpin.v2"
 
+	"github.com/tenjin/rotate-eks-asg/internal/pkg/cli"
 	"github.com/tenjin/rotate-eks-asg/internal/pkg/rotator"
 )
 
@@ -16,21 +20,63 @@ var (
 	dryRun     = kingpin.Flag("dryrun", "Don't actually rotate nodes, just print what would be rotated").Default("false").Bool()
 )
 
+var (
+	timeouts      rotator.Timeouts
+	drainOptions  func() (rotator.DrainOptions, error)
+	lifecycleHook *string
+	rollback      *bool
+	pdbPolicy     *string
+)
+
 func init() {
 	_ = os.Setenv("AWS_SDK_LOAD_CONFIG", "true")
+	cli.TimeoutFlags(&timeouts)
+	drainOptions = cli.DrainFlags()
+	lifecycleHook = cli.LifecycleHookFlag()
+	rollback = cli.RollbackFlag()
+	pdbPolicy = cli.PDBPolicyFlag()
 }
 
 func main() {
 	kingpin.Parse()
+	drain, err := drainOptions()
+	if err != nil {
+		kingpin.Fatalf("%s", err)
+	}
 
-	r, err := rotator.NewRotator(*dryRun, 0, "")
+	r, err := rotator.NewRotator("", rotator.Options{
+		DryRun:        *dryRun,
+		Drain:         &drain,
+		LifecycleHook: *lifecycleHook,
+		Rollback:      *rollback,
+		PDBPolicy:     rotator.PDBPolicy(*pdbPolicy),
+		Timeouts:      timeouts,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	ctx, cancel := ctxutil.ContextWithCancelSignals(os.Kill, os.Interrupt)
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	handleSignals(r, cancel)
 	if err := r.RotateByInternalDNS(ctx, *name, *removeNode); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// handleSignals lets the first SIGINT or SIGTERM stop the rotation if it
+// hasn't touched the instance yet, and otherwise finish it; the second
+// cancels ctx, aborting it.
+func handleSignals(r *rotator.Rotator, cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, finishing the instance if its rotation started; send it again to abort it.", sig)
+		r.Stop(fmt.Sprintf("stopped by %s", sig))
+		sig = <-signals
+		log.Printf("Received %s again, aborting the rotation.", sig)
+		signal.Stop(signals)
+		cancel()
+	}()
+}
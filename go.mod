@@ -4,12 +4,13 @@ go 1.12
 
 require (
 	github.com/aws/aws-sdk-go v1.37.1
-	github.com/complex64/go-utils v0.0.0-20190108122916-7eeb2ebb17c1
 	github.com/imdario/mergo v0.3.7 // indirect
+	github.com/prometheus/client_golang v1.11.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 	k8s.io/api v0.22.0
 	k8s.io/apimachinery v0.22.0
 	k8s.io/client-go v0.22.0
 	k8s.io/kubectl v0.22.0
 	sigs.k8s.io/aws-iam-authenticator v0.5.3
+	sigs.k8s.io/yaml v1.2.0
 )
@@ -0,0 +1,98 @@
+// Package cli holds the command line flags shared by the rotate-eks-* commands.
+package cli
+
+import (
+	"sort"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/tenjin/rotate-eks-asg/internal/pkg/rotator"
+)
+
+// TimeoutFlags registers the per-phase deadline flags, populating t.
+func TimeoutFlags(t *rotator.Timeouts) {
+	d := rotator.DefaultTimeouts
+	kingpin.Flag("join-timeout", "Maximum time to wait for a replacement node to join the cluster (0 to wait forever)").
+		Default(d.Join.String()).DurationVar(&t.Join)
+	kingpin.Flag("ready-timeout", "Maximum time to wait for a replacement node to become Ready (0 to wait forever)").
+		Default(d.Ready.String()).DurationVar(&t.Ready)
+	kingpin.Flag("drain-timeout", "Maximum time to spend draining a node (0 to wait forever)").
+		Default(d.Drain.String()).DurationVar(&t.Drain)
+	kingpin.Flag("terminate-timeout", "Maximum time to wait for an instance to terminate (0 to wait forever)").
+		Default(d.Terminate.String()).DurationVar(&t.Terminate)
+}
+
+// DrainFlags registers the flags configuring how nodes are drained. The
+// returned function resolves them once the command line is parsed: the
+// profile comes first, then the config file, then the flags given explicitly.
+func DrainFlags() func() (rotator.DrainOptions, error) {
+	return drainFlags(kingpin.CommandLine)
+}
+
+func drainFlags(app *kingpin.Application) func() (rotator.DrainOptions, error) {
+	profiles := make([]string, 0, len(rotator.DrainProfiles))
+	for name := range rotator.DrainProfiles {
+		profiles = append(profiles, name)
+	}
+	sort.Strings(profiles)
+	profile := app.Flag("drain-profile", "Drain options to start from: default deletes unmanaged pods and emptyDir data, strict refuses to").
+		Default("default").Enum(profiles...)
+	config := app.Flag("drain-config", "YAML file with drain options, applied on top of --drain-profile").ExistingFile()
+
+	var overrides []func(*rotator.DrainOptions)
+	override := func(apply func(*rotator.DrainOptions)) kingpin.Action {
+		return func(*kingpin.ParseContext) error {
+			overrides = append(overrides, apply)
+			return nil
+		}
+	}
+	var opts rotator.DrainOptions
+	app.Flag("drain-force", "Delete pods that no controller manages").
+		Action(override(func(o *rotator.DrainOptions) { o.Force = opts.Force })).BoolVar(&opts.Force)
+	app.Flag("drain-delete-emptydir-data", "Delete pods with emptyDir volumes, and their data").
+		Action(override(func(o *rotator.DrainOptions) { o.DeleteEmptyDirData = opts.DeleteEmptyDirData })).BoolVar(&opts.DeleteEmptyDirData)
+	app.Flag("drain-ignore-daemonsets", "Leave DaemonSet pods on the node instead of failing the drain").
+		Action(override(func(o *rotator.DrainOptions) { o.IgnoreAllDaemonSets = opts.IgnoreAllDaemonSets })).BoolVar(&opts.IgnoreAllDaemonSets)
+	app.Flag("drain-grace-period", "Seconds each pod is given to terminate (-1 to use the pod's own)").
+		Action(override(func(o *rotator.DrainOptions) { o.GracePeriodSeconds = opts.GracePeriodSeconds })).IntVar(&opts.GracePeriodSeconds)
+	app.Flag("drain-pod-selector", "Only drain the pods matching this label selector").
+		Action(override(func(o *rotator.DrainOptions) { o.PodSelector = opts.PodSelector })).StringVar(&opts.PodSelector)
+	app.Flag("drain-skip-wait-for-delete-timeout", "Stop waiting for pods deleted longer than this many seconds ago (0 to always wait)").
+		Action(override(func(o *rotator.DrainOptions) {
+			o.SkipWaitForDeleteTimeoutSeconds = opts.SkipWaitForDeleteTimeoutSeconds
+		})).IntVar(&opts.SkipWaitForDeleteTimeoutSeconds)
+	app.Flag("drain-disable-eviction", "Delete pods instead of evicting them, bypassing PodDisruptionBudgets").
+		Action(override(func(o *rotator.DrainOptions) { o.DisableEviction = opts.DisableEviction })).BoolVar(&opts.DisableEviction)
+
+	return func() (rotator.DrainOptions, error) {
+		resolved := rotator.DrainProfiles[*profile]
+		if *config != "" {
+			var err error
+			if resolved, err = rotator.LoadDrainOptions(*config, resolved); err != nil {
+				return resolved, err
+			}
+		}
+		for _, apply := range overrides {
+			apply(&resolved)
+		}
+		return resolved, resolved.Validate()
+	}
+}
+
+// LifecycleHookFlag registers the flag naming the lifecycle hook to service
+// when terminating instances.
+func LifecycleHookFlag() *string {
+	return kingpin.Flag("lifecycle-hook", "Terminate instances through their ASG and drain them while this autoscaling:EC2_INSTANCE_TERMINATING lifecycle hook holds them").String()
+}
+
+// RollbackFlag registers the flag rolling back the rotation of a node whose
+// replacement never becomes Ready.
+func RollbackFlag() *bool {
+	return kingpin.Flag("rollback", "When a replacement node fails to join or become Ready, terminate it and re-attach the old instance to its ASG").Default("true").Bool()
+}
+
+// PDBPolicyFlag registers the flag choosing what to do with nodes whose drain
+// a PodDisruptionBudget would block.
+func PDBPolicyFlag() *string {
+	return kingpin.Flag("pdb-policy", "What to do when a PodDisruptionBudget would block draining a node: refuse to start, skip the node, or ignore it").Default(string(rotator.PDBRefuse)).Enum(rotator.PDBPolicies...)
+}
@@ -0,0 +1,80 @@
+package cli
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/tenjin/rotate-eks-asg/internal/pkg/rotator"
+)
+
+func TestDrainFlags(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "drain.yaml")
+	if err := ioutil.WriteFile(config, []byte("force: true\ngracePeriodSeconds: 60\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	strict := func(apply func(*rotator.DrainOptions)) rotator.DrainOptions {
+		opts := rotator.StrictDrainOptions
+		apply(&opts)
+		return opts
+	}
+	for _, tc := range []struct {
+		name string
+		args []string
+		want rotator.DrainOptions
+	}{
+		{name: "defaults", want: rotator.DefaultDrainOptions},
+		{name: "profile", args: []string{"--drain-profile", "strict"}, want: rotator.StrictDrainOptions},
+		{
+			name: "config over profile",
+			args: []string{"--drain-profile", "strict", "--drain-config", config},
+			want: strict(func(o *rotator.DrainOptions) {
+				o.Force = true
+				o.GracePeriodSeconds = 60
+			}),
+		},
+		{
+			name: "flags over config",
+			args: []string{"--drain-profile", "strict", "--drain-config", config, "--no-drain-force", "--drain-grace-period", "30"},
+			want: strict(func(o *rotator.DrainOptions) { o.GracePeriodSeconds = 30 }),
+		},
+		{
+			// Flags left out don't reset what the profile set.
+			name: "flags over profile",
+			args: []string{"--drain-pod-selector", "app=web"},
+			want: func() rotator.DrainOptions {
+				opts := rotator.DefaultDrainOptions
+				opts.PodSelector = "app=web"
+				return opts
+			}(),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			app := kingpin.New("test", "")
+			resolve := drainFlags(app)
+			if _, err := app.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			got, err := resolve()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("resolved %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDrainFlagsRejectInvalidOptions(t *testing.T) {
+	app := kingpin.New("test", "")
+	resolve := drainFlags(app)
+	if _, err := app.Parse([]string{"--drain-pod-selector", "app in (web"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolve(); err == nil {
+		t.Error("invalid pod selector was accepted")
+	}
+}
@@ -1,14 +1,23 @@
 package rotator
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"log"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/aws/aws-sdk-go/service/eks"
+	"github.com/aws/aws-sdk-go/service/eks/eksiface"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/rest"
 	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
 )
@@ -20,19 +29,63 @@ type InstanceGroup struct {
 
 func (ig InstanceGroup) instanceId() string { return *ig.instance.InstanceId }
 func (ig InstanceGroup) groupId() string    { return *ig.group.AutoScalingGroupName }
+func (ig InstanceGroup) zone() string       { return aws.StringValue(ig.instance.Placement.AvailabilityZone) }
+
+// attached tells whether the instance is still a member of its ASG.
+func (ig InstanceGroup) attached() bool {
+	return ig.asgInstance() != nil
+}
+
+// terminating tells whether the ASG has started terminating the instance,
+// e.g. while a lifecycle hook holds it in Terminating:Wait.
+func (ig InstanceGroup) terminating() bool {
+	instance := ig.asgInstance()
+	return instance != nil && strings.HasPrefix(aws.StringValue(instance.LifecycleState), "Terminating")
+}
+
+// terminated tells whether the instance is shutting down or gone.
+func (ig InstanceGroup) terminated() bool {
+	state := aws.StringValue(ig.instance.State.Name)
+	return state == ec2.InstanceStateNameShuttingDown || state == ec2.InstanceStateNameTerminated
+}
+
+// asgInstance returns the ASG's view of the instance, or nil if it isn't a
+// member of the ASG.
+func (ig InstanceGroup) asgInstance() *autoscaling.Instance {
+	for _, i := range ig.group.Instances {
+		if aws.StringValue(i.InstanceId) == ig.instanceId() {
+			return i
+		}
+	}
+	return nil
+}
 
 type InstanceGroups []*InstanceGroup
 
 func (ig InstanceGroups) Len() int      { return len(ig) }
 func (ig InstanceGroups) Swap(i, j int) { ig[i], ig[j] = ig[j], ig[i] }
 
+// byGroup splits instances by ASG, keeping their order. The ASGs are returned
+// in the order their first instance appears.
+func (ig InstanceGroups) byGroup() ([]string, map[string]InstanceGroups) {
+	var groupIds []string
+	byGroup := map[string]InstanceGroups{}
+	for _, i := range ig {
+		if _, ok := byGroup[i.groupId()]; !ok {
+			groupIds = append(groupIds, i.groupId())
+		}
+		byGroup[i.groupId()] = append(byGroup[i.groupId()], i)
+	}
+	return groupIds, byGroup
+}
+
 type ByAge struct{ InstanceGroups }
 
 func (ig ByAge) Less(i, j int) bool {
 	return ig.InstanceGroups[i].instance.LaunchTime.Before(*ig.InstanceGroups[j].instance.LaunchTime)
 }
 
-func GetInstancesForGroup(ec2Client *ec2.EC2, group *autoscaling.Group) (InstanceGroups, error) {
+func GetInstancesForGroup(ec2Client ec2iface.EC2API, group *autoscaling.Group) (InstanceGroups, error) {
 	instanceGroups := make(InstanceGroups, 0, len(group.Instances))
 
 	instanceIds := make([]*string, 0, len(group.Instances))
@@ -60,7 +113,7 @@ func GetInstancesForGroup(ec2Client *ec2.EC2, group *autoscaling.Group) (Instanc
 	return instanceGroups, nil
 }
 
-func DescribeAutoScalingGroup(asgClient *autoscaling.AutoScaling, ec2Client *ec2.EC2, name string) (InstanceGroups, error) {
+func DescribeAutoScalingGroup(asgClient autoscalingiface.AutoScalingAPI, ec2Client ec2iface.EC2API, name string) (InstanceGroups, error) {
 	group, err := getAutoScalingGroup(asgClient, name)
 	if err != nil {
 		return nil, err
@@ -69,8 +122,9 @@ func DescribeAutoScalingGroup(asgClient *autoscaling.AutoScaling, ec2Client *ec2
 }
 
 func DescribeInstanceByInternalDNS(
-	ec2Client *ec2.EC2,
-	asgClient *autoscaling.AutoScaling,
+	ctx context.Context,
+	ec2Client ec2iface.EC2API,
+	asgClient autoscalingiface.AutoScalingAPI,
 	instanceInternalDNS string,
 ) (*InstanceGroup, error) {
 	input := &ec2.DescribeInstancesInput{
@@ -92,7 +146,7 @@ func DescribeInstanceByInternalDNS(
 		return nil, fmt.Errorf("%s: No matching instance could be found", instanceInternalDNS)
 	}
 
-	log.Printf("Internal DNS '%s' is instance ID '%s'", instanceInternalDNS, *instance.InstanceId)
+	logf(ctx, "Internal DNS '%s' is instance ID '%s'", instanceInternalDNS, *instance.InstanceId)
 
 	var groupName string
 	asgInput := &autoscaling.DescribeAutoScalingInstancesInput{
@@ -121,7 +175,45 @@ func DescribeInstanceByInternalDNS(
 	return &InstanceGroup{instance: instance, group: group}, nil
 }
 
-func GetAllAutoScalingGroups(client *autoscaling.AutoScaling) ([]*autoscaling.Group, error) {
+// DescribeInstanceByID looks up an instance and the ASG it belongs, or
+// belonged, to.
+func DescribeInstanceByID(
+	ec2Client ec2iface.EC2API,
+	asgClient autoscalingiface.AutoScalingAPI,
+	id string,
+	groupName string,
+) (*InstanceGroup, error) {
+	group, err := getAutoScalingGroup(asgClient, groupName)
+	if err != nil {
+		return nil, err
+	}
+	input := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("instance-id"),
+			Values: []*string{aws.String(id)},
+		}},
+	}
+	var instance *ec2.Instance
+	err = ec2Client.DescribeInstancesPages(input,
+		func(output *ec2.DescribeInstancesOutput, isLast bool) bool {
+			for _, r := range output.Reservations {
+				for _, i := range r.Instances {
+					instance = i
+					return false
+				}
+			}
+			return !isLast
+		})
+	if err != nil {
+		return nil, err
+	}
+	if instance == nil {
+		return nil, fmt.Errorf("%s: No matching instance could be found", id)
+	}
+	return &InstanceGroup{instance: instance, group: group}, nil
+}
+
+func GetAllAutoScalingGroups(client autoscalingiface.AutoScalingAPI) ([]*autoscaling.Group, error) {
 	var groups []*autoscaling.Group
 	in := &autoscaling.DescribeAutoScalingGroupsInput{
 		MaxRecords: aws.Int64(100),
@@ -137,7 +229,62 @@ func GetAllAutoScalingGroups(client *autoscaling.AutoScaling) ([]*autoscaling.Gr
 	return groups, nil
 }
 
-func getAutoScalingGroup(client *autoscaling.AutoScaling, name string) (*autoscaling.Group, error) {
+// FindGroupsByTag returns the names of the ASGs carrying a tag with key and
+// one of values, or any value if values is empty. The tags are filtered by
+// AWS rather than by listing every ASG in the region.
+func FindGroupsByTag(client autoscalingiface.AutoScalingAPI, key string, values []string) (sets.String, error) {
+	in := &autoscaling.DescribeTagsInput{
+		Filters: []*autoscaling.Filter{
+			{Name: aws.String("key"), Values: aws.StringSlice([]string{key})},
+		},
+		MaxRecords: aws.Int64(100),
+	}
+	if len(values) > 0 {
+		in.Filters = append(in.Filters, &autoscaling.Filter{Name: aws.String("value"), Values: aws.StringSlice(values)})
+	}
+	names := sets.NewString()
+	err := client.DescribeTagsPages(in, func(page *autoscaling.DescribeTagsOutput, lastPage bool) bool {
+		for _, tag := range page.Tags {
+			if aws.StringValue(tag.ResourceType) == "auto-scaling-group" {
+				names.Insert(aws.StringValue(tag.ResourceId))
+			}
+		}
+		return !lastPage
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// GetAutoScalingGroups describes the named ASGs, leaving out those that don't
+// exist.
+func GetAutoScalingGroups(client autoscalingiface.AutoScalingAPI, names []string) ([]*autoscaling.Group, error) {
+	var groups []*autoscaling.Group
+	// DescribeAutoScalingGroups takes up to 50 names at a time.
+	for len(names) > 0 {
+		batch := names
+		if len(batch) > 50 {
+			batch = batch[:50]
+		}
+		names = names[len(batch):]
+		in := &autoscaling.DescribeAutoScalingGroupsInput{
+			AutoScalingGroupNames: aws.StringSlice(batch),
+			MaxRecords:            aws.Int64(100),
+		}
+		err := client.DescribeAutoScalingGroupsPages(in,
+			func(page *autoscaling.DescribeAutoScalingGroupsOutput, lastPage bool) bool {
+				groups = append(groups, page.AutoScalingGroups...)
+				return !lastPage
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+func getAutoScalingGroup(client autoscalingiface.AutoScalingAPI, name string) (*autoscaling.Group, error) {
 	in := &autoscaling.DescribeAutoScalingGroupsInput{
 		AutoScalingGroupNames: aws.StringSlice([]string{name}),
 		MaxRecords:            aws.Int64(1),
@@ -152,35 +299,453 @@ func getAutoScalingGroup(client *autoscaling.AutoScaling, name string) (*autosca
 	return out.AutoScalingGroups[0], nil
 }
 
-func DetachInstance(client *autoscaling.AutoScaling, groupId, id string, removeNode bool) error {
-	log.Printf("Detaching instance '%s' from ASG '%s'...", id, groupId)
+func DetachInstance(ctx context.Context, client autoscalingiface.AutoScalingAPI, groupId, id string, removeNode bool) error {
+	logf(ctx, "Detaching instance '%s' from ASG '%s'...", id, groupId)
 	in := &autoscaling.DetachInstancesInput{
 		InstanceIds:                    aws.StringSlice([]string{id}),
 		AutoScalingGroupName:           aws.String(groupId),
 		ShouldDecrementDesiredCapacity: aws.Bool(removeNode),
 	}
-	_, err := client.DetachInstances(in)
+	_, err := client.DetachInstancesWithContext(ctx, in)
+	if err != nil {
+		return err
+	}
+	logf(ctx, "Instance '%s' detached.", id)
+	return nil
+}
+
+// AttachInstance adds a running instance back to an ASG, which raises the
+// ASG's desired capacity by one.
+func AttachInstance(ctx context.Context, client autoscalingiface.AutoScalingAPI, groupId, id string) error {
+	logf(ctx, "Attaching instance '%s' to ASG '%s'...", id, groupId)
+	in := &autoscaling.AttachInstancesInput{
+		InstanceIds:          aws.StringSlice([]string{id}),
+		AutoScalingGroupName: aws.String(groupId),
+	}
+	_, err := client.AttachInstancesWithContext(ctx, in)
 	if err != nil {
 		return err
 	}
-	log.Printf("Instance '%s' detached.", id)
+	logf(ctx, "Instance '%s' attached.", id)
 	return nil
 }
 
-func TerminateInstanceByID(client *ec2.EC2, id string) error {
-	log.Printf("Terminating instance '%s'...", id)
+func TerminateInstanceByID(ctx context.Context, client ec2iface.EC2API, id string) error {
+	logf(ctx, "Terminating instance '%s'...", id)
 	in := &ec2.TerminateInstancesInput{
 		InstanceIds: aws.StringSlice([]string{id}),
 	}
-	_, err := client.TerminateInstances(in)
+	_, err := client.TerminateInstancesWithContext(ctx, in)
 	if err != nil {
 		return err
 	}
-	log.Printf("Instance '%s' succesfully terminated.", id)
+	return awaitInstanceTerminated(ctx, client, id)
+}
+
+// consoleOutputLines is how many of the last lines of an instance's console
+// output are reported.
+const consoleOutputLines = 20
+
+// GetConsoleOutput returns the last lines of an instance's console output, or
+// an empty string if EC2 has none yet.
+func GetConsoleOutput(ctx context.Context, client ec2iface.EC2API, id string) (string, error) {
+	out, err := client.GetConsoleOutputWithContext(ctx, &ec2.GetConsoleOutputInput{InstanceId: aws.String(id)})
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(aws.StringValue(out.Output))
+	if err != nil {
+		return "", err
+	}
+	output := strings.TrimRight(string(data), "\r\n")
+	if output == "" {
+		return "", nil
+	}
+	lines := strings.Split(output, "\n")
+	if len(lines) > consoleOutputLines {
+		lines = lines[len(lines)-consoleOutputLines:]
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// SetGroupCapacity sets the desired capacity and max size of an ASG.
+func SetGroupCapacity(ctx context.Context, client autoscalingiface.AutoScalingAPI, groupId string, desired, max int64) error {
+	logf(ctx, "Setting desired capacity of ASG '%s' to %d (max size %d).", groupId, desired, max)
+	in := &autoscaling.UpdateAutoScalingGroupInput{
+		AutoScalingGroupName: aws.String(groupId),
+		DesiredCapacity:      aws.Int64(desired),
+		MaxSize:              aws.Int64(max),
+	}
+	_, err := client.UpdateAutoScalingGroupWithContext(ctx, in)
+	return err
+}
+
+// TerminateInstanceInGroup terminates an instance through its ASG, which
+// launches a replacement unless decrement is set, and waits until it is gone.
+func TerminateInstanceInGroup(
+	ctx context.Context,
+	asgClient autoscalingiface.AutoScalingAPI,
+	ec2Client ec2iface.EC2API,
+	id string,
+	decrement bool,
+) error {
+	if err := RequestTermination(ctx, asgClient, id, decrement); err != nil {
+		return err
+	}
+	return awaitInstanceTerminated(ctx, ec2Client, id)
+}
+
+// RequestTermination asks the ASG of an instance to terminate it, without
+// waiting for the instance to go.
+func RequestTermination(ctx context.Context, client autoscalingiface.AutoScalingAPI, id string, decrement bool) error {
+	logf(ctx, "Terminating instance '%s'...", id)
+	in := &autoscaling.TerminateInstanceInAutoScalingGroupInput{
+		InstanceId:                     aws.String(id),
+		ShouldDecrementDesiredCapacity: aws.Bool(decrement),
+	}
+	_, err := client.TerminateInstanceInAutoScalingGroupWithContext(ctx, in)
+	return err
+}
+
+func awaitInstanceTerminated(ctx context.Context, client ec2iface.EC2API, id string) error {
+	waitIn := &ec2.DescribeInstancesInput{
+		InstanceIds: aws.StringSlice([]string{id}),
+	}
+	if err := client.WaitUntilInstanceTerminatedWithContext(ctx, waitIn); err != nil {
+		return err
+	}
+	logf(ctx, "Instance '%s' succesfully terminated.", id)
 	return nil
 }
 
-func GetEKSCluserByName(client *eks.EKS, name string) (*eks.Cluster, error) {
+// GetTerminatingHook returns the named lifecycle hook of an ASG, which must
+// hold instances when they terminate.
+func GetTerminatingHook(
+	ctx context.Context,
+	client autoscalingiface.AutoScalingAPI,
+	groupId string,
+	name string,
+) (*autoscaling.LifecycleHook, error) {
+	out, err := client.DescribeLifecycleHooksWithContext(ctx, &autoscaling.DescribeLifecycleHooksInput{
+		AutoScalingGroupName: aws.String(groupId),
+		LifecycleHookNames:   aws.StringSlice([]string{name}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.LifecycleHooks) == 0 {
+		return nil, fmt.Errorf("ASG '%s' has no lifecycle hook '%s'", groupId, name)
+	}
+	hook := out.LifecycleHooks[0]
+	if transition := aws.StringValue(hook.LifecycleTransition); transition != "autoscaling:EC2_INSTANCE_TERMINATING" {
+		return nil, fmt.Errorf("lifecycle hook '%s' of ASG '%s' is for '%s', not autoscaling:EC2_INSTANCE_TERMINATING",
+			name, groupId, transition)
+	}
+	return hook, nil
+}
+
+// LifecycleStatePollInterval is how often an instance's lifecycle state is
+// checked while waiting for a lifecycle hook to hold it.
+var LifecycleStatePollInterval = 5 * time.Second
+
+// AwaitLifecycleState waits for an instance of an ASG to reach a lifecycle
+// state such as Terminating:Wait.
+func AwaitLifecycleState(ctx context.Context, client autoscalingiface.AutoScalingAPI, groupId, id, state string) error {
+	logf(ctx, "Waiting for instance '%s' to reach lifecycle state '%s'...", id, state)
+	err := wait.PollImmediateUntil(LifecycleStatePollInterval, func() (bool, error) {
+		current, err := getLifecycleState(client, groupId, id)
+		if err != nil {
+			return false, err
+		}
+		if current == "" {
+			return false, fmt.Errorf("instance '%s' left ASG '%s' before reaching lifecycle state '%s'", id, groupId, state)
+		}
+		return current == state, nil
+	}, ctx.Done())
+	if err == wait.ErrWaitTimeout && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// getLifecycleState returns the lifecycle state of an instance of an ASG, or
+// an empty string if it isn't a member.
+func getLifecycleState(client autoscalingiface.AutoScalingAPI, groupId, id string) (string, error) {
+	group, err := getAutoScalingGroup(client, groupId)
+	if err != nil {
+		return "", err
+	}
+	for _, i := range group.Instances {
+		if aws.StringValue(i.InstanceId) == id {
+			return aws.StringValue(i.LifecycleState), nil
+		}
+	}
+	return "", nil
+}
+
+func RecordLifecycleActionHeartbeat(ctx context.Context, client autoscalingiface.AutoScalingAPI, groupId, hook, id string) error {
+	_, err := client.RecordLifecycleActionHeartbeatWithContext(ctx, &autoscaling.RecordLifecycleActionHeartbeatInput{
+		AutoScalingGroupName: aws.String(groupId),
+		LifecycleHookName:    aws.String(hook),
+		InstanceId:           aws.String(id),
+	})
+	return err
+}
+
+// CompleteLifecycleAction lets an instance held by a lifecycle hook continue
+// to terminate.
+func CompleteLifecycleAction(ctx context.Context, client autoscalingiface.AutoScalingAPI, groupId, hook, id string) error {
+	logf(ctx, "Completing lifecycle action of hook '%s' for instance '%s'.", hook, id)
+	_, err := client.CompleteLifecycleActionWithContext(ctx, &autoscaling.CompleteLifecycleActionInput{
+		AutoScalingGroupName:  aws.String(groupId),
+		LifecycleHookName:     aws.String(hook),
+		InstanceId:            aws.String(id),
+		LifecycleActionResult: aws.String("CONTINUE"),
+	})
+	return err
+}
+
+// ScalingActivityPollInterval is how often an ASG's scaling activities are
+// checked while waiting for it to launch a replacement instance.
+var ScalingActivityPollInterval = 10 * time.Second
+
+var launchActivityPattern = regexp.MustCompile(`^Launching a new EC2 instance: (i-[0-9a-f]+)`)
+
+// Replacement is an instance an ASG launched in place of a rotated one.
+type Replacement struct {
+	InstanceID       string
+	AvailabilityZone string
+}
+
+// GetScalingActivityIDs returns the IDs of the most recent scaling activities
+// of an ASG, so activities started later can be told apart, along with the
+// start time of the newest one.
+func GetScalingActivityIDs(
+	ctx context.Context,
+	client autoscalingiface.AutoScalingAPI,
+	groupId string,
+) (sets.String, time.Time, error) {
+	activities, err := getRecentScalingActivities(ctx, client, groupId)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	ids := sets.NewString()
+	var latest time.Time
+	for _, a := range activities {
+		ids.Insert(aws.StringValue(a.ActivityId))
+		if start := aws.TimeValue(a.StartTime); start.After(latest) {
+			latest = start
+		}
+	}
+	return ids, latest, nil
+}
+
+// GetScalingActivityIDsUntil returns the IDs of an ASG's recent scaling
+// activities that started no later than t.
+func GetScalingActivityIDsUntil(
+	ctx context.Context,
+	client autoscalingiface.AutoScalingAPI,
+	groupId string,
+	t time.Time,
+) (sets.String, error) {
+	activities, err := getRecentScalingActivities(ctx, client, groupId)
+	if err != nil {
+		return nil, err
+	}
+	ids := sets.NewString()
+	for _, a := range activities {
+		if !aws.TimeValue(a.StartTime).After(t) {
+			ids.Insert(aws.StringValue(a.ActivityId))
+		}
+	}
+	return ids, nil
+}
+
+// AwaitReplacementInstance waits for the ASG to launch an instance in an
+// activity not in known, and returns it. If several instances are launched at
+// once, the one in zone is preferred.
+func AwaitReplacementInstance(
+	ctx context.Context,
+	client autoscalingiface.AutoScalingAPI,
+	groupId string,
+	zone string,
+	known sets.String,
+) (*Replacement, error) {
+	logf(ctx, "Waiting for ASG '%s' to launch a replacement instance...", groupId)
+	var replacement *Replacement
+	err := pollLaunches(ctx, client, groupId, known, func(launches []*Replacement) bool {
+		// The earliest launch wins, unless a later one is in the right zone.
+		for _, candidate := range launches {
+			if replacement == nil || (replacement.AvailabilityZone != zone && candidate.AvailabilityZone == zone) {
+				replacement = candidate
+			}
+		}
+		return replacement != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	logf(ctx, "ASG '%s' launched instance '%s' in '%s'.", groupId, replacement.InstanceID, replacement.AvailabilityZone)
+	return replacement, nil
+}
+
+// AwaitLaunchedInstances waits for the ASG to launch count instances through
+// scaling activities not in known, leaving out the instances in ignore.
+func AwaitLaunchedInstances(
+	ctx context.Context,
+	client autoscalingiface.AutoScalingAPI,
+	groupId string,
+	count int,
+	known sets.String,
+	ignore sets.String,
+) ([]*Replacement, error) {
+	logf(ctx, "Waiting for ASG '%s' to launch %d instances...", groupId, count)
+	var launched []*Replacement
+	err := pollLaunches(ctx, client, groupId, known, func(launches []*Replacement) bool {
+		launched = launched[:0]
+		for _, l := range launches {
+			if !ignore.Has(l.InstanceID) && len(launched) < count {
+				launched = append(launched, l)
+			}
+		}
+		return len(launched) == count
+	})
+	if err != nil {
+		// The instances launched so far are returned too, to be cleaned up.
+		return launched, err
+	}
+	for _, l := range launched {
+		logf(ctx, "ASG '%s' launched instance '%s' in '%s'.", groupId, l.InstanceID, l.AvailabilityZone)
+	}
+	return launched, nil
+}
+
+// GetLaunchedInstances returns the instances the ASG launched through scaling
+// activities not in known, oldest first.
+func GetLaunchedInstances(
+	ctx context.Context,
+	client autoscalingiface.AutoScalingAPI,
+	groupId string,
+	known sets.String,
+) ([]*Replacement, error) {
+	activities, err := getRecentScalingActivities(ctx, client, groupId)
+	if err != nil {
+		return nil, err
+	}
+	return launchedBy(activities, known), nil
+}
+
+// launchedBy returns the instances launched by the successful activities not
+// in known, oldest first. Activities are listed newest first.
+func launchedBy(activities []*autoscaling.Activity, known sets.String) []*Replacement {
+	var launches []*Replacement
+	for n := len(activities) - 1; n >= 0; n-- {
+		a := activities[n]
+		status := aws.StringValue(a.StatusCode)
+		if known.Has(aws.StringValue(a.ActivityId)) ||
+			status == autoscaling.ScalingActivityStatusCodeFailed || status == autoscaling.ScalingActivityStatusCodeCancelled {
+			continue
+		}
+		m := launchActivityPattern.FindStringSubmatch(aws.StringValue(a.Description))
+		if m == nil {
+			continue
+		}
+		launches = append(launches, &Replacement{InstanceID: m[1], AvailabilityZone: activityZone(a)})
+	}
+	return launches
+}
+
+// pollLaunches polls the ASG's scaling activities until done accepts the
+// instances launched by activities not in known, which are passed oldest
+// first. Failed and cancelled activities are logged once.
+func pollLaunches(
+	ctx context.Context,
+	client autoscalingiface.AutoScalingAPI,
+	groupId string,
+	known sets.String,
+	done func([]*Replacement) bool,
+) error {
+	reported := sets.NewString()
+	err := wait.PollImmediateUntil(ScalingActivityPollInterval, func() (bool, error) {
+		activities, err := getRecentScalingActivities(ctx, client, groupId)
+		if err != nil {
+			return false, err
+		}
+		for n := len(activities) - 1; n >= 0; n-- {
+			a := activities[n]
+			id := aws.StringValue(a.ActivityId)
+			status := aws.StringValue(a.StatusCode)
+			if known.Has(id) || reported.Has(id) ||
+				status != autoscaling.ScalingActivityStatusCodeFailed && status != autoscaling.ScalingActivityStatusCodeCancelled {
+				continue
+			}
+			reported.Insert(id)
+			logf(ctx, "ASG '%s' activity '%s' %s: %s",
+				groupId, aws.StringValue(a.Description), strings.ToLower(status), aws.StringValue(a.StatusMessage))
+		}
+		return done(launchedBy(activities, known)), nil
+	}, ctx.Done())
+	if err == wait.ErrWaitTimeout && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// GetFailedScalingActivities describes the failed and cancelled scaling
+// activities of an ASG that are not in known, oldest first.
+func GetFailedScalingActivities(
+	ctx context.Context,
+	client autoscalingiface.AutoScalingAPI,
+	groupId string,
+	known sets.String,
+) ([]string, error) {
+	activities, err := getRecentScalingActivities(ctx, client, groupId)
+	if err != nil {
+		return nil, err
+	}
+	var failed []string
+	for n := len(activities) - 1; n >= 0; n-- {
+		a := activities[n]
+		status := aws.StringValue(a.StatusCode)
+		if known.Has(aws.StringValue(a.ActivityId)) ||
+			status != autoscaling.ScalingActivityStatusCodeFailed && status != autoscaling.ScalingActivityStatusCodeCancelled {
+			continue
+		}
+		failed = append(failed, fmt.Sprintf("ASG '%s' activity '%s' %s: %s",
+			groupId, aws.StringValue(a.Description), strings.ToLower(status), aws.StringValue(a.StatusMessage)))
+	}
+	return failed, nil
+}
+
+func getRecentScalingActivities(
+	ctx context.Context,
+	client autoscalingiface.AutoScalingAPI,
+	groupId string,
+) ([]*autoscaling.Activity, error) {
+	in := &autoscaling.DescribeScalingActivitiesInput{
+		AutoScalingGroupName: aws.String(groupId),
+		MaxRecords:           aws.Int64(100),
+	}
+	out, err := client.DescribeScalingActivitiesWithContext(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out.Activities, nil
+}
+
+// activityZone extracts the availability zone from an activity's details,
+// a JSON document such as {"Subnet ID":"subnet-1","Availability Zone":"us-east-1a"}.
+func activityZone(a *autoscaling.Activity) string {
+	var details struct {
+		AvailabilityZone string `json:"Availability Zone"`
+	}
+	if err := json.Unmarshal([]byte(aws.StringValue(a.Details)), &details); err != nil {
+		return ""
+	}
+	return details.AvailabilityZone
+}
+
+func GetEKSCluserByName(client eksiface.EKSAPI, name string) (*eks.Cluster, error) {
 	cluserInput := &eks.DescribeClusterInput{
 		Name: aws.String(name),
 	}
@@ -215,7 +780,7 @@ func getK8sConfigForCluster(cluster *eks.Cluster) (*rest.Config, error) {
 	}, nil
 }
 
-func GetEKSCluserByURL(client *eks.EKS, url string) (*eks.Cluster, error) {
+func GetEKSCluserByURL(client eksiface.EKSAPI, url string) (*eks.Cluster, error) {
 	listOutput, err := client.ListClusters(nil)
 	if err != nil {
 		return nil, err
@@ -232,7 +797,7 @@ func GetEKSCluserByURL(client *eks.EKS, url string) (*eks.Cluster, error) {
 	return nil, fmt.Errorf("unable to find cluster with URL %s", url)
 }
 
-func GetK8sConfigByClusterName(client *eks.EKS, clusterName string) (*rest.Config, error) {
+func GetK8sConfigByClusterName(client eksiface.EKSAPI, clusterName string) (*rest.Config, error) {
 	cluster, err := GetEKSCluserByName(client, clusterName)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,121 @@
+package rotator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"github.com/tenjin/rotate-eks-asg/internal/pkg/rotator/fake"
+)
+
+// scaleOut raises the desired capacity of the ASG by one, as the cluster
+// autoscaler would while a node is rotated, and returns the launched instance.
+func scaleOut(t *testing.T, cloud *fake.Cloud, group, zone string) string {
+	before := map[string]bool{}
+	for _, i := range cloud.Group(group).Instances {
+		before[aws.StringValue(i.InstanceId)] = true
+	}
+	cloud.PinLaunchZone(group, zone)
+	defer cloud.PinLaunchZone(group, "")
+	desired := aws.Int64Value(cloud.Group(group).DesiredCapacity) + 1
+	if err := SetGroupCapacity(context.Background(), cloud.AutoScaling(), group, desired, desired); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range cloud.Group(group).Instances {
+		if !before[aws.StringValue(i.InstanceId)] {
+			return aws.StringValue(i.InstanceId)
+		}
+	}
+	t.Fatalf("ASG '%s' launched no instance", group)
+	return ""
+}
+
+// detach detaches the first instance of the ASG, letting it launch the
+// replacement in zone, and returns the replacement.
+func detach(t *testing.T, cloud *fake.Cloud, group, zone string) string {
+	instances := cloud.Group(group).Instances
+	cloud.PinLaunchZone(group, zone)
+	defer cloud.PinLaunchZone(group, "")
+	err := DetachInstance(context.Background(), cloud.AutoScaling(), group, aws.StringValue(instances[0].InstanceId), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := cloud.Group(group).Instances
+	return aws.StringValue(after[len(after)-1].InstanceId)
+}
+
+func TestAwaitReplacementInstance(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// scaleOutZone, if set, makes the ASG launch an instance there before
+		// the replacement, as it does when it scales out meanwhile.
+		scaleOutZone    string
+		replacementZone string
+		// wantScaleOut is set when the heuristic can't tell the replacement
+		// apart and picks the earliest launch.
+		wantScaleOut bool
+	}{
+		{name: "quiet ASG", replacementZone: "us-east-1a"},
+		{name: "scale-out in another zone", scaleOutZone: "us-east-1b", replacementZone: "us-east-1a"},
+		{name: "scale-out in the same zone", scaleOutZone: "us-east-1a", replacementZone: "us-east-1a", wantScaleOut: true},
+		{name: "replacement in another zone", scaleOutZone: "us-east-1b", replacementZone: "us-east-1b", wantScaleOut: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cloud := fake.NewCloud()
+			cloud.AddGroup("ng-1", 2, []string{"us-east-1a", "us-east-1b"}, nil)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			known, _, err := GetScalingActivityIDs(ctx, cloud.AutoScaling(), "ng-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var scaledOut string
+			if tc.scaleOutZone != "" {
+				scaledOut = scaleOut(t, cloud, "ng-1", tc.scaleOutZone)
+			}
+			replacement := detach(t, cloud, "ng-1", tc.replacementZone)
+
+			got, err := AwaitReplacementInstance(ctx, cloud.AutoScaling(), "ng-1", "us-east-1a", known)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := replacement
+			if tc.wantScaleOut {
+				want = scaledOut
+			}
+			if got.InstanceID != want {
+				t.Errorf("replacement is '%s', want '%s'", got.InstanceID, want)
+			}
+		})
+	}
+}
+
+func TestAwaitReplacementInstanceSkipsFailedLaunches(t *testing.T) {
+	cloud := fake.NewCloud()
+	cloud.AddGroup("ng-1", 2, []string{"us-east-1a"}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	known, _, err := GetScalingActivityIDs(ctx, cloud.AutoScaling(), "ng-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloud.FailLaunches("ng-1", "We currently do not have sufficient m5.large capacity.")
+	detach(t, cloud, "ng-1", "")
+	cloud.FailLaunches("ng-1", "")
+	// The ASG tries again.
+	if err := SetGroupCapacity(ctx, cloud.AutoScaling(), "ng-1", 2, 2); err != nil {
+		t.Fatal(err)
+	}
+	instances := cloud.Group("ng-1").Instances
+	replacement := aws.StringValue(instances[len(instances)-1].InstanceId)
+
+	got, err := AwaitReplacementInstance(ctx, cloud.AutoScaling(), "ng-1", "us-east-1a", known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.InstanceID != replacement {
+		t.Errorf("replacement is '%s', want '%s'", got.InstanceID, replacement)
+	}
+}
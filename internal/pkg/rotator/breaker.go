@@ -0,0 +1,235 @@
+package rotator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// FailureBudget is how many failed replacements a rotation tolerates before
+// it halts. A replacement fails when the new node doesn't join the cluster or
+// become Ready; if the failure was rolled back, the rotation carries on with
+// the next node until the budget is exhausted.
+type FailureBudget struct {
+	// MaxFailures halts the rotation once this many replacements failed
+	// across all ASGs; 0 is the same as 1, halting at the first failure,
+	// unless MaxRate is set.
+	MaxFailures uint
+	// MaxRate halts the rotation once more than this fraction of an ASG's
+	// replacements failed, from minRateAttempts replacements on, whether or
+	// not MaxFailures was reached; 0 disables it.
+	MaxRate float64
+}
+
+// minRateAttempts is how many replacements of an ASG have to be attempted
+// before its failure rate counts.
+const minRateAttempts = 3
+
+// ParseFailureRate parses a failure rate written as a percentage like 50% or
+// as a fraction like 0.5.
+func ParseFailureRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err == nil && strings.HasSuffix(s, "%") {
+		rate /= 100
+	}
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("invalid failure rate '%s', expected a percentage or a fraction between 0 and 1", s)
+	}
+	return rate, nil
+}
+
+// breaker counts the replacements a rotation attempted and the ones that
+// failed, and trips once the failure budget is exhausted.
+type breaker struct {
+	budget FailureBudget
+
+	mu        sync.Mutex
+	attempted sets.String
+	attempts  map[string]int
+	failures  map[string]int
+	failed    []string
+	// tripped is why the breaker tripped, if it did.
+	tripped string
+}
+
+func newBreaker(budget FailureBudget) *breaker {
+	if budget.MaxFailures == 0 && budget.MaxRate == 0 {
+		budget.MaxFailures = 1
+	}
+	return &breaker{
+		budget:    budget,
+		attempted: sets.NewString(),
+		attempts:  map[string]int{},
+		failures:  map[string]int{},
+	}
+}
+
+// record counts an attempt to replace instanceGroups of an ASG that ended
+// with err, and returns why the breaker tripped if this failure exhausted
+// the budget. A failed batch counts as one failed replacement, of the
+// instance it failed at, out of the replacements it attempted.
+func (b *breaker) record(groupId string, instanceGroups InstanceGroups, err error) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ig := range instanceGroups {
+		b.attempted.Insert(ig.instanceId())
+	}
+	b.attempts[groupId] += len(instanceGroups)
+	phaseErr := replacementFailure(err)
+	if phaseErr == nil {
+		return ""
+	}
+	b.failures[groupId]++
+	b.failed = append(b.failed, phaseErr.Error())
+
+	total := 0
+	for _, n := range b.failures {
+		total += n
+	}
+	attempts, failures := b.attempts[groupId], b.failures[groupId]
+	switch {
+	case !phaseErr.RolledBack:
+		b.tripped = fmt.Sprintf("the failed replacement of instance '%s' could not be rolled back", phaseErr.InstanceID)
+	case b.rateExceeded(attempts, failures):
+		b.tripped = fmt.Sprintf("%d of %d replacements in ASG '%s' failed, more than %g%%",
+			failures, attempts, groupId, b.budget.MaxRate*100)
+	case b.budget.MaxFailures > 0 && total >= int(b.budget.MaxFailures) && total == 1:
+		b.tripped = "a replacement failed"
+	case b.budget.MaxFailures > 0 && total >= int(b.budget.MaxFailures):
+		b.tripped = fmt.Sprintf("%d replacements failed", total)
+	}
+	return b.tripped
+}
+
+func (b *breaker) rateExceeded(attempts, failures int) bool {
+	return b.budget.MaxRate > 0 && attempts >= minRateAttempts && float64(failures)/float64(attempts) > b.budget.MaxRate
+}
+
+// replacementFailure returns the PhaseError of a replacement that failed to
+// join the cluster or become Ready, or nil if err is another failure.
+func replacementFailure(err error) *PhaseError {
+	var phaseErr *PhaseError
+	if errors.As(err, &phaseErr) && (phaseErr.Phase == PhaseJoin || phaseErr.Phase == PhaseReady) {
+		return phaseErr
+	}
+	return nil
+}
+
+// interrupted tells whether err only means that the rotation was cancelled
+// or halted, rather than that a replacement failed.
+func interrupted(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, errHalted)
+}
+
+// attempt runs rotate to replace instanceGroups of an ASG, counting it
+// against the failure budget. A failed replacement that was rolled back
+// within the budget is logged and the rotation carries on; once the budget
+// is exhausted the rotation halts. An attempt that was interrupted doesn't
+// count.
+func (r *Rotator) attempt(ctx context.Context, groupId string, instanceGroups InstanceGroups, rotate func() error) error {
+	err := rotate()
+	if err != nil && interrupted(ctx, err) {
+		return err
+	}
+	// A failed surge batch fails at one of its instances; the others were
+	// either rotated already or are left as they were.
+	var failure *PhaseError
+	if errors.As(err, &failure) {
+		r.metrics.nodeFailed(groupId)
+	}
+	tripped := r.breaker.record(groupId, instanceGroups, err)
+	phaseErr := replacementFailure(err)
+	if phaseErr == nil {
+		return err
+	}
+	if tripped != "" {
+		r.halt()
+		return fmt.Errorf("rotation halted, %s: %w", tripped, err)
+	}
+	logf(ctx, "WARNING: replacing instance '%s' failed; carrying on with the next node: %s", phaseErr.InstanceID, err)
+	return nil
+}
+
+// report lists the failed replacements and, if the breaker tripped, the
+// instances that were not attempted.
+func (b *breaker) report(ctx context.Context, instanceGroups InstanceGroups) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.failed) == 0 {
+		return
+	}
+	if b.tripped != "" {
+		logf(ctx, "Rotation halted because %s.", b.tripped)
+	}
+	logln(ctx, "Failed replacements:")
+	for _, failure := range b.failed {
+		logf(ctx, "  - %s", strings.SplitN(failure, "\n", 2)[0])
+	}
+	notAttempted := b.notAttemptedLocked(instanceGroups)
+	if len(notAttempted) == 0 {
+		return
+	}
+	logln(ctx, "Not attempted:")
+	for _, ig := range notAttempted {
+		logf(ctx, "  - instance '%s' of ASG '%s'", ig.instanceId(), ig.groupId())
+	}
+}
+
+// notAttempted returns the instances the rotation didn't get to because the
+// breaker tripped.
+func (b *breaker) notAttempted(instanceGroups InstanceGroups) InstanceGroups {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.notAttemptedLocked(instanceGroups)
+}
+
+func (b *breaker) notAttemptedLocked(instanceGroups InstanceGroups) InstanceGroups {
+	if b.tripped == "" {
+		return nil
+	}
+	var notAttempted InstanceGroups
+	for _, ig := range instanceGroups {
+		if !b.attempted.Has(ig.instanceId()) {
+			notAttempted = append(notAttempted, ig)
+		}
+	}
+	return notAttempted
+}
+
+// recordNotAttempted marks the instances the breaker kept the rotation from
+// starting as not attempted in the state file.
+func (r *Rotator) recordNotAttempted(ctx context.Context, instanceGroups InstanceGroups) {
+	for _, ig := range r.breaker.notAttempted(instanceGroups) {
+		if r.state.Instance(ig.instanceId()).Status != StatusPending {
+			continue
+		}
+		if err := r.state.record(ig.instanceId(), StatusNotAttempted, nil); err != nil {
+			logf(ctx, "Failed to update state file '%s': %s", r.stateFile, err)
+			return
+		}
+	}
+}
+
+// err returns an error if replacements failed within the budget, so a
+// rotation that carried on past them doesn't pass for a success. resume
+// tells whether the failed instances are retried by resuming.
+func (b *breaker) err(resume bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	total := 0
+	for _, n := range b.failures {
+		total += n
+	}
+	if total == 0 {
+		return nil
+	}
+	if resume {
+		return fmt.Errorf("%d replacements failed and were rolled back; run again with --resume to retry them", total)
+	}
+	return fmt.Errorf("%d replacements failed and were rolled back; run again to retry them", total)
+}
@@ -0,0 +1,164 @@
+package rotator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/tenjin/rotate-eks-asg/internal/pkg/rotator/fake"
+)
+
+func testInstanceGroup(groupId, id string) *InstanceGroup {
+	return &InstanceGroup{
+		instance: &ec2.Instance{InstanceId: aws.String(id)},
+		group:    &autoscaling.Group{AutoScalingGroupName: aws.String(groupId)},
+	}
+}
+
+func failedReplacement(id string) error {
+	return &PhaseError{Phase: PhaseReady, InstanceID: id, RolledBack: true, Err: errors.New("timed out")}
+}
+
+func TestBreakerTrips(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		budget FailureBudget
+		// failures are whether each attempt in turn fails.
+		failures []bool
+		// trips is the attempt that trips the breaker, from 1, or 0.
+		trips  int
+		reason string
+	}{
+		{
+			name:     "first failure by default",
+			failures: []bool{false, true},
+			trips:    2,
+			reason:   "a replacement failed",
+		},
+		{
+			name:     "max failures",
+			budget:   FailureBudget{MaxFailures: 2},
+			failures: []bool{true, false, false, false, true},
+			trips:    5,
+			reason:   "2 replacements failed",
+		},
+		{
+			name:     "max rate alone",
+			budget:   FailureBudget{MaxRate: 0.5},
+			failures: []bool{true, false, true},
+			trips:    3,
+			reason:   "2 of 3 replacements in ASG 'ng-1' failed, more than 50%",
+		},
+		{
+			name:     "max rate before max failures",
+			budget:   FailureBudget{MaxFailures: 5, MaxRate: 0.5},
+			failures: []bool{false, true, true},
+			trips:    3,
+			reason:   "2 of 3 replacements in ASG 'ng-1' failed, more than 50%",
+		},
+		{
+			name:     "within the rate",
+			budget:   FailureBudget{MaxRate: 0.5},
+			failures: []bool{true, false, false, true},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newBreaker(tc.budget)
+			for n, fails := range tc.failures {
+				id := fmt.Sprintf("i-%d", n+1)
+				var err error
+				if fails {
+					err = failedReplacement(id)
+				}
+				tripped := b.record("ng-1", InstanceGroups{testInstanceGroup("ng-1", id)}, err)
+				switch {
+				case n+1 < tc.trips || tc.trips == 0:
+					if tripped != "" {
+						t.Fatalf("attempt %d tripped the breaker: %s", n+1, tripped)
+					}
+				case n+1 == tc.trips:
+					if tripped != tc.reason {
+						t.Fatalf("attempt %d tripped the breaker with '%s', want '%s'", n+1, tripped, tc.reason)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAttemptIgnoresInterruptions(t *testing.T) {
+	c := newTestCluster(t, 1)
+	r := c.rotator(Options{})
+	ig := testInstanceGroup(c.group, "i-1")
+	for _, err := range []error{
+		&PhaseError{Phase: PhaseJoin, InstanceID: "i-1", RolledBack: true, Err: context.Canceled},
+		errHalted,
+	} {
+		if got := r.attempt(context.Background(), c.group, InstanceGroups{ig}, func() error { return err }); got != err {
+			t.Errorf("attempt returned %v, want %v", got, err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := r.attempt(ctx, c.group, InstanceGroups{ig}, func() error { return failedReplacement("i-1") })
+	if err == nil || strings.Contains(err.Error(), "halted") {
+		t.Errorf("attempt returned %v, want the failure without halting", err)
+	}
+	if r.isHalted() {
+		t.Error("interruptions halted the rotation")
+	}
+	if err := r.breaker.err(false); err != nil {
+		t.Errorf("interruptions counted as failures: %s", err)
+	}
+}
+
+func TestBreakerMarksNotAttemptedInstances(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.sim.Faults = func(string, *ec2.Instance) fake.Fault { return fake.NeverReady }
+	r := c.rotator(rollbackOptions(t))
+
+	err := r.Rotate(context.Background(), c.group)
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) || !strings.Contains(err.Error(), "rotation halted") {
+		t.Fatalf("rotation failed with %v, want it halted by a failed replacement", err)
+	}
+	state, err := LoadState(r.stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range c.original {
+		want := StatusNotAttempted
+		if id == phaseErr.InstanceID {
+			want = StatusPending
+		}
+		if got := state.Instance(id).Status; got != want {
+			t.Errorf("instance '%s' is %s in the state file, want %s", id, got, want)
+		}
+	}
+	if unfinished := state.Unfinished(); len(unfinished) != 3 {
+		t.Errorf("%d instances are left to resume, want 3", len(unfinished))
+	}
+}
+
+func TestBreakerCountsFailedBatchOnce(t *testing.T) {
+	batch := InstanceGroups{
+		testInstanceGroup("ng-1", "i-1"),
+		testInstanceGroup("ng-1", "i-2"),
+		testInstanceGroup("ng-1", "i-3"),
+	}
+	for _, budget := range []FailureBudget{{MaxFailures: 2}, {MaxRate: 0.5}} {
+		b := newBreaker(budget)
+		if tripped := b.record("ng-1", batch, failedReplacement("i-2")); tripped != "" {
+			t.Errorf("a batch failing at one instance tripped budget %+v: %s", budget, tripped)
+		}
+		if err := b.err(false); err == nil || !strings.HasPrefix(err.Error(), "1 replacements failed") {
+			t.Errorf("breaker reported %v, want 1 failed replacement", err)
+		}
+	}
+}
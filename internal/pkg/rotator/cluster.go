@@ -2,24 +2,27 @@ package rotator
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
-	"os"
 	"strings"
 	"time"
 
 	coreV1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/kubectl/pkg/drain"
 )
 
+// Node joins and readiness are detected by watching Nodes. If a watch can't
+// be established the rotator falls back to polling at these intervals.
 var (
-	DefaultNodeAwaitJoinTimeout      = 30 * time.Second
-	DefaultNodeAwaitReadinessTimeout = 10 * time.Second
+	NodeJoinPollInterval      = 30 * time.Second
+	NodeReadinessPollInterval = 10 * time.Second
 )
 
 func GetClusterConfig() (*rest.Config, error) {
@@ -28,90 +31,194 @@ func GetClusterConfig() (*rest.Config, error) {
 	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides).ClientConfig()
 }
 
-func GetClusterNodeSet(ctx context.Context, k8s *kubernetes.Clientset) (sets.String, error) {
-	nodes, err := getClusterNodes(ctx, k8s)
+// AwaitNewNodeReady waits for the Node of a replacement instance to join the
+// cluster and become Ready.
+func AwaitNewNodeReady(ctx context.Context, k8s kubernetes.Interface, replacement *Replacement) error {
+	node, err := awaitReplacementJoin(ctx, k8s, replacement)
 	if err != nil {
-		return nil, err
-	}
-	set := sets.NewString()
-	for _, node := range nodes {
-		set.Insert(string(node.UID))
+		return err
 	}
-	return set, nil
+	return awaitNodeReadiness(ctx, k8s, node)
 }
 
-func AwaitNewNodeReady(ctx context.Context, k8s *kubernetes.Clientset, nodes sets.String) error {
-	errors := make(chan error)
-	go func() { errors <- awaitNewNodeReady(ctx, k8s, nodes) }()
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case err := <-errors:
-		return err
+func awaitReplacementJoin(ctx context.Context, k8s kubernetes.Interface, replacement *Replacement) (*coreV1.Node, error) {
+	logf(ctx, "Waiting for the node of instance '%s' to join cluster...", replacement.InstanceID)
+	node, err := awaitNode(ctx, k8s, NodeJoinPollInterval, func(node *coreV1.Node) bool {
+		return nodeMatchesInstance(node, replacement.InstanceID, replacement.AvailabilityZone)
+	})
+	if err != nil {
+		return nil, err
 	}
+	logf(ctx, "Node '%s' joined cluster.", node.Name)
+	return node, nil
 }
 
-func awaitNewNodeReady(ctx context.Context, k8s *kubernetes.Clientset, nodes sets.String) error {
-	node, err := awaitNewNodeJoin(ctx, k8s, nodes)
+func awaitNodeReadiness(ctx context.Context, k8s kubernetes.Interface, node *coreV1.Node) error {
+	logf(ctx, "Waiting for node '%s' to be ready...", node.Name)
+	_, err := awaitNode(ctx, k8s, NodeReadinessPollInterval, func(n *coreV1.Node) bool {
+		return n.Name == node.Name && isNodeReady(n)
+	})
 	if err != nil {
 		return err
 	}
-	if err := awaitNodeReadiness(ctx, k8s, node); err != nil {
-		return err
-	}
+	logf(ctx, "Node '%s' is ready.", node.Name)
 	return nil
 }
 
-func awaitNewNodeJoin(ctx context.Context, k8s *kubernetes.Clientset, known sets.String) (*coreV1.Node, error) {
-	for {
-		log.Printf("Waiting %s for new node to join cluster...", DefaultNodeAwaitJoinTimeout.String())
-		time.Sleep(DefaultNodeAwaitJoinTimeout)
+// nodeMatchesInstance tells whether node runs on the given instance. Its
+// provider ID has the form aws:///<zone>/<instance ID>; an empty zone matches
+// any zone.
+func nodeMatchesInstance(node *coreV1.Node, id, zone string) bool {
+	providerID := node.Spec.ProviderID
+	if !strings.HasSuffix(providerID, "/"+id) {
+		return false
+	}
+	return zone == "" || strings.HasSuffix(providerID, "/"+zone+"/"+id)
+}
 
-		nodes, err := getClusterNodes(ctx, k8s)
+func isNodeReady(node *coreV1.Node) bool {
+	for _, c := range node.Status.Conditions {
+		if c.Type == coreV1.NodeReady && c.Status == coreV1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// awaitNode blocks until a Node matching match exists. Nodes are watched so
+// changes are seen as soon as they happen, and watched again when a watch
+// ends or fails; should a watch not be established at all, the Nodes are
+// polled every interval instead.
+func awaitNode(
+	ctx context.Context,
+	k8s kubernetes.Interface,
+	interval time.Duration,
+	match func(*coreV1.Node) bool,
+) (*coreV1.Node, error) {
+	node, err := watchNode(ctx, k8s, match)
+	if err == nil || ctx.Err() != nil {
+		return node, err
+	}
+	logf(ctx, "Watching nodes failed (%s), polling every %s instead.", err, interval)
+	return pollNode(ctx, k8s, interval, match)
+}
+
+func watchNode(ctx context.Context, k8s kubernetes.Interface, match func(*coreV1.Node) bool) (*coreV1.Node, error) {
+	for {
+		list, err := k8s.CoreV1().Nodes().List(ctx, v1.ListOptions{})
 		if err != nil {
 			return nil, err
 		}
-		for _, node := range nodes {
-			if known.Has(string(node.UID)) {
-				continue
+		for n := range list.Items {
+			if match(&list.Items[n]) {
+				return &list.Items[n], nil
 			}
-			log.Printf("Node '%s' joined cluster.", node.Name)
-			return node, nil
 		}
+		w, err := k8s.CoreV1().Nodes().Watch(ctx, v1.ListOptions{ResourceVersion: list.ResourceVersion})
+		if err != nil {
+			return nil, err
+		}
+		node, err := awaitWatchEvent(ctx, w, match)
+		w.Stop()
+		if err == errWatchClosed {
+			// The API server ends watches periodically, start over.
+			continue
+		}
+		var status apierrors.APIStatus
+		if errors.As(err, &status) {
+			// The watch itself failed, e.g. because the resource version
+			// it started from expired; list and watch again.
+			if !apierrors.IsResourceExpired(err) && !apierrors.IsGone(err) {
+				logf(ctx, "Watching nodes failed (%s), watching again.", err)
+				if err := sleepContext(ctx, watchRetryDelay); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		return node, err
 	}
 }
 
-func awaitNodeReadiness(ctx context.Context, k8s *kubernetes.Clientset, node *coreV1.Node) error {
+var errWatchClosed = errors.New("watch closed")
+
+// watchRetryDelay is how long to wait before watching Nodes again after a
+// watch failed with an error other than an expired resource version.
+var watchRetryDelay = time.Second
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func awaitWatchEvent(ctx context.Context, w watch.Interface, match func(*coreV1.Node) bool) (*coreV1.Node, error) {
 	for {
-		log.Printf("Waiting %s for new node to be ready...", DefaultNodeAwaitReadinessTimeout.String())
-		time.Sleep(DefaultNodeAwaitReadinessTimeout)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return nil, errWatchClosed
+			}
+			switch event.Type {
+			case watch.Error:
+				return nil, apierrors.FromObject(event.Object)
+			case watch.Added, watch.Modified:
+				if node, ok := event.Object.(*coreV1.Node); ok && match(node) {
+					return node, nil
+				}
+			}
+		}
+	}
+}
 
-		n, err := k8s.CoreV1().Nodes().Get(ctx, node.Name, v1.GetOptions{})
+func pollNode(
+	ctx context.Context,
+	k8s kubernetes.Interface,
+	interval time.Duration,
+	match func(*coreV1.Node) bool,
+) (*coreV1.Node, error) {
+	var found *coreV1.Node
+	err := wait.PollImmediateUntil(interval, func() (bool, error) {
+		nodes, err := getClusterNodes(ctx, k8s)
 		if err != nil {
-			return err
+			return false, err
 		}
-		for _, c := range n.Status.Conditions {
-			if c.Type == coreV1.NodeReady && c.Status == coreV1.ConditionTrue {
-				return nil
+		for _, node := range nodes {
+			if match(node) {
+				found = node
+				return true, nil
 			}
 		}
+		return false, nil
+	}, ctx.Done())
+	if err == wait.ErrWaitTimeout && ctx.Err() != nil {
+		return nil, ctx.Err()
 	}
+	return found, err
 }
 
-func GetNodeByInstanceID(ctx context.Context, k8s *kubernetes.Clientset, id string) (*coreV1.Node, error) {
+func GetNodeByInstanceID(ctx context.Context, k8s kubernetes.Interface, id string) (*coreV1.Node, error) {
 	nodes, err := getClusterNodes(ctx, k8s)
 	if err != nil {
 		return nil, err
 	}
 	for _, node := range nodes {
-		if strings.HasSuffix(node.Spec.ProviderID, id) {
+		if nodeMatchesInstance(node, id, "") {
 			return node, nil
 		}
 	}
 	return nil, fmt.Errorf("node '%s' is not part of the cluster", id)
 }
 
-func getClusterNodes(ctx context.Context, k8s *kubernetes.Clientset) ([]*coreV1.Node, error) {
+func getClusterNodes(ctx context.Context, k8s kubernetes.Interface) ([]*coreV1.Node, error) {
 	list, err := k8s.CoreV1().Nodes().List(ctx, v1.ListOptions{})
 	if err != nil {
 		return nil, err
@@ -124,23 +231,38 @@ func getClusterNodes(ctx context.Context, k8s *kubernetes.Clientset) ([]*coreV1.
 	return nodes, nil
 }
 
-func getDrainHelper(ctx context.Context, k8s *kubernetes.Clientset) *drain.Helper {
+func getDrainHelper(ctx context.Context, k8s kubernetes.Interface, opts DrainOptions, timeout time.Duration) *drain.Helper {
 	return &drain.Helper{
-		Ctx:                 ctx,
-		Client:              k8s,
-		Force:               true,
-		GracePeriodSeconds:  -1,
-		IgnoreAllDaemonSets: true,
-		Out:                 os.Stdout,
-		ErrOut:              os.Stdout,
-		DeleteEmptyDirData:  true,
-		Timeout:             time.Duration(600) * time.Second,
+		Ctx:                             ctx,
+		Client:                          k8s,
+		Force:                           opts.Force,
+		GracePeriodSeconds:              opts.GracePeriodSeconds,
+		IgnoreAllDaemonSets:             opts.IgnoreAllDaemonSets,
+		Out:                             logWriter(ctx),
+		ErrOut:                          logWriter(ctx),
+		DeleteEmptyDirData:              opts.DeleteEmptyDirData,
+		PodSelector:                     opts.PodSelector,
+		SkipWaitForDeleteTimeoutSeconds: opts.SkipWaitForDeleteTimeoutSeconds,
+		DisableEviction:                 opts.DisableEviction,
+		Timeout:                         timeout,
 	}
 }
 
-func DrainNode(ctx context.Context, k8s *kubernetes.Clientset, node *coreV1.Node) error {
-	log.Printf("Draining node '%s'.", node.Name)
-	helper := getDrainHelper(ctx, k8s)
+// DrainNode drains node, calling onEvicted, if set, for each pod it evicts or
+// deletes.
+func DrainNode(
+	ctx context.Context,
+	k8s kubernetes.Interface,
+	node *coreV1.Node,
+	opts DrainOptions,
+	timeout time.Duration,
+	onEvicted func(pod *coreV1.Pod),
+) error {
+	logf(ctx, "Draining node '%s'.", node.Name)
+	helper := getDrainHelper(ctx, k8s, opts, timeout)
+	if onEvicted != nil {
+		helper.OnPodDeletedOrEvicted = func(pod *coreV1.Pod, _ bool) { onEvicted(pod) }
+	}
 	err := drain.RunNodeDrain(helper, node.Name)
 	if err != nil {
 		return err
@@ -148,12 +270,28 @@ func DrainNode(ctx context.Context, k8s *kubernetes.Clientset, node *coreV1.Node
 	return nil
 }
 
-func CordonNode(ctx context.Context, k8s *kubernetes.Clientset, node *coreV1.Node) error {
-	log.Printf("Cordoning node '%s'.", node.Name)
-	helper := getDrainHelper(ctx, k8s)
+func CordonNode(ctx context.Context, k8s kubernetes.Interface, node *coreV1.Node) error {
+	logf(ctx, "Cordoning node '%s'.", node.Name)
+	helper := getDrainHelper(ctx, k8s, DrainOptions{}, 0)
 	err := drain.RunCordonOrUncordon(helper, node, true)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+func UncordonNode(ctx context.Context, k8s kubernetes.Interface, node *coreV1.Node) error {
+	logf(ctx, "Uncordoning node '%s'.", node.Name)
+	// The cordon helper compares against the object it is given, so make sure
+	// it sees the node as currently cordoned.
+	current, err := k8s.CoreV1().Nodes().Get(ctx, node.Name, v1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	helper := getDrainHelper(ctx, k8s, DrainOptions{}, 0)
+	err = drain.RunCordonOrUncordon(helper, current, false)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package rotator
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newNode(name, instanceId string) *coreV1.Node {
+	return &coreV1.Node{
+		ObjectMeta: v1.ObjectMeta{Name: name},
+		Spec:       coreV1.NodeSpec{ProviderID: "aws:///us-east-1a/" + instanceId},
+	}
+}
+
+// createNodeLater creates node once whatever awaits it had time to start
+// watching.
+func createNodeLater(t *testing.T, client *k8sfake.Clientset, node *coreV1.Node) {
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := client.CoreV1().Nodes().Create(context.Background(), node, v1.CreateOptions{}); err != nil {
+			t.Error(err)
+		}
+	}()
+}
+
+func TestAwaitNodeWatchesAgainAfterExpiredWatch(t *testing.T) {
+	client := k8sfake.NewSimpleClientset()
+	watches := 0
+	client.PrependWatchReactor("nodes", func(k8stesting.Action) (bool, watch.Interface, error) {
+		watches++
+		if watches > 1 {
+			return false, nil, nil
+		}
+		w := watch.NewFakeWithChanSize(1, false)
+		w.Error(&v1.Status{
+			Status:  v1.StatusFailure,
+			Code:    http.StatusGone,
+			Reason:  v1.StatusReasonExpired,
+			Message: "too old resource version",
+		})
+		return true, w, nil
+	})
+	createNodeLater(t, client, newNode("node-1", "i-1"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Polling an hour apart would time out, so the node must be seen by a
+	// second watch.
+	node, err := awaitNode(ctx, client, time.Hour, func(n *coreV1.Node) bool {
+		return nodeMatchesInstance(n, "i-1", "")
+	})
+	if err != nil {
+		t.Fatalf("awaitNode failed: %v", err)
+	}
+	if node.Name != "node-1" {
+		t.Errorf("awaitNode returned node '%s', want 'node-1'", node.Name)
+	}
+	if watches < 2 {
+		t.Errorf("nodes were watched %d times, want at least 2", watches)
+	}
+}
+
+func TestAwaitNodePollsWhenWatchFails(t *testing.T) {
+	client := k8sfake.NewSimpleClientset()
+	client.PrependWatchReactor("nodes", func(k8stesting.Action) (bool, watch.Interface, error) {
+		return true, nil, errors.New("watch not allowed")
+	})
+	createNodeLater(t, client, newNode("node-1", "i-1"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	node, err := awaitNode(ctx, client, 10*time.Millisecond, func(n *coreV1.Node) bool {
+		return nodeMatchesInstance(n, "i-1", "")
+	})
+	if err != nil {
+		t.Fatalf("awaitNode failed: %v", err)
+	}
+	if node.Name != "node-1" {
+		t.Errorf("awaitNode returned node '%s', want 'node-1'", node.Name)
+	}
+}
+
+func TestAwaitNodeStopsWithContext(t *testing.T) {
+	client := k8sfake.NewSimpleClientset()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := awaitNode(ctx, client, time.Hour, func(*coreV1.Node) bool { return true })
+	if err != context.DeadlineExceeded {
+		t.Errorf("awaitNode returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,64 @@
+package rotator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// HoldPollInterval is how often a held rotation checks whether it may go on.
+var HoldPollInterval = time.Second
+
+// Hold makes the rotation finish the nodes it is rotating and then wait
+// before the next one until Release is called. It is safe to call while the
+// rotation runs.
+func (r *Rotator) Hold() { atomic.StoreInt32(&r.held, 1) }
+
+// Release lets a rotation held by Hold go on with the next node.
+func (r *Rotator) Release() { atomic.StoreInt32(&r.held, 0) }
+
+// Stop makes the rotation finish the nodes it is rotating and then stop, as
+// if paused for reason. It is safe to call while the rotation runs.
+func (r *Rotator) Stop(reason string) { r.pause(reason) }
+
+// holdReason tells what the rotation is held until, or returns "" if it isn't
+// held.
+func (r *Rotator) holdReason() string {
+	if atomic.LoadInt32(&r.held) == 1 {
+		return "until it is resumed"
+	}
+	if r.controlFile == "" {
+		return ""
+	}
+	if _, err := os.Stat(r.controlFile); err == nil {
+		return fmt.Sprintf("until '%s' is removed", r.controlFile)
+	}
+	return ""
+}
+
+// awaitRelease waits before instanceId, the next instance to rotate, for as
+// long as the rotation is held and not stopped.
+func (r *Rotator) awaitRelease(ctx context.Context, instanceId string) error {
+	reason := r.holdReason()
+	if reason == "" || r.dryrun || r.isHalted() {
+		return nil
+	}
+	logf(ctx, "Rotation held before instance '%s' %s.", instanceId, reason)
+	err := wait.PollImmediateUntil(HoldPollInterval, func() (bool, error) {
+		return r.isHalted() || r.holdReason() == "", nil
+	}, ctx.Done())
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	if !r.isHalted() {
+		logln(ctx, "Rotation resumed.")
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package rotator
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/tenjin/rotate-eks-asg/internal/pkg/rotator/fake"
+)
+
+// onFirstLaunch calls f once the ASG launches the first replacement, while
+// the rotation of the first node is under way.
+func (c *testCluster) onFirstLaunch(f func()) {
+	launched := make(chan struct{})
+	c.sim.Faults = func(string, *ec2.Instance) fake.Fault {
+		select {
+		case <-launched:
+		default:
+			close(launched)
+			f()
+		}
+		return fake.NoFault
+	}
+}
+
+// rotateInBackground starts rotating the ASG and returns where the rotation
+// sends its result.
+func (c *testCluster) rotateInBackground(r *Rotator) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- r.Rotate(context.Background(), c.group) }()
+	return done
+}
+
+// awaitHeld waits long enough for a held rotation to have gone on if it
+// weren't held, and fails unless it is still running with only rotated
+// instances rotated.
+func (c *testCluster) awaitHeld(t *testing.T, done <-chan error, rotated int) {
+	select {
+	case err := <-done:
+		t.Fatalf("held rotation ended with %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if detached := c.detached(t); len(detached) != rotated {
+		t.Fatalf("instances %v were rotated while held, want %d", detached, rotated)
+	}
+}
+
+func TestHoldAfterCurrentNode(t *testing.T) {
+	c := newTestCluster(t, 2)
+	logged := captureLog(t)
+	r := c.rotator(Options{})
+	c.onFirstLaunch(r.Hold)
+
+	done := c.rotateInBackground(r)
+	c.awaitHeld(t, done, 1)
+	r.Release()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if left := c.running(c.original...); len(left) > 0 {
+		t.Errorf("old instances %v still run", left)
+	}
+	held := fmt.Sprintf("Rotation held before instance '%s' until it is resumed.", c.original[1])
+	if !strings.Contains(logged.String(), held) || !strings.Contains(logged.String(), "Rotation resumed.") {
+		t.Errorf("log doesn't tell the hold:\n%s", logged)
+	}
+}
+
+func TestControlFileHoldsRotation(t *testing.T) {
+	c := newTestCluster(t, 2)
+	logged := captureLog(t)
+	control := filepath.Join(t.TempDir(), "hold")
+	if err := ioutil.WriteFile(control, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := c.rotator(Options{ControlFile: control})
+
+	done := c.rotateInBackground(r)
+	c.awaitHeld(t, done, 0)
+	if err := os.Remove(control); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if left := c.running(c.original...); len(left) > 0 {
+		t.Errorf("old instances %v still run", left)
+	}
+	held := fmt.Sprintf("Rotation held before instance '%s' until '%s' is removed.", c.original[0], control)
+	if !strings.Contains(logged.String(), held) {
+		t.Errorf("log doesn't tell the hold:\n%s", logged)
+	}
+}
+
+func TestStopAfterCurrentNode(t *testing.T) {
+	c := newTestCluster(t, 3)
+	opts := Options{StateFile: stateFile(t)}
+	r := c.rotator(opts)
+	c.onFirstLaunch(func() { r.Stop("stopped by interrupt") })
+
+	err := r.Rotate(context.Background(), c.group)
+	if err == nil || err.Error() != "rotation paused: stopped by interrupt; run again with --resume to continue" {
+		t.Fatalf("rotation ended with %v, want it stopped", err)
+	}
+	// The node being rotated is finished.
+	if left := c.running(c.original...); len(left) != 2 {
+		t.Fatalf("ASG runs old instances %v, want all but the first", left)
+	}
+
+	if err := c.rotator(opts).Resume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if left := c.running(c.original...); len(left) > 0 {
+		t.Errorf("old instances %v still run", left)
+	}
+}
+
+func TestStopReleasesHeldRotation(t *testing.T) {
+	c := newTestCluster(t, 2)
+	r := c.rotator(Options{})
+	r.Hold()
+
+	done := c.rotateInBackground(r)
+	c.awaitHeld(t, done, 0)
+	r.Stop("stopped by interrupt")
+	if err := <-done; err == nil || err.Error() != "rotation paused: stopped by interrupt" {
+		t.Fatalf("rotation ended with %v, want it stopped", err)
+	}
+	if left := c.running(c.original...); len(left) != 2 {
+		t.Errorf("ASG runs old instances %v, want all of them", left)
+	}
+}
+
+func TestStopBeforeRotatingInstance(t *testing.T) {
+	c := newTestCluster(t, 1)
+	r := c.rotator(Options{})
+	r.Stop("stopped by interrupt")
+	igs, err := DescribeAutoScalingGroup(r.asg, r.ec2, c.group)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.RotateInstance(context.Background(), igs[0], false); err == nil || err.Error() != "rotation paused: stopped by interrupt" {
+		t.Fatalf("rotation ended with %v, want it stopped", err)
+	}
+	if left := c.running(c.original...); len(left) != 1 {
+		t.Errorf("instance was rotated after the rotation was stopped")
+	}
+}
@@ -0,0 +1,219 @@
+package rotator
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// GroupSelector picks the ASGs a cluster-wide rotation covers.
+type GroupSelector struct {
+	// Tags must all be carried by an ASG, on top of the tags marking it as
+	// belonging to the cluster. Without any, all the cluster's ASGs are
+	// picked.
+	Tags []TagSelector
+	// Include, if set, keeps only the ASGs whose name matches one of these
+	// patterns.
+	Include []NamePattern
+	// Exclude leaves out the ASGs whose name matches one of these patterns.
+	Exclude []NamePattern
+}
+
+// TagSelector matches ASGs carrying a tag with Key and one of Values, or any
+// value if Values is empty.
+type TagSelector struct {
+	Key    string
+	Values []string
+}
+
+func (t TagSelector) String() string {
+	if len(t.Values) == 0 {
+		return t.Key
+	}
+	return t.Key + "=" + strings.Join(t.Values, ",")
+}
+
+// ParseTagSelector parses a tag selector written as key, or key=value with
+// alternative values separated by commas.
+func ParseTagSelector(s string) (TagSelector, error) {
+	key, values := s, ""
+	if i := strings.Index(s, "="); i >= 0 {
+		key, values = s[:i], s[i+1:]
+		if values == "" {
+			return TagSelector{}, fmt.Errorf("tag selector '%s' has no values", s)
+		}
+	}
+	if key == "" {
+		return TagSelector{}, fmt.Errorf("tag selector '%s' has no key", s)
+	}
+	t := TagSelector{Key: key}
+	if values != "" {
+		t.Values = strings.Split(values, ",")
+	}
+	return t, nil
+}
+
+// NamePattern matches ASG names against a glob, or against a regular
+// expression written between slashes, e.g. /^ng-(a|b)-/.
+type NamePattern struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// ParseNamePattern parses a glob or a /regular expression/.
+func ParseNamePattern(s string) (NamePattern, error) {
+	if len(s) > 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+		re, err := regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return NamePattern{}, fmt.Errorf("invalid ASG name pattern '%s': %v", s, err)
+		}
+		return NamePattern{pattern: s, re: re}, nil
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return NamePattern{}, fmt.Errorf("invalid ASG name pattern '%s': %v", s, err)
+	}
+	return NamePattern{pattern: s}, nil
+}
+
+func (p NamePattern) Match(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	ok, _ := path.Match(p.pattern, name)
+	return ok
+}
+
+func (p NamePattern) String() string { return p.pattern }
+
+// ParseGroupSelector parses the tag selectors and the name patterns of ASGs
+// to include and exclude.
+func ParseGroupSelector(tags, include, exclude []string) (GroupSelector, error) {
+	var selector GroupSelector
+	for _, s := range tags {
+		t, err := ParseTagSelector(s)
+		if err != nil {
+			return selector, err
+		}
+		selector.Tags = append(selector.Tags, t)
+	}
+	for _, s := range include {
+		p, err := ParseNamePattern(s)
+		if err != nil {
+			return selector, err
+		}
+		selector.Include = append(selector.Include, p)
+	}
+	for _, s := range exclude {
+		p, err := ParseNamePattern(s)
+		if err != nil {
+			return selector, err
+		}
+		selector.Exclude = append(selector.Exclude, p)
+	}
+	return selector, nil
+}
+
+// clusterTags are the tags that mark an ASG as belonging to a cluster: the
+// ones set by the Kubernetes cloud provider, eksctl and Terraform modules,
+// and the one EKS sets on the ASGs of managed node groups. Any of them will
+// do.
+func clusterTags(clusterName string) []TagSelector {
+	return []TagSelector{
+		{Key: "k8s.io/cluster/" + clusterName, Values: []string{"owned"}},
+		{Key: "kubernetes.io/cluster/" + clusterName, Values: []string{"owned", "shared"}},
+		{Key: eksClusterNameTag, Values: []string{clusterName}},
+	}
+}
+
+// findGroups returns the names of the ASGs the selector picks for a cluster,
+// sorted. Only ASGs belonging to the cluster are picked, whatever tags are
+// selected.
+func (r *Rotator) findGroups(ctx context.Context, clusterName string) ([]string, error) {
+	owned := sets.NewString()
+	for _, tag := range clusterTags(clusterName) {
+		found, err := FindGroupsByTag(r.asg, tag.Key, tag.Values)
+		if err != nil {
+			return nil, err
+		}
+		owned = owned.Union(found)
+	}
+	// The ASGs of managed node groups may predate the EKS tag.
+	for groupId := range r.nodegroups {
+		owned.Insert(groupId)
+	}
+
+	names := owned
+	if len(r.discovery.Tags) > 0 {
+		var tagged sets.String
+		for _, tag := range r.discovery.Tags {
+			found, err := FindGroupsByTag(r.asg, tag.Key, tag.Values)
+			if err != nil {
+				return nil, err
+			}
+			if tagged == nil {
+				tagged = found
+			} else {
+				tagged = tagged.Intersection(found)
+			}
+		}
+		for _, name := range tagged.Difference(owned).List() {
+			logf(ctx, "Skipping ASG '%s': it doesn't belong to cluster '%s'.\n", name, clusterName)
+		}
+		names = tagged.Intersection(owned)
+	}
+
+	var selected []string
+	for _, name := range names.List() {
+		if reason := r.discovery.excludes(name); reason != "" {
+			logf(ctx, "Skipping ASG '%s': %s.\n", name, reason)
+			continue
+		}
+		selected = append(selected, name)
+	}
+	return selected, nil
+}
+
+// excludes tells why the selector leaves out an ASG by its name. It returns
+// an empty string if the ASG is kept.
+func (s GroupSelector) excludes(name string) string {
+	for _, p := range s.Exclude {
+		if p.Match(name) {
+			return fmt.Sprintf("excluded by '%s'", p)
+		}
+	}
+	if len(s.Include) == 0 {
+		return ""
+	}
+	for _, p := range s.Include {
+		if p.Match(name) {
+			return ""
+		}
+	}
+	return "matches none of the included names"
+}
+
+// describeSelected logs why an ASG is part of a cluster-wide rotation.
+func (r *Rotator) describeSelected(ctx context.Context, group *autoscaling.Group, clusterName string) {
+	groupId := aws.StringValue(group.AutoScalingGroupName)
+	if nodegroup := r.nodegroups[groupId]; nodegroup != nil {
+		describeNodegroup(ctx, groupId, nodegroup)
+		return
+	}
+	if len(r.discovery.Tags) == 0 {
+		logf(ctx, "ASG '%s' is owned by cluster '%s'.\n", groupId, clusterName)
+		return
+	}
+	tags := make([]string, 0, len(r.discovery.Tags))
+	for _, tag := range r.discovery.Tags {
+		tags = append(tags, tag.String())
+	}
+	sort.Strings(tags)
+	logf(ctx, "ASG '%s' matches tags '%s'.\n", groupId, strings.Join(tags, "', '"))
+}
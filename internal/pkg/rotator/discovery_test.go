@@ -0,0 +1,54 @@
+package rotator
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/tenjin/rotate-eks-asg/internal/pkg/rotator/fake"
+)
+
+func TestFindGroupsOnlyPicksTheClustersGroups(t *testing.T) {
+	c := fake.NewCloud()
+	zones := []string{"us-east-1a"}
+	c.AddGroup("ng-payments", 1, zones, map[string]string{
+		"kubernetes.io/cluster/prod": "owned",
+		"team":                       "payments",
+	})
+	c.AddGroup("ng-search", 1, zones, map[string]string{
+		"kubernetes.io/cluster/prod": "owned",
+		"team":                       "search",
+	})
+	c.AddGroup("staging-payments", 1, zones, map[string]string{
+		"kubernetes.io/cluster/staging": "owned",
+		"team":                          "payments",
+	})
+
+	for _, tc := range []struct {
+		name string
+		tags []string
+		want []string
+	}{
+		{name: "cluster tags", want: []string{"ng-payments", "ng-search"}},
+		{name: "team tag", tags: []string{"team=payments"}, want: []string{"ng-payments"}},
+		{name: "tag of another cluster", tags: []string{"kubernetes.io/cluster/staging"}, want: nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			discovery, err := ParseGroupSelector(tc.tags, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewRotatorWithClients(Options{Discovery: discovery},
+				c.AutoScaling(), c.EC2(), c.EKS(), nil, k8sfake.NewSimpleClientset())
+			got, err := r.findGroups(context.Background(), "prod")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("findGroups picked %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
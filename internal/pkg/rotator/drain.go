@@ -0,0 +1,88 @@
+package rotator
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// DrainOptions configures how nodes are drained, mirroring the flags of
+// kubectl drain.
+type DrainOptions struct {
+	// Force deletes pods that no controller manages.
+	Force bool `json:"force"`
+	// DeleteEmptyDirData deletes pods with emptyDir volumes, and their data.
+	DeleteEmptyDirData bool `json:"deleteEmptyDirData"`
+	// IgnoreAllDaemonSets leaves DaemonSet pods on the node instead of
+	// failing the drain.
+	IgnoreAllDaemonSets bool `json:"ignoreAllDaemonSets"`
+	// GracePeriodSeconds overrides the termination grace period of the
+	// pods; -1 uses each pod's own.
+	GracePeriodSeconds int `json:"gracePeriodSeconds"`
+	// PodSelector, if set, only drains the pods matching this label
+	// selector.
+	PodSelector string `json:"podSelector,omitempty"`
+	// SkipWaitForDeleteTimeoutSeconds stops waiting for pods whose deletion
+	// timestamp is older than this many seconds; 0 always waits.
+	SkipWaitForDeleteTimeoutSeconds int `json:"skipWaitForDeleteTimeoutSeconds,omitempty"`
+	// DisableEviction deletes pods instead of evicting them, bypassing
+	// PodDisruptionBudgets.
+	DisableEviction bool `json:"disableEviction,omitempty"`
+}
+
+// DefaultDrainOptions drain whatever is on a node, as the rotator always has.
+var DefaultDrainOptions = DrainOptions{
+	Force:               true,
+	DeleteEmptyDirData:  true,
+	IgnoreAllDaemonSets: true,
+	GracePeriodSeconds:  -1,
+}
+
+// StrictDrainOptions fail the drain of a node running unmanaged pods or pods
+// with emptyDir data instead of deleting them.
+var StrictDrainOptions = DrainOptions{
+	IgnoreAllDaemonSets: true,
+	GracePeriodSeconds:  -1,
+}
+
+// DrainProfiles are the named sets of drain options.
+var DrainProfiles = map[string]DrainOptions{
+	"default": DefaultDrainOptions,
+	"strict":  StrictDrainOptions,
+}
+
+// LoadDrainOptions reads drain options from a YAML or JSON file. Options the
+// file leaves out keep their value in base.
+func LoadDrainOptions(path string, base DrainOptions) (DrainOptions, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return base, err
+	}
+	opts := base
+	if err := yaml.UnmarshalStrict(data, &opts); err != nil {
+		return base, fmt.Errorf("drain config '%s': %v", path, err)
+	}
+	return opts, nil
+}
+
+// Validate checks that the options can be passed to the drain helper.
+func (o DrainOptions) Validate() error {
+	if _, err := labels.Parse(o.PodSelector); err != nil {
+		return fmt.Errorf("invalid pod selector '%s': %v", o.PodSelector, err)
+	}
+	if o.SkipWaitForDeleteTimeoutSeconds < 0 {
+		return fmt.Errorf("skip-wait-for-delete timeout must not be negative")
+	}
+	return nil
+}
+
+// podSelector returns the selector of the pods a drain removes.
+func (o DrainOptions) podSelector() labels.Selector {
+	selector, err := labels.Parse(o.PodSelector)
+	if err != nil {
+		return labels.Everything()
+	}
+	return selector
+}
@@ -0,0 +1,57 @@
+package rotator
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// podsOf returns the names of the pods labelled app=name that are left.
+func (c *testCluster) podsOf(t *testing.T, name string) []string {
+	pods, err := c.client.CoreV1().Pods("default").List(context.Background(), v1.ListOptions{LabelSelector: "app=" + name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, pod := range pods.Items {
+		names = append(names, pod.Name)
+	}
+	return names
+}
+
+func TestStrictDrainRefusesUnmanagedPods(t *testing.T) {
+	c := newTestCluster(t, 2)
+	c.addPods(t, "batch", c.original[0], 1)
+	drain := StrictDrainOptions
+	r := c.rotator(Options{Drain: &drain})
+
+	err := r.Rotate(context.Background(), c.group)
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) || phaseErr.Phase != PhaseDrain || phaseErr.InstanceID != c.original[0] {
+		t.Fatalf("rotation failed with %v, want the drain phase error of instance '%s'", err, c.original[0])
+	}
+	if pods := c.podsOf(t, "batch"); len(pods) != 1 {
+		t.Errorf("pods %v are left, want the unmanaged pod kept", pods)
+	}
+}
+
+func TestDrainPodSelector(t *testing.T) {
+	c := newTestCluster(t, 1)
+	c.addPods(t, "web", c.original[0], 1)
+	c.addPods(t, "agent", c.original[0], 1)
+	drain := DefaultDrainOptions
+	drain.PodSelector = "app=web"
+	r := c.rotator(Options{Drain: &drain})
+
+	if err := r.Rotate(context.Background(), c.group); err != nil {
+		t.Fatal(err)
+	}
+	if pods := c.podsOf(t, "web"); len(pods) > 0 {
+		t.Errorf("selected pods %v were not drained", pods)
+	}
+	if pods := c.podsOf(t, "agent"); len(pods) != 1 {
+		t.Errorf("pods %v are left, want the unselected pod kept", pods)
+	}
+}
@@ -0,0 +1,146 @@
+package rotator
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// rotateNodeDrainFirst replaces a node for ASGs that are at their max size or
+// should shrink: the node is cordoned and drained, its instance is terminated
+// through the ASG, and only then is the replacement awaited. With removeNode
+// the ASG's desired capacity is decremented instead and nothing replaces the
+// node. Steps that progress records as done are skipped.
+func (r *Rotator) rotateNodeDrainFirst(
+	ctx context.Context,
+	instanceGroup *InstanceGroup,
+	node *coreV1.Node,
+	progress InstanceState,
+	removeNode bool,
+) error {
+	instanceId := instanceGroup.instanceId()
+	groupId := instanceGroup.groupId()
+	status := progress.Status
+	checkpoint := func(phase Phase, status InstanceStatus, update func(*InstanceState)) error {
+		return r.checkpoint(instanceGroup, node, phase, status, update)
+	}
+
+	if !status.reached(StatusDrained) {
+		// A node is uncordoned when its rotation fails, so cordon it again
+		// when resuming.
+		err := r.runPhase(ctx, PhaseCordon, instanceGroup, node.Name, func(ctx context.Context) error {
+			return CordonNode(ctx, r.k8s, node)
+		})
+		if err != nil {
+			return err
+		}
+		if !status.reached(StatusCordoned) {
+			if err := checkpoint(PhaseCordon, StatusCordoned, nil); err != nil {
+				return err
+			}
+		}
+		err = r.drainWithSlot(ctx, func() error {
+			return r.runPhase(ctx, PhaseDrain, instanceGroup, node.Name, func(ctx context.Context) error {
+				return DrainNode(ctx, r.k8s, node, r.drain, r.timeouts.Drain, r.podEvicted(groupId))
+			})
+		})
+		if err != nil {
+			return err
+		}
+		if err := checkpoint(PhaseDrain, StatusDrained, nil); err != nil {
+			return err
+		}
+	}
+
+	var activities sets.String
+	if !status.reached(StatusRemoved) {
+		var activitiesUntil time.Time
+		err := r.runPhase(ctx, PhaseTerminate, instanceGroup, node.Name, func(ctx context.Context) error {
+			var err error
+			activities, activitiesUntil, err = GetScalingActivityIDs(ctx, r.asg, groupId)
+			if err != nil {
+				return err
+			}
+			return r.terminateInGroup(ctx, groupId, instanceId, removeNode)
+		})
+		if err != nil {
+			return err
+		}
+		if removeNode {
+			return checkpoint(PhaseTerminate, StatusTerminated, nil)
+		}
+		err = checkpoint(PhaseTerminate, StatusRemoved, func(s *InstanceState) { s.ActivitiesUntil = &activitiesUntil })
+		if err != nil {
+			return err
+		}
+	}
+
+	var replacement *Replacement
+	var newNode *coreV1.Node
+	err := r.runPhase(ctx, PhaseJoin, instanceGroup, node.Name, func(ctx context.Context) error {
+		var err error
+		if activities == nil {
+			// Resuming, so tell the replacement apart by the activities
+			// recorded before terminating.
+			until := progress.UpdatedAt
+			if progress.ActivitiesUntil != nil {
+				until = *progress.ActivitiesUntil
+			}
+			activities, err = GetScalingActivityIDsUntil(ctx, r.asg, groupId, until)
+			if err != nil {
+				return err
+			}
+		}
+		replacement, err = AwaitReplacementInstance(ctx, r.asg, groupId, instanceGroup.zone(), activities)
+		if err != nil {
+			return err
+		}
+		r.checkReplacementZone(ctx, instanceGroup, replacement)
+		newNode, err = awaitReplacementJoin(ctx, r.k8s, replacement)
+		return err
+	})
+	if err != nil {
+		return r.diagnose(ctx, err, groupId, activities, replacement)
+	}
+	err = r.runPhase(ctx, PhaseReady, instanceGroup, node.Name, func(ctx context.Context) error {
+		return awaitNodeReadiness(ctx, r.k8s, newNode)
+	})
+	if err != nil {
+		return r.diagnose(ctx, err, groupId, activities, replacement)
+	}
+	return checkpoint(PhaseReady, StatusTerminated, func(s *InstanceState) { s.Replacement = replacement.InstanceID })
+}
+
+// recoverDrainFirst leaves the cluster in a safe state after a failed
+// drain-first rotation: unless the old node was already drained, it is
+// uncordoned so it keeps serving workloads. Once the instance is terminated
+// the ASG keeps trying to replace it, so there is nothing to restore.
+func (r *Rotator) recoverDrainFirst(ctx context.Context, err error, instanceGroup *InstanceGroup, node *coreV1.Node) {
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) {
+		return
+	}
+	logf(ctx, "Rotation of instance '%s' failed during the %s phase.", phaseErr.InstanceID, phaseErr.Phase)
+
+	switch phaseErr.Phase {
+	case PhaseTerminate:
+		logf(ctx, "Node '%s' was drained and remains cordoned; instance '%s' must be terminated manually.",
+			node.Name, phaseErr.InstanceID)
+	case PhaseJoin, PhaseReady:
+		logf(ctx, "Instance '%s' was terminated; check ASG '%s' for its replacement.",
+			phaseErr.InstanceID, instanceGroup.groupId())
+	default:
+		// The rotation context may be what failed, so clean up with a fresh one.
+		ctx, cancel := cleanupContext(ctx)
+		defer cancel()
+		if err := UncordonNode(ctx, r.k8s, node); err != nil {
+			logf(ctx, "Failed to uncordon node '%s', uncordon it manually: %s", node.Name, err)
+		}
+	}
+	if r.state != nil {
+		logf(ctx, "Progress was saved to '%s'; run again with --resume to finish the rotation.", r.stateFile)
+	}
+}
@@ -0,0 +1,128 @@
+package rotator
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestDrainFirstReplacesEachNode(t *testing.T) {
+	c := newTestCluster(t, 3)
+	r := c.rotator(Options{Strategy: StrategyDrainFirst})
+
+	if err := r.Rotate(context.Background(), c.group); err != nil {
+		t.Fatal(err)
+	}
+	if left := c.running(c.original...); len(left) > 0 {
+		t.Errorf("old instances %v still run", left)
+	}
+	if detached := c.detached(t); len(detached) > 0 {
+		t.Errorf("instances %v were detached, want them terminated in the ASG", detached)
+	}
+	if desired, max := c.capacity(); desired != 3 || max != 3 {
+		t.Errorf("capacity is %d (max %d), want 3 (max 3)", desired, max)
+	}
+	if launches := c.launches(t); launches != 6 {
+		t.Errorf("ASG launched %d instances, want 6", launches)
+	}
+}
+
+func TestDrainFirstDrainFailureUncordons(t *testing.T) {
+	c := newTestCluster(t, 2)
+	ctx := context.Background()
+	stuck, err := GetNodeByInstanceID(ctx, c.client, c.original[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.client.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		selector := action.(k8stesting.ListAction).GetListRestrictions().Fields
+		if node, _ := selector.RequiresExactMatch("spec.nodeName"); node == stuck.Name {
+			return true, nil, errors.New("API unavailable")
+		}
+		return false, nil, nil
+	})
+	r := c.rotator(Options{Strategy: StrategyDrainFirst})
+
+	err = r.Rotate(ctx, c.group)
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) || phaseErr.Phase != PhaseDrain {
+		t.Fatalf("rotation failed with %v, want a drain phase error", err)
+	}
+	if len(c.running(c.original[0])) == 0 {
+		t.Errorf("instance '%s' that wasn't drained was terminated", c.original[0])
+	}
+	node, err := GetNodeByInstanceID(ctx, c.client, c.original[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Spec.Unschedulable {
+		t.Errorf("node '%s' that wasn't drained is still cordoned", node.Name)
+	}
+	if desired, _ := c.capacity(); desired != 2 {
+		t.Errorf("desired capacity is %d, want 2", desired)
+	}
+}
+
+func TestDrainFirstResumeAfterReadyTimeout(t *testing.T) {
+	c := newTestCluster(t, 2)
+	ctx := context.Background()
+	logged := captureLog(t)
+	c.sim.ReadyDelay = 400 * time.Millisecond
+	opts := Options{Strategy: StrategyDrainFirst, StateFile: stateFile(t)}
+	failed := opts
+	failed.Timeouts = Timeouts{Ready: 100 * time.Millisecond}
+
+	err := c.rotator(failed).Rotate(ctx, c.group)
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) || phaseErr.Phase != PhaseReady {
+		t.Fatalf("rotation failed with %v, want a ready phase error", err)
+	}
+	terminated := phaseErr.InstanceID
+	if state := aws.StringValue(c.cloud.Instance(terminated).State.Name); state != ec2.InstanceStateNameTerminated {
+		t.Errorf("instance '%s' is %s, want it terminated", terminated, state)
+	}
+	if !strings.Contains(logged.String(), "check ASG") {
+		t.Errorf("log doesn't point to the ASG for the replacement:\n%s", logged)
+	}
+
+	if err := c.rotator(opts).Resume(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if left := c.running(c.original...); len(left) > 0 {
+		t.Errorf("old instances %v still run", left)
+	}
+	// The replacement that was slow to get Ready is kept.
+	if launches := c.launches(t); launches != 4 {
+		t.Errorf("ASG launched %d instances, want 4", launches)
+	}
+}
+
+func TestDrainFirstRemoveNode(t *testing.T) {
+	c := newTestCluster(t, 2)
+	ctx := context.Background()
+	r := c.rotator(Options{})
+	igs, err := DescribeAutoScalingGroup(r.asg, r.ec2, c.group)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.RotateInstance(ctx, igs[0], true); err != nil {
+		t.Fatal(err)
+	}
+	if left := c.running(igs[0].instanceId()); len(left) > 0 {
+		t.Errorf("removed instance '%s' still runs", igs[0].instanceId())
+	}
+	if desired, _ := c.capacity(); desired != 1 {
+		t.Errorf("desired capacity is %d, want 1", desired)
+	}
+	if launches := c.launches(t); launches != 2 {
+		t.Errorf("ASG launched %d instances, want no replacement", launches)
+	}
+}
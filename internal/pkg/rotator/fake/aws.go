@@ -0,0 +1,1203 @@
+// Package fake provides in-memory stand-ins for the AWS services used by the
+// rotator, so that whole rotations can be exercised without an AWS account.
+package fake
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/eks"
+	"github.com/aws/aws-sdk-go/service/eks/eksiface"
+)
+
+// Cloud is a tiny simulation of one AWS region. Auto Scaling Groups keep their
+// desired capacity: detaching an instance without decrementing the desired
+// capacity launches a replacement, just like the real service does.
+type Cloud struct {
+	mu        sync.Mutex
+	nextID    int
+	groups    map[string]*autoscaling.Group
+	instances map[string]*ec2.Instance
+	clusters  map[string]*eks.Cluster
+	// nodegroups holds each cluster's managed node groups by name.
+	nodegroups map[string]map[string]*eks.Nodegroup
+	// launchTemplates is keyed by template ID.
+	launchTemplates map[string]*ec2.LaunchTemplate
+	// images holds the AMI of launch template versions by template ID and
+	// version number.
+	images map[string]map[int64]string
+	// launchConfigurations is keyed by name.
+	launchConfigurations map[string]*autoscaling.LaunchConfiguration
+	// activities holds each group's scaling activities, newest first.
+	activities  map[string][]*autoscaling.Activity
+	launchFault map[string]string
+	// launchZone pins the zone of each group's launches.
+	launchZone map[string]string
+	// hooks holds each group's lifecycle hooks.
+	hooks map[string][]*autoscaling.LifecycleHook
+	// waiting holds each group's instances held in Terminating:Wait by a
+	// lifecycle hook. They no longer count towards the desired capacity.
+	waiting map[string][]*autoscaling.Instance
+	// heartbeats counts the lifecycle action heartbeats of each instance.
+	heartbeats map[string]int
+	// consoleOutput holds the console output of instances by ID.
+	consoleOutput map[string]string
+
+	// OnLaunch, if set, is called (without the lock held) for every instance
+	// an ASG launches, including the ones created by AddGroup.
+	OnLaunch func(group string, instance *ec2.Instance)
+	// OnTerminate, if set, is called (without the lock held) for every
+	// instance that is terminated.
+	OnTerminate func(instance *ec2.Instance)
+}
+
+func NewCloud() *Cloud {
+	return &Cloud{
+		groups:    map[string]*autoscaling.Group{},
+		instances: map[string]*ec2.Instance{},
+		clusters:  map[string]*eks.Cluster{},
+
+		nodegroups:      map[string]map[string]*eks.Nodegroup{},
+		launchTemplates: map[string]*ec2.LaunchTemplate{},
+		images:          map[string]map[int64]string{},
+		activities:      map[string][]*autoscaling.Activity{},
+		launchFault:     map[string]string{},
+		launchZone:      map[string]string{},
+		hooks:           map[string][]*autoscaling.LifecycleHook{},
+		waiting:         map[string][]*autoscaling.Instance{},
+		heartbeats:      map[string]int{},
+		consoleOutput:   map[string]string{},
+
+		launchConfigurations: map[string]*autoscaling.LaunchConfiguration{},
+	}
+}
+
+// PinLaunchZone makes the named group launch every new instance in zone, as
+// when the other zones lack capacity or the group rebalances. An empty zone
+// restores the default placement.
+func (c *Cloud) PinLaunchZone(group, zone string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if zone == "" {
+		delete(c.launchZone, group)
+		return
+	}
+	c.launchZone[group] = zone
+}
+
+// SetConsoleOutput sets the console output of an instance, as its boot
+// messages and user data scripts would write it.
+func (c *Cloud) SetConsoleOutput(id, output string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.consoleOutput[id] = output
+}
+
+// FailLaunches makes every launch in the named group fail with message, as
+// with a broken launch template or insufficient capacity. An empty message
+// lets launches succeed again.
+func (c *Cloud) FailLaunches(group, message string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if message == "" {
+		delete(c.launchFault, group)
+		return
+	}
+	c.launchFault[group] = message
+}
+
+// AddLifecycleHook adds a lifecycle hook for transition, such as
+// autoscaling:EC2_INSTANCE_TERMINATING, to the named group. Instances the
+// group terminates are held in Terminating:Wait until the action is completed.
+func (c *Cloud) AddLifecycleHook(group, name, transition string, heartbeatTimeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hooks[group] = append(c.hooks[group], &autoscaling.LifecycleHook{
+		AutoScalingGroupName: aws.String(group),
+		LifecycleHookName:    aws.String(name),
+		LifecycleTransition:  aws.String(transition),
+		HeartbeatTimeout:     aws.Int64(int64(heartbeatTimeout / time.Second)),
+		DefaultResult:        aws.String("CONTINUE"),
+	})
+}
+
+// Heartbeats returns how many lifecycle action heartbeats were recorded for
+// an instance.
+func (c *Cloud) Heartbeats(id string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.heartbeats[id]
+}
+
+// AddCluster registers an EKS cluster reachable at endpoint.
+func (c *Cloud) AddCluster(name, endpoint string) *eks.Cluster {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cluster := &eks.Cluster{
+		Name:     aws.String(name),
+		Endpoint: aws.String(endpoint),
+		Version:  aws.String("1.21"),
+		Status:   aws.String(eks.ClusterStatusActive),
+		CertificateAuthority: &eks.Certificate{
+			Data: aws.String(""),
+		},
+	}
+	c.clusters[name] = cluster
+	return cluster
+}
+
+// AddNodegroup registers a managed node group of cluster that consists of
+// the named ASG, tagging the ASG the way EKS does.
+func (c *Cloud) AddNodegroup(cluster, name, group, releaseVersion, amiType string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.nodegroups[cluster] == nil {
+		c.nodegroups[cluster] = map[string]*eks.Nodegroup{}
+	}
+	c.nodegroups[cluster][name] = &eks.Nodegroup{
+		ClusterName:    aws.String(cluster),
+		NodegroupName:  aws.String(name),
+		ReleaseVersion: aws.String(releaseVersion),
+		AmiType:        aws.String(amiType),
+		Version:        aws.String("1.21"),
+		Status:         aws.String(eks.NodegroupStatusActive),
+		Resources: &eks.NodegroupResources{
+			AutoScalingGroups: []*eks.AutoScalingGroup{{Name: aws.String(group)}},
+		},
+	}
+	if g, ok := c.groups[group]; ok {
+		for k, v := range map[string]string{"eks:cluster-name": cluster, "eks:nodegroup-name": name} {
+			g.Tags = append(g.Tags, &autoscaling.TagDescription{
+				Key:          aws.String(k),
+				Value:        aws.String(v),
+				ResourceId:   aws.String(group),
+				ResourceType: aws.String("auto-scaling-group"),
+			})
+		}
+	}
+}
+
+// AddGroup creates an ASG with the given tags and launches size instances,
+// spread round-robin over zones.
+func (c *Cloud) AddGroup(name string, size int, zones []string, tags map[string]string) {
+	c.mu.Lock()
+	group := &autoscaling.Group{
+		AutoScalingGroupName: aws.String(name),
+		AvailabilityZones:    aws.StringSlice(zones),
+		DesiredCapacity:      aws.Int64(int64(size)),
+		MinSize:              aws.Int64(0),
+		MaxSize:              aws.Int64(int64(size)),
+		CreatedTime:          aws.Time(time.Now()),
+	}
+	for k, v := range tags {
+		group.Tags = append(group.Tags, &autoscaling.TagDescription{
+			Key:          aws.String(k),
+			Value:        aws.String(v),
+			ResourceId:   aws.String(name),
+			ResourceType: aws.String("auto-scaling-group"),
+		})
+	}
+	c.groups[name] = group
+	launched := c.reconcileLocked(group)
+	c.mu.Unlock()
+	c.notifyLaunched(name, launched)
+}
+
+// AddLaunchTemplate creates a launch template with a single version and
+// returns its ID.
+func (c *Cloud) AddLaunchTemplate(name string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	id := fmt.Sprintf("lt-%017x", c.nextID)
+	c.launchTemplates[id] = &ec2.LaunchTemplate{
+		LaunchTemplateId:     aws.String(id),
+		LaunchTemplateName:   aws.String(name),
+		CreateTime:           aws.Time(time.Now()),
+		DefaultVersionNumber: aws.Int64(1),
+		LatestVersionNumber:  aws.Int64(1),
+	}
+	return id
+}
+
+// AddLaunchTemplateVersion creates a new version of a launch template and
+// returns its number. makeDefault also makes it the default version.
+func (c *Cloud) AddLaunchTemplateVersion(id string, makeDefault bool) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	template := c.launchTemplates[id]
+	version := aws.Int64Value(template.LatestVersionNumber) + 1
+	template.LatestVersionNumber = aws.Int64(version)
+	if makeDefault {
+		template.DefaultVersionNumber = aws.Int64(version)
+	}
+	return version
+}
+
+// SetLaunchTemplateImage sets the AMI of a launch template version, which
+// the instances launched from it run.
+func (c *Cloud) SetLaunchTemplateImage(id string, version int64, image string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.images[id] == nil {
+		c.images[id] = map[int64]string{}
+	}
+	c.images[id][version] = image
+}
+
+// SetLaunchTemplate makes an ASG launch new instances from the given launch
+// template version, which may be a number, "$Latest" or "$Default".
+func (c *Cloud) SetLaunchTemplate(group, id, version string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.groups[group].LaunchTemplate = &autoscaling.LaunchTemplateSpecification{
+		LaunchTemplateId:   aws.String(id),
+		LaunchTemplateName: c.launchTemplates[id].LaunchTemplateName,
+		Version:            aws.String(version),
+	}
+}
+
+// AddLaunchConfiguration creates a launch configuration that launches
+// instances from image.
+func (c *Cloud) AddLaunchConfiguration(name, image string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.launchConfigurations[name] = &autoscaling.LaunchConfiguration{
+		LaunchConfigurationName: aws.String(name),
+		ImageId:                 aws.String(image),
+		InstanceType:            aws.String("m5.large"),
+		CreatedTime:             aws.Time(time.Now()),
+	}
+}
+
+// SetLaunchConfiguration makes an ASG launch new instances from the named
+// launch configuration instead of a launch template.
+func (c *Cloud) SetLaunchConfiguration(group, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.groups[group].LaunchConfigurationName = aws.String(name)
+	c.groups[group].LaunchTemplate = nil
+}
+
+// SetLaunchTime backdates when an instance was launched.
+func (c *Cloud) SetLaunchTime(id string, launched time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.instances[id].LaunchTime = aws.Time(launched)
+}
+
+// Instance returns a copy of the instance with the given ID, or nil.
+func (c *Cloud) Instance(id string) *ec2.Instance {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i, ok := c.instances[id]
+	if !ok {
+		return nil
+	}
+	return copyInstance(i)
+}
+
+// RunningInstances returns copies of all instances that are not terminated.
+func (c *Cloud) RunningInstances() []*ec2.Instance {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var running []*ec2.Instance
+	for _, i := range c.instances {
+		if aws.StringValue(i.State.Name) != ec2.InstanceStateNameTerminated {
+			running = append(running, copyInstance(i))
+		}
+	}
+	return running
+}
+
+// Group returns a copy of the named ASG, or nil.
+func (c *Cloud) Group(name string) *autoscaling.Group {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, ok := c.groups[name]
+	if !ok {
+		return nil
+	}
+	return copyGroup(g, c.waiting[name])
+}
+
+func (c *Cloud) AutoScaling() autoscalingiface.AutoScalingAPI { return &autoScaling{cloud: c} }
+func (c *Cloud) EC2() ec2iface.EC2API                         { return &ec2Client{cloud: c} }
+func (c *Cloud) EKS() eksiface.EKSAPI                         { return &eksClient{cloud: c} }
+
+// reconcileLocked launches instances until the group reaches its desired
+// capacity and returns the launched instances.
+func (c *Cloud) reconcileLocked(group *autoscaling.Group) []*ec2.Instance {
+	name := aws.StringValue(group.AutoScalingGroupName)
+	var launched []*ec2.Instance
+	for int64(len(group.Instances)) < aws.Int64Value(group.DesiredCapacity) {
+		zone := aws.StringValue(group.AvailabilityZones[len(group.Instances)%len(group.AvailabilityZones)])
+		if pinned, ok := c.launchZone[name]; ok {
+			zone = pinned
+		}
+		if message, ok := c.launchFault[name]; ok {
+			c.recordLocked(name, "Launching a new EC2 instance.  Status Reason: "+message, zone,
+				autoscaling.ScalingActivityStatusCodeFailed, message)
+			break
+		}
+		instance := c.launchLocked(group, zone)
+		c.recordLocked(name, "Launching a new EC2 instance: "+aws.StringValue(instance.InstanceId), zone,
+			autoscaling.ScalingActivityStatusCodeSuccessful, "")
+		launched = append(launched, instance)
+	}
+	return launched
+}
+
+func (c *Cloud) recordLocked(group, description, zone, status, message string) {
+	c.nextID++
+	now := time.Now()
+	activity := &autoscaling.Activity{
+		ActivityId:           aws.String(fmt.Sprintf("activity-%d", c.nextID)),
+		AutoScalingGroupName: aws.String(group),
+		Cause:                aws.String(fmt.Sprintf("At %s the rotator simulation caused this activity.", now.UTC().Format(time.RFC3339))),
+		Description:          aws.String(description),
+		Details:              aws.String(fmt.Sprintf(`{"Subnet ID":"subnet-%s","Availability Zone":"%s"}`, zone, zone)),
+		StartTime:            aws.Time(now),
+		EndTime:              aws.Time(now),
+		Progress:             aws.Int64(100),
+		StatusCode:           aws.String(status),
+	}
+	if message != "" {
+		activity.StatusMessage = aws.String(message)
+	}
+	c.activities[group] = append([]*autoscaling.Activity{activity}, c.activities[group]...)
+}
+
+func (c *Cloud) launchLocked(group *autoscaling.Group, zone string) *ec2.Instance {
+	c.nextID++
+	id := fmt.Sprintf("i-%017x", c.nextID)
+	launchTemplate := c.launchedVersionLocked(group.LaunchTemplate)
+	image := c.imageLocked(launchTemplate)
+	if config, ok := c.launchConfigurations[aws.StringValue(group.LaunchConfigurationName)]; ok {
+		image = aws.StringValue(config.ImageId)
+	}
+	instance := &ec2.Instance{
+		InstanceId:     aws.String(id),
+		ImageId:        aws.String(image),
+		InstanceType:   aws.String("m5.large"),
+		LaunchTime:     aws.Time(time.Now()),
+		PrivateDnsName: aws.String(fmt.Sprintf("ip-10-0-%d-%d.ec2.internal", c.nextID/256, c.nextID%256)),
+		Placement:      &ec2.Placement{AvailabilityZone: aws.String(zone)},
+		State: &ec2.InstanceState{
+			Code: aws.Int64(16),
+			Name: aws.String(ec2.InstanceStateNameRunning),
+		},
+	}
+	c.instances[id] = instance
+	group.Instances = append(group.Instances, &autoscaling.Instance{
+		InstanceId:              aws.String(id),
+		AvailabilityZone:        aws.String(zone),
+		InstanceType:            instance.InstanceType,
+		HealthStatus:            aws.String("Healthy"),
+		LifecycleState:          aws.String(autoscaling.LifecycleStateInService),
+		LaunchConfigurationName: group.LaunchConfigurationName,
+		LaunchTemplate:          launchTemplate,
+	})
+	return copyInstance(instance)
+}
+
+// launchedVersionLocked resolves the version of a launch template an
+// instance is launched from, as the ASG reports it for its instances.
+func (c *Cloud) launchedVersionLocked(spec *autoscaling.LaunchTemplateSpecification) *autoscaling.LaunchTemplateSpecification {
+	if spec == nil {
+		return nil
+	}
+	template := c.launchTemplates[aws.StringValue(spec.LaunchTemplateId)]
+	version := aws.StringValue(spec.Version)
+	switch version {
+	case "", "$Default":
+		version = fmt.Sprint(aws.Int64Value(template.DefaultVersionNumber))
+	case "$Latest":
+		version = fmt.Sprint(aws.Int64Value(template.LatestVersionNumber))
+	}
+	return &autoscaling.LaunchTemplateSpecification{
+		LaunchTemplateId:   template.LaunchTemplateId,
+		LaunchTemplateName: template.LaunchTemplateName,
+		Version:            aws.String(version),
+	}
+}
+
+// imageLocked returns the AMI of a launch template version resolved by
+// launchedVersionLocked, or a default AMI.
+func (c *Cloud) imageLocked(spec *autoscaling.LaunchTemplateSpecification) string {
+	if spec != nil {
+		version, _ := strconv.ParseInt(aws.StringValue(spec.Version), 10, 64)
+		if image, ok := c.images[aws.StringValue(spec.LaunchTemplateId)][version]; ok {
+			return image
+		}
+	}
+	return "ami-00000000000000000"
+}
+
+func (c *Cloud) notifyLaunched(group string, instances []*ec2.Instance) {
+	if c.OnLaunch == nil {
+		return
+	}
+	for _, i := range instances {
+		c.OnLaunch(group, i)
+	}
+}
+
+func (c *Cloud) notifyTerminated(instances []*ec2.Instance) {
+	if c.OnTerminate == nil {
+		return
+	}
+	for _, i := range instances {
+		c.OnTerminate(i)
+	}
+}
+
+func (c *Cloud) groupLocked(name string) (*autoscaling.Group, error) {
+	g, ok := c.groups[name]
+	if !ok {
+		return nil, awserr.New("ValidationError", fmt.Sprintf("AutoScalingGroup name not found - %s", name), nil)
+	}
+	return g, nil
+}
+
+func removeInstance(instances []*autoscaling.Instance, id string) ([]*autoscaling.Instance, bool) {
+	for n, i := range instances {
+		if aws.StringValue(i.InstanceId) == id {
+			return append(instances[:n:n], instances[n+1:]...), true
+		}
+	}
+	return instances, false
+}
+
+func copyInstance(i *ec2.Instance) *ec2.Instance {
+	cp := *i
+	placement := *i.Placement
+	state := *i.State
+	cp.Placement = &placement
+	cp.State = &state
+	return &cp
+}
+
+// copyGroup copies g, listing the instances waiting to terminate along with
+// the ones in service.
+func copyGroup(g *autoscaling.Group, waiting []*autoscaling.Instance) *autoscaling.Group {
+	cp := *g
+	cp.Instances = make([]*autoscaling.Instance, 0, len(g.Instances)+len(waiting))
+	for _, i := range append(append([]*autoscaling.Instance(nil), g.Instances...), waiting...) {
+		instance := *i
+		cp.Instances = append(cp.Instances, &instance)
+	}
+	cp.Tags = append([]*autoscaling.TagDescription(nil), g.Tags...)
+	return &cp
+}
+
+type autoScaling struct {
+	autoscalingiface.AutoScalingAPI
+	cloud *Cloud
+}
+
+func (a *autoScaling) DescribeAutoScalingGroups(
+	in *autoscaling.DescribeAutoScalingGroupsInput,
+) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	c := a.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := &autoscaling.DescribeAutoScalingGroupsOutput{}
+	if len(in.AutoScalingGroupNames) == 0 {
+		for name, g := range c.groups {
+			out.AutoScalingGroups = append(out.AutoScalingGroups, copyGroup(g, c.waiting[name]))
+		}
+		return out, nil
+	}
+	for _, name := range in.AutoScalingGroupNames {
+		if g, ok := c.groups[aws.StringValue(name)]; ok {
+			out.AutoScalingGroups = append(out.AutoScalingGroups, copyGroup(g, c.waiting[aws.StringValue(name)]))
+		}
+	}
+	return out, nil
+}
+
+func (a *autoScaling) DescribeAutoScalingGroupsPages(
+	in *autoscaling.DescribeAutoScalingGroupsInput,
+	fn func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool,
+) error {
+	out, err := a.DescribeAutoScalingGroups(in)
+	if err != nil {
+		return err
+	}
+	fn(out, true)
+	return nil
+}
+
+// DescribeTagsPages supports the key and value filters.
+func (a *autoScaling) DescribeTagsPages(
+	in *autoscaling.DescribeTagsInput,
+	fn func(*autoscaling.DescribeTagsOutput, bool) bool,
+) error {
+	c := a.cloud
+	c.mu.Lock()
+	out := &autoscaling.DescribeTagsOutput{}
+	for _, g := range c.groups {
+		for _, tag := range g.Tags {
+			if tagMatches(tag, in.Filters) {
+				cp := *tag
+				out.Tags = append(out.Tags, &cp)
+			}
+		}
+	}
+	c.mu.Unlock()
+	fn(out, true)
+	return nil
+}
+
+// tagMatches tells whether a tag passes all filters.
+func tagMatches(tag *autoscaling.TagDescription, filters []*autoscaling.Filter) bool {
+	for _, f := range filters {
+		var field string
+		switch aws.StringValue(f.Name) {
+		case "key":
+			field = aws.StringValue(tag.Key)
+		case "value":
+			field = aws.StringValue(tag.Value)
+		case "auto-scaling-group":
+			field = aws.StringValue(tag.ResourceId)
+		default:
+			continue
+		}
+		matched := false
+		for _, v := range f.Values {
+			if aws.StringValue(v) == field {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *autoScaling) DescribeAutoScalingInstancesPages(
+	in *autoscaling.DescribeAutoScalingInstancesInput,
+	fn func(*autoscaling.DescribeAutoScalingInstancesOutput, bool) bool,
+) error {
+	c := a.cloud
+	c.mu.Lock()
+	out := &autoscaling.DescribeAutoScalingInstancesOutput{}
+	wanted := map[string]bool{}
+	for _, id := range in.InstanceIds {
+		wanted[aws.StringValue(id)] = true
+	}
+	for name, g := range c.groups {
+		for _, i := range append(append([]*autoscaling.Instance(nil), g.Instances...), c.waiting[name]...) {
+			if len(wanted) > 0 && !wanted[aws.StringValue(i.InstanceId)] {
+				continue
+			}
+			out.AutoScalingInstances = append(out.AutoScalingInstances, &autoscaling.InstanceDetails{
+				AutoScalingGroupName: aws.String(name),
+				AvailabilityZone:     i.AvailabilityZone,
+				HealthStatus:         i.HealthStatus,
+				InstanceId:           i.InstanceId,
+				InstanceType:         i.InstanceType,
+				LifecycleState:       i.LifecycleState,
+			})
+		}
+	}
+	c.mu.Unlock()
+	fn(out, true)
+	return nil
+}
+
+func (a *autoScaling) DetachInstancesWithContext(
+	_ aws.Context,
+	in *autoscaling.DetachInstancesInput,
+	_ ...request.Option,
+) (*autoscaling.DetachInstancesOutput, error) {
+	c := a.cloud
+	c.mu.Lock()
+	group, err := c.groupLocked(aws.StringValue(in.AutoScalingGroupName))
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	for _, id := range in.InstanceIds {
+		var found bool
+		group.Instances, found = removeInstance(group.Instances, aws.StringValue(id))
+		if !found {
+			c.mu.Unlock()
+			return nil, awserr.New("ValidationError",
+				fmt.Sprintf("The instance %s is not part of Auto Scaling group %s.", aws.StringValue(id), aws.StringValue(group.AutoScalingGroupName)), nil)
+		}
+		if aws.BoolValue(in.ShouldDecrementDesiredCapacity) {
+			group.DesiredCapacity = aws.Int64(aws.Int64Value(group.DesiredCapacity) - 1)
+		}
+		zone := aws.StringValue(c.instances[aws.StringValue(id)].Placement.AvailabilityZone)
+		c.recordLocked(aws.StringValue(group.AutoScalingGroupName), "Detaching EC2 instance: "+aws.StringValue(id), zone,
+			autoscaling.ScalingActivityStatusCodeSuccessful, "")
+	}
+	launched := c.reconcileLocked(group)
+	c.mu.Unlock()
+	c.notifyLaunched(aws.StringValue(in.AutoScalingGroupName), launched)
+	return &autoscaling.DetachInstancesOutput{}, nil
+}
+
+// AttachInstancesWithContext adds running instances to a group, raising its
+// desired capacity by one for each.
+func (a *autoScaling) AttachInstancesWithContext(
+	_ aws.Context,
+	in *autoscaling.AttachInstancesInput,
+	_ ...request.Option,
+) (*autoscaling.AttachInstancesOutput, error) {
+	c := a.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	group, err := c.groupLocked(aws.StringValue(in.AutoScalingGroupName))
+	if err != nil {
+		return nil, err
+	}
+	desired := aws.Int64Value(group.DesiredCapacity) + int64(len(in.InstanceIds))
+	if desired > aws.Int64Value(group.MaxSize) {
+		return nil, awserr.New("ValidationError", fmt.Sprintf(
+			"AutoScalingGroup: %s had its desired capacity increased above its maximum size of %d",
+			aws.StringValue(group.AutoScalingGroupName), aws.Int64Value(group.MaxSize)), nil)
+	}
+	for _, id := range in.InstanceIds {
+		instance, ok := c.instances[aws.StringValue(id)]
+		if !ok || aws.StringValue(instance.State.Name) != ec2.InstanceStateNameRunning {
+			return nil, awserr.New("ValidationError",
+				fmt.Sprintf("Instance %s is not in correct state.", aws.StringValue(id)), nil)
+		}
+		for _, g := range c.groups {
+			for _, i := range g.Instances {
+				if aws.StringValue(i.InstanceId) == aws.StringValue(id) {
+					return nil, awserr.New("ValidationError",
+						fmt.Sprintf("The instance %s is already part of an Auto Scaling group.", aws.StringValue(id)), nil)
+				}
+			}
+		}
+	}
+	for _, id := range in.InstanceIds {
+		instance := c.instances[aws.StringValue(id)]
+		group.Instances = append(group.Instances, &autoscaling.Instance{
+			InstanceId:              id,
+			AvailabilityZone:        instance.Placement.AvailabilityZone,
+			InstanceType:            instance.InstanceType,
+			HealthStatus:            aws.String("Healthy"),
+			LifecycleState:          aws.String(autoscaling.LifecycleStateInService),
+			LaunchConfigurationName: group.LaunchConfigurationName,
+			LaunchTemplate:          c.launchedVersionLocked(group.LaunchTemplate),
+		})
+		c.recordLocked(aws.StringValue(group.AutoScalingGroupName), "Attaching an existing EC2 instance: "+aws.StringValue(id),
+			aws.StringValue(instance.Placement.AvailabilityZone), autoscaling.ScalingActivityStatusCodeSuccessful, "")
+	}
+	group.DesiredCapacity = aws.Int64(desired)
+	return &autoscaling.AttachInstancesOutput{}, nil
+}
+
+// UpdateAutoScalingGroupWithContext applies capacity changes. Scaling in
+// terminates the oldest instances.
+func (a *autoScaling) UpdateAutoScalingGroupWithContext(
+	_ aws.Context,
+	in *autoscaling.UpdateAutoScalingGroupInput,
+	_ ...request.Option,
+) (*autoscaling.UpdateAutoScalingGroupOutput, error) {
+	c := a.cloud
+	name := aws.StringValue(in.AutoScalingGroupName)
+	c.mu.Lock()
+	group, err := c.groupLocked(name)
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	if in.MinSize != nil {
+		group.MinSize = in.MinSize
+	}
+	if in.MaxSize != nil {
+		group.MaxSize = in.MaxSize
+	}
+	if in.DesiredCapacity != nil {
+		group.DesiredCapacity = in.DesiredCapacity
+	}
+	desired := aws.Int64Value(group.DesiredCapacity)
+	if desired < aws.Int64Value(group.MinSize) || desired > aws.Int64Value(group.MaxSize) {
+		c.mu.Unlock()
+		return nil, awserr.New("ValidationError", fmt.Sprintf(
+			"Desired capacity:%d must be between the specified min size:%d and max size:%d",
+			desired, aws.Int64Value(group.MinSize), aws.Int64Value(group.MaxSize)), nil)
+	}
+	var terminated []*ec2.Instance
+	for int64(len(group.Instances)) > desired {
+		id := aws.StringValue(group.Instances[0].InstanceId)
+		group.Instances = group.Instances[1:]
+		terminated = append(terminated, c.terminateLocked(name, id))
+	}
+	launched := c.reconcileLocked(group)
+	c.mu.Unlock()
+	c.notifyTerminated(terminated)
+	c.notifyLaunched(name, launched)
+	return &autoscaling.UpdateAutoScalingGroupOutput{}, nil
+}
+
+func (a *autoScaling) TerminateInstanceInAutoScalingGroupWithContext(
+	_ aws.Context,
+	in *autoscaling.TerminateInstanceInAutoScalingGroupInput,
+	_ ...request.Option,
+) (*autoscaling.TerminateInstanceInAutoScalingGroupOutput, error) {
+	c := a.cloud
+	id := aws.StringValue(in.InstanceId)
+	c.mu.Lock()
+	for name, group := range c.groups {
+		var found bool
+		group.Instances, found = removeInstance(group.Instances, id)
+		if !found {
+			continue
+		}
+		if aws.BoolValue(in.ShouldDecrementDesiredCapacity) {
+			group.DesiredCapacity = aws.Int64(aws.Int64Value(group.DesiredCapacity) - 1)
+		}
+		if c.terminatingHookLocked(name) != nil {
+			c.waiting[name] = append(c.waiting[name], &autoscaling.Instance{
+				InstanceId:       aws.String(id),
+				AvailabilityZone: c.instances[id].Placement.AvailabilityZone,
+				InstanceType:     c.instances[id].InstanceType,
+				HealthStatus:     aws.String("Healthy"),
+				LifecycleState:   aws.String(autoscaling.LifecycleStateTerminatingWait),
+			})
+			launched := c.reconcileLocked(group)
+			c.mu.Unlock()
+			c.notifyLaunched(name, launched)
+			return &autoscaling.TerminateInstanceInAutoScalingGroupOutput{}, nil
+		}
+		terminated := c.terminateLocked(name, id)
+		launched := c.reconcileLocked(group)
+		c.mu.Unlock()
+		c.notifyTerminated([]*ec2.Instance{terminated})
+		c.notifyLaunched(name, launched)
+		return &autoscaling.TerminateInstanceInAutoScalingGroupOutput{}, nil
+	}
+	c.mu.Unlock()
+	return nil, awserr.New("ValidationError", fmt.Sprintf("Instance Id not found - No managed instance found for instance ID: %s", id), nil)
+}
+
+func (c *Cloud) terminatingHookLocked(group string) *autoscaling.LifecycleHook {
+	for _, hook := range c.hooks[group] {
+		if aws.StringValue(hook.LifecycleTransition) == "autoscaling:EC2_INSTANCE_TERMINATING" {
+			return hook
+		}
+	}
+	return nil
+}
+
+// waitingLocked checks that an instance of group is held by the named hook.
+func (c *Cloud) waitingLocked(group, hook, id string) error {
+	found := false
+	for _, h := range c.hooks[group] {
+		found = found || aws.StringValue(h.LifecycleHookName) == hook
+	}
+	if !found {
+		return awserr.New("ValidationError", fmt.Sprintf("No Lifecycle Hook found with name %s for group %s", hook, group), nil)
+	}
+	for _, i := range c.waiting[group] {
+		if aws.StringValue(i.InstanceId) == id {
+			return nil
+		}
+	}
+	return awserr.New("ValidationError", fmt.Sprintf("No active Lifecycle Action found with instance ID %s", id), nil)
+}
+
+func (a *autoScaling) DescribeLifecycleHooksWithContext(
+	_ aws.Context,
+	in *autoscaling.DescribeLifecycleHooksInput,
+	_ ...request.Option,
+) (*autoscaling.DescribeLifecycleHooksOutput, error) {
+	c := a.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name := aws.StringValue(in.AutoScalingGroupName)
+	if _, err := c.groupLocked(name); err != nil {
+		return nil, err
+	}
+	wanted := map[string]bool{}
+	for _, n := range in.LifecycleHookNames {
+		wanted[aws.StringValue(n)] = true
+	}
+	out := &autoscaling.DescribeLifecycleHooksOutput{}
+	for _, hook := range c.hooks[name] {
+		if len(wanted) == 0 || wanted[aws.StringValue(hook.LifecycleHookName)] {
+			cp := *hook
+			out.LifecycleHooks = append(out.LifecycleHooks, &cp)
+		}
+	}
+	return out, nil
+}
+
+func (a *autoScaling) RecordLifecycleActionHeartbeatWithContext(
+	_ aws.Context,
+	in *autoscaling.RecordLifecycleActionHeartbeatInput,
+	_ ...request.Option,
+) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error) {
+	c := a.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := aws.StringValue(in.InstanceId)
+	if err := c.waitingLocked(aws.StringValue(in.AutoScalingGroupName), aws.StringValue(in.LifecycleHookName), id); err != nil {
+		return nil, err
+	}
+	c.heartbeats[id]++
+	return &autoscaling.RecordLifecycleActionHeartbeatOutput{}, nil
+}
+
+// CompleteLifecycleActionWithContext lets an instance held in
+// Terminating:Wait terminate, whatever the action result.
+func (a *autoScaling) CompleteLifecycleActionWithContext(
+	_ aws.Context,
+	in *autoscaling.CompleteLifecycleActionInput,
+	_ ...request.Option,
+) (*autoscaling.CompleteLifecycleActionOutput, error) {
+	c := a.cloud
+	name, id := aws.StringValue(in.AutoScalingGroupName), aws.StringValue(in.InstanceId)
+	c.mu.Lock()
+	if err := c.waitingLocked(name, aws.StringValue(in.LifecycleHookName), id); err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.waiting[name], _ = removeInstance(c.waiting[name], id)
+	terminated := c.terminateLocked(name, id)
+	c.mu.Unlock()
+	c.notifyTerminated([]*ec2.Instance{terminated})
+	return &autoscaling.CompleteLifecycleActionOutput{}, nil
+}
+
+// terminateLocked terminates an instance an ASG has let go of.
+func (c *Cloud) terminateLocked(group, id string) *ec2.Instance {
+	i := c.instances[id]
+	i.State = &ec2.InstanceState{Code: aws.Int64(48), Name: aws.String(ec2.InstanceStateNameTerminated)}
+	c.recordLocked(group, "Terminating EC2 instance: "+id, aws.StringValue(i.Placement.AvailabilityZone),
+		autoscaling.ScalingActivityStatusCodeSuccessful, "")
+	return copyInstance(i)
+}
+
+func (a *autoScaling) DescribeScalingActivitiesWithContext(
+	_ aws.Context,
+	in *autoscaling.DescribeScalingActivitiesInput,
+	_ ...request.Option,
+) (*autoscaling.DescribeScalingActivitiesOutput, error) {
+	c := a.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	activities := c.activities[aws.StringValue(in.AutoScalingGroupName)]
+	if max := int(aws.Int64Value(in.MaxRecords)); max > 0 && len(activities) > max {
+		activities = activities[:max]
+	}
+	out := &autoscaling.DescribeScalingActivitiesOutput{}
+	for _, a := range activities {
+		cp := *a
+		out.Activities = append(out.Activities, &cp)
+	}
+	return out, nil
+}
+
+// DescribeLaunchConfigurationsWithContext lists the named launch
+// configurations, leaving out unknown names as the real service does.
+func (a *autoScaling) DescribeLaunchConfigurationsWithContext(
+	_ aws.Context,
+	in *autoscaling.DescribeLaunchConfigurationsInput,
+	_ ...request.Option,
+) (*autoscaling.DescribeLaunchConfigurationsOutput, error) {
+	c := a.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := &autoscaling.DescribeLaunchConfigurationsOutput{}
+	for _, name := range in.LaunchConfigurationNames {
+		if config, ok := c.launchConfigurations[aws.StringValue(name)]; ok {
+			cp := *config
+			out.LaunchConfigurations = append(out.LaunchConfigurations, &cp)
+		}
+	}
+	return out, nil
+}
+
+type ec2Client struct {
+	ec2iface.EC2API
+	cloud *Cloud
+}
+
+func (e *ec2Client) DescribeInstancesPages(
+	in *ec2.DescribeInstancesInput,
+	fn func(*ec2.DescribeInstancesOutput, bool) bool,
+) error {
+	c := e.cloud
+	c.mu.Lock()
+	reservation := &ec2.Reservation{}
+	for _, i := range c.instances {
+		if matchesFilters(i, in.Filters) {
+			reservation.Instances = append(reservation.Instances, copyInstance(i))
+		}
+	}
+	c.mu.Unlock()
+	out := &ec2.DescribeInstancesOutput{}
+	if len(reservation.Instances) > 0 {
+		out.Reservations = []*ec2.Reservation{reservation}
+	}
+	fn(out, true)
+	return nil
+}
+
+func matchesFilters(i *ec2.Instance, filters []*ec2.Filter) bool {
+	for _, f := range filters {
+		var value string
+		switch aws.StringValue(f.Name) {
+		case "instance-id":
+			value = aws.StringValue(i.InstanceId)
+		case "network-interface.private-dns-name":
+			value = aws.StringValue(i.PrivateDnsName)
+		default:
+			return false
+		}
+		matched := false
+		for _, v := range f.Values {
+			if aws.StringValue(v) == value {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *ec2Client) TerminateInstancesWithContext(
+	_ aws.Context,
+	in *ec2.TerminateInstancesInput,
+	_ ...request.Option,
+) (*ec2.TerminateInstancesOutput, error) {
+	c := e.cloud
+	c.mu.Lock()
+	out := &ec2.TerminateInstancesOutput{}
+	var terminated []*ec2.Instance
+	for _, id := range in.InstanceIds {
+		i, ok := c.instances[aws.StringValue(id)]
+		if !ok {
+			c.mu.Unlock()
+			return nil, awserr.New("InvalidInstanceID.NotFound",
+				fmt.Sprintf("The instance ID '%s' does not exist", aws.StringValue(id)), nil)
+		}
+		previous := *i.State
+		i.State = &ec2.InstanceState{Code: aws.Int64(48), Name: aws.String(ec2.InstanceStateNameTerminated)}
+		out.TerminatingInstances = append(out.TerminatingInstances, &ec2.InstanceStateChange{
+			InstanceId:    i.InstanceId,
+			PreviousState: &previous,
+			CurrentState:  i.State,
+		})
+		terminated = append(terminated, copyInstance(i))
+	}
+	// Instances still attached to an ASG are replaced once the ASG notices
+	// they are gone.
+	launched := map[string][]*ec2.Instance{}
+	for name, group := range c.groups {
+		removed := false
+		for _, i := range terminated {
+			var found bool
+			group.Instances, found = removeInstance(group.Instances, aws.StringValue(i.InstanceId))
+			removed = removed || found
+		}
+		if removed {
+			launched[name] = c.reconcileLocked(group)
+		}
+	}
+	c.mu.Unlock()
+	c.notifyTerminated(terminated)
+	for name, instances := range launched {
+		c.notifyLaunched(name, instances)
+	}
+	return out, nil
+}
+
+func (e *ec2Client) GetConsoleOutputWithContext(
+	_ aws.Context,
+	in *ec2.GetConsoleOutputInput,
+	_ ...request.Option,
+) (*ec2.GetConsoleOutputOutput, error) {
+	c := e.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := aws.StringValue(in.InstanceId)
+	if _, ok := c.instances[id]; !ok {
+		return nil, awserr.New("InvalidInstanceID.NotFound", fmt.Sprintf("The instance ID '%s' does not exist", id), nil)
+	}
+	out := &ec2.GetConsoleOutputOutput{InstanceId: in.InstanceId, Timestamp: aws.Time(time.Now())}
+	if output := c.consoleOutput[id]; output != "" {
+		out.Output = aws.String(base64.StdEncoding.EncodeToString([]byte(output)))
+	}
+	return out, nil
+}
+
+func (e *ec2Client) DescribeLaunchTemplatesWithContext(
+	_ aws.Context,
+	in *ec2.DescribeLaunchTemplatesInput,
+	_ ...request.Option,
+) (*ec2.DescribeLaunchTemplatesOutput, error) {
+	c := e.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := &ec2.DescribeLaunchTemplatesOutput{}
+	for _, template := range c.launchTemplates {
+		matched := false
+		for _, id := range in.LaunchTemplateIds {
+			matched = matched || aws.StringValue(id) == aws.StringValue(template.LaunchTemplateId)
+		}
+		for _, name := range in.LaunchTemplateNames {
+			matched = matched || aws.StringValue(name) == aws.StringValue(template.LaunchTemplateName)
+		}
+		if matched {
+			cp := *template
+			out.LaunchTemplates = append(out.LaunchTemplates, &cp)
+		}
+	}
+	if len(out.LaunchTemplates) == 0 {
+		return nil, awserr.New("InvalidLaunchTemplateId.NotFound", "At least one of the launch templates specified in the request does not exist.", nil)
+	}
+	return out, nil
+}
+
+func (e *ec2Client) DescribeLaunchTemplateVersionsWithContext(
+	_ aws.Context,
+	in *ec2.DescribeLaunchTemplateVersionsInput,
+	_ ...request.Option,
+) (*ec2.DescribeLaunchTemplateVersionsOutput, error) {
+	c := e.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var template *ec2.LaunchTemplate
+	for _, t := range c.launchTemplates {
+		if aws.StringValue(t.LaunchTemplateId) == aws.StringValue(in.LaunchTemplateId) ||
+			aws.StringValue(t.LaunchTemplateName) == aws.StringValue(in.LaunchTemplateName) {
+			template = t
+		}
+	}
+	if template == nil {
+		return nil, awserr.New("InvalidLaunchTemplateId.NotFound", "The specified launch template does not exist.", nil)
+	}
+	out := &ec2.DescribeLaunchTemplateVersionsOutput{}
+	for _, v := range in.Versions {
+		spec := c.launchedVersionLocked(&autoscaling.LaunchTemplateSpecification{
+			LaunchTemplateId: template.LaunchTemplateId,
+			Version:          v,
+		})
+		number, _ := strconv.ParseInt(aws.StringValue(spec.Version), 10, 64)
+		if number < 1 || number > aws.Int64Value(template.LatestVersionNumber) {
+			return nil, awserr.New("InvalidLaunchTemplateId.VersionNotFound",
+				fmt.Sprintf("Could not find launch template version %s.", aws.StringValue(v)), nil)
+		}
+		out.LaunchTemplateVersions = append(out.LaunchTemplateVersions, &ec2.LaunchTemplateVersion{
+			LaunchTemplateId:   template.LaunchTemplateId,
+			LaunchTemplateName: template.LaunchTemplateName,
+			VersionNumber:      aws.Int64(number),
+			DefaultVersion:     aws.Bool(number == aws.Int64Value(template.DefaultVersionNumber)),
+			LaunchTemplateData: &ec2.ResponseLaunchTemplateData{
+				ImageId: aws.String(c.imageLocked(spec)),
+			},
+		})
+	}
+	return out, nil
+}
+
+// WaitUntilInstanceTerminatedWithContext succeeds right away: the fake
+// terminates instances synchronously.
+func (e *ec2Client) WaitUntilInstanceTerminatedWithContext(
+	_ aws.Context,
+	in *ec2.DescribeInstancesInput,
+	_ ...request.WaiterOption,
+) error {
+	c := e.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range in.InstanceIds {
+		i, ok := c.instances[aws.StringValue(id)]
+		if !ok || aws.StringValue(i.State.Name) != ec2.InstanceStateNameTerminated {
+			return awserr.New(request.WaiterResourceNotReadyErrorCode, "exceeded wait attempts", nil)
+		}
+	}
+	return nil
+}
+
+type eksClient struct {
+	eksiface.EKSAPI
+	cloud *Cloud
+}
+
+func (e *eksClient) ListClusters(*eks.ListClustersInput) (*eks.ListClustersOutput, error) {
+	c := e.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := &eks.ListClustersOutput{}
+	for name := range c.clusters {
+		out.Clusters = append(out.Clusters, aws.String(name))
+	}
+	return out, nil
+}
+
+func (e *eksClient) DescribeCluster(in *eks.DescribeClusterInput) (*eks.DescribeClusterOutput, error) {
+	c := e.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cluster, ok := c.clusters[aws.StringValue(in.Name)]
+	if !ok {
+		return nil, awserr.New(eks.ErrCodeResourceNotFoundException,
+			fmt.Sprintf("No cluster found for name: %s.", aws.StringValue(in.Name)), nil)
+	}
+	cp := *cluster
+	return &eks.DescribeClusterOutput{Cluster: &cp}, nil
+}
+
+func (e *eksClient) ListNodegroupsPagesWithContext(
+	_ aws.Context,
+	in *eks.ListNodegroupsInput,
+	fn func(*eks.ListNodegroupsOutput, bool) bool,
+	_ ...request.Option,
+) error {
+	c := e.cloud
+	c.mu.Lock()
+	cluster := aws.StringValue(in.ClusterName)
+	if _, ok := c.clusters[cluster]; !ok {
+		c.mu.Unlock()
+		return awserr.New(eks.ErrCodeResourceNotFoundException, fmt.Sprintf("No cluster found for name: %s.", cluster), nil)
+	}
+	out := &eks.ListNodegroupsOutput{}
+	for name := range c.nodegroups[cluster] {
+		out.Nodegroups = append(out.Nodegroups, aws.String(name))
+	}
+	c.mu.Unlock()
+	fn(out, true)
+	return nil
+}
+
+func (e *eksClient) DescribeNodegroupWithContext(
+	_ aws.Context,
+	in *eks.DescribeNodegroupInput,
+	_ ...request.Option,
+) (*eks.DescribeNodegroupOutput, error) {
+	c := e.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	nodegroup, ok := c.nodegroups[aws.StringValue(in.ClusterName)][aws.StringValue(in.NodegroupName)]
+	if !ok {
+		return nil, awserr.New(eks.ErrCodeResourceNotFoundException,
+			fmt.Sprintf("No node group found for name: %s.", aws.StringValue(in.NodegroupName)), nil)
+	}
+	cp := *nodegroup
+	return &eks.DescribeNodegroupOutput{Nodegroup: &cp}, nil
+}
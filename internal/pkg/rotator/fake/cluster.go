@@ -0,0 +1,225 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	coreV1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// Fault describes how a simulated node misbehaves.
+type Fault int
+
+const (
+	// NoFault nodes join after JoinDelay and become Ready after ReadyDelay.
+	NoFault Fault = iota
+	// NeverJoin nodes never register with the cluster.
+	NeverJoin
+	// NeverReady nodes register but never report Ready.
+	NeverReady
+)
+
+// Simulator plays the part of the kubelets in a cluster backed by a Cloud: it
+// registers a Node for every instance the Cloud launches, flips it Ready after
+// a delay, and removes it when the instance is terminated.
+type Simulator struct {
+	Client *k8sfake.Clientset
+
+	// JoinDelay is how long a launched instance takes to register its Node.
+	JoinDelay time.Duration
+	// ReadyDelay is how long a registered Node takes to become Ready.
+	ReadyDelay time.Duration
+	// Faults, if set, decides per launched instance whether it misbehaves.
+	Faults func(group string, instance *ec2.Instance) Fault
+	// KubeletVersion is reported in the NodeInfo of every simulated Node.
+	KubeletVersion string
+
+	mu     sync.Mutex
+	timers []*time.Timer
+	closed bool
+}
+
+// NewSimulator attaches a simulator to cloud. Every instance that is already
+// running gets a Ready Node immediately. Evicting a pod through the fake
+// client deletes it, so drains complete, and listing the pods of a node only
+// returns those.
+func NewSimulator(cloud *Cloud, client *k8sfake.Clientset) (*Simulator, error) {
+	s := &Simulator{
+		Client:         client,
+		KubeletVersion: "v1.21.2-eks-0389ca3",
+	}
+	client.Resources = append(client.Resources, &v1.APIResourceList{
+		GroupVersion: "v1",
+		APIResources: []v1.APIResource{{Name: "pods/eviction", Kind: "Eviction", Group: "policy", Version: "v1"}},
+	})
+	client.PrependReactor("create", "pods", s.evict)
+	client.PrependReactor("list", "pods", s.listPods)
+	for _, i := range cloud.RunningInstances() {
+		if err := s.register(i, true); err != nil {
+			return nil, err
+		}
+	}
+	cloud.OnLaunch = s.launched
+	cloud.OnTerminate = s.terminated
+	return s, nil
+}
+
+// Close stops all pending joins and readiness transitions.
+func (s *Simulator) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, t := range s.timers {
+		t.Stop()
+	}
+	s.timers = nil
+}
+
+// NodeName returns the name of the Node registered for instance.
+func NodeName(instance *ec2.Instance) string {
+	return aws.StringValue(instance.PrivateDnsName)
+}
+
+// ProviderID returns the provider ID the AWS cloud provider sets on the Node
+// registered for instance.
+func ProviderID(instance *ec2.Instance) string {
+	return fmt.Sprintf("aws:///%s/%s",
+		aws.StringValue(instance.Placement.AvailabilityZone), aws.StringValue(instance.InstanceId))
+}
+
+func (s *Simulator) after(d time.Duration, fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.timers = append(s.timers, time.AfterFunc(d, fn))
+}
+
+func (s *Simulator) launched(group string, instance *ec2.Instance) {
+	fault := NoFault
+	if s.Faults != nil {
+		fault = s.Faults(group, instance)
+	}
+	if fault == NeverJoin {
+		return
+	}
+	s.after(s.JoinDelay, func() {
+		if err := s.register(instance, false); err != nil {
+			return
+		}
+		if fault == NeverReady {
+			return
+		}
+		s.after(s.ReadyDelay, func() { _ = s.markReady(NodeName(instance)) })
+	})
+}
+
+func (s *Simulator) terminated(instance *ec2.Instance) {
+	_ = s.Client.CoreV1().Nodes().Delete(context.Background(), NodeName(instance), v1.DeleteOptions{})
+}
+
+func (s *Simulator) register(instance *ec2.Instance, ready bool) error {
+	zone := aws.StringValue(instance.Placement.AvailabilityZone)
+	status := coreV1.ConditionFalse
+	if ready {
+		status = coreV1.ConditionTrue
+	}
+	node := &coreV1.Node{
+		ObjectMeta: v1.ObjectMeta{
+			Name: NodeName(instance),
+			UID:  types.UID(aws.StringValue(instance.InstanceId)),
+			Labels: map[string]string{
+				coreV1.LabelHostname:           NodeName(instance),
+				coreV1.LabelTopologyZone:       zone,
+				coreV1.LabelInstanceTypeStable: aws.StringValue(instance.InstanceType),
+			},
+			CreationTimestamp: v1.Now(),
+		},
+		Spec: coreV1.NodeSpec{
+			ProviderID: ProviderID(instance),
+		},
+		Status: coreV1.NodeStatus{
+			Conditions: []coreV1.NodeCondition{{
+				Type:               coreV1.NodeReady,
+				Status:             status,
+				LastTransitionTime: v1.Now(),
+			}},
+			NodeInfo: coreV1.NodeSystemInfo{
+				KubeletVersion: s.KubeletVersion,
+			},
+		},
+	}
+	_, err := s.Client.CoreV1().Nodes().Create(context.Background(), node, v1.CreateOptions{})
+	return err
+}
+
+func (s *Simulator) markReady(name string) error {
+	nodes := s.Client.CoreV1().Nodes()
+	node, err := nodes.Get(context.Background(), name, v1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	for n, c := range node.Status.Conditions {
+		if c.Type == coreV1.NodeReady {
+			node.Status.Conditions[n].Status = coreV1.ConditionTrue
+			node.Status.Conditions[n].LastTransitionTime = v1.Now()
+		}
+	}
+	_, err = nodes.UpdateStatus(context.Background(), node, v1.UpdateOptions{})
+	return err
+}
+
+// listPods honours the spec.nodeName field selector, which the fake client
+// ignores.
+func (s *Simulator) listPods(action k8stesting.Action) (bool, runtime.Object, error) {
+	list, ok := action.(k8stesting.ListAction)
+	if !ok {
+		return false, nil, nil
+	}
+	node, ok := list.GetListRestrictions().Fields.RequiresExactMatch("spec.nodeName")
+	if !ok {
+		return false, nil, nil
+	}
+	obj, err := s.Client.Tracker().List(
+		coreV1.SchemeGroupVersion.WithResource("pods"), coreV1.SchemeGroupVersion.WithKind("Pod"), action.GetNamespace())
+	if err != nil {
+		return true, nil, err
+	}
+	pods := obj.(*coreV1.PodList)
+	filtered := &coreV1.PodList{ListMeta: pods.ListMeta}
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == node {
+			filtered.Items = append(filtered.Items, pod)
+		}
+	}
+	return true, filtered, nil
+}
+
+// evict turns the creation of a pods/eviction subresource into a deletion of
+// the pod, which is what the API server ends up doing.
+func (s *Simulator) evict(action k8stesting.Action) (bool, runtime.Object, error) {
+	if action.GetSubresource() != "eviction" {
+		return false, nil, nil
+	}
+	create, ok := action.(k8stesting.CreateAction)
+	if !ok {
+		return false, nil, nil
+	}
+	eviction, ok := create.GetObject().(v1.Object)
+	if !ok {
+		return true, nil, fmt.Errorf("unexpected eviction object %T", create.GetObject())
+	}
+	err := s.Client.Tracker().Delete(
+		coreV1.SchemeGroupVersion.WithResource("pods"), action.GetNamespace(), eviction.GetName())
+	return true, nil, err
+}
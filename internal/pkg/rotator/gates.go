@@ -0,0 +1,430 @@
+package rotator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	appsV1 "k8s.io/api/apps/v1"
+	coreV1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Gates are health checks that must pass after a node, or a surge batch, is
+// replaced before the next one is rotated.
+type Gates struct {
+	// Pods waits until the controllers of the pods evicted from the replaced
+	// nodes have as many Running and Ready pods as before.
+	Pods bool
+	// Workloads waits until no Deployment or StatefulSet has unavailable
+	// replicas. Workloads that had some before the nodes were replaced are
+	// not waited for.
+	Workloads bool
+	// DaemonSets are waited for until they are fully rolled out and their
+	// pods on the nodes that joined meanwhile are Ready.
+	DaemonSets []types.NamespacedName
+	// Soak is how long to wait once the other gates pass.
+	Soak time.Duration
+	// Timeout bounds how long the gates may take to pass; 0 waits forever.
+	Timeout time.Duration
+	// OnFailure is what to do when the gates don't pass in time; it defaults
+	// to GateFailurePause.
+	OnFailure GateFailure
+}
+
+// GateFailure is what to do when the health gates don't pass in time.
+type GateFailure string
+
+const (
+	// GateFailurePause stops the rotation, so it can be resumed once the
+	// cluster is healthy again.
+	GateFailurePause GateFailure = "pause"
+	// GateFailureAbort fails the rotation.
+	GateFailureAbort GateFailure = "abort"
+)
+
+var GateFailures = []string{string(GateFailurePause), string(GateFailureAbort)}
+
+// DefaultGateTimeout is how long the health gates may take to pass by
+// default.
+var DefaultGateTimeout = 10 * time.Minute
+
+// GatePollInterval is how often the health gates are checked.
+var GatePollInterval = 10 * time.Second
+
+// ParseDaemonSets parses DaemonSets written as namespace/name.
+func ParseDaemonSets(names []string) ([]types.NamespacedName, error) {
+	var parsed []types.NamespacedName
+	for _, name := range names {
+		i := strings.Index(name, "/")
+		if i <= 0 || i == len(name)-1 || strings.Count(name, "/") > 1 {
+			return nil, fmt.Errorf("DaemonSet '%s' must be written as namespace/name", name)
+		}
+		parsed = append(parsed, types.NamespacedName{Namespace: name[:i], Name: name[i+1:]})
+	}
+	return parsed, nil
+}
+
+func (g Gates) empty() bool {
+	return !g.Pods && !g.Workloads && len(g.DaemonSets) == 0 && g.Soak == 0
+}
+
+// gateBaseline is what the health gates compare the cluster against: its
+// state before nodes were replaced.
+type gateBaseline struct {
+	// nodes are the names of the nodes that were part of the cluster.
+	nodes sets.String
+	// ready counts the Running and Ready pods of each controller of a pod
+	// the drain of the nodes evicts, by Deployment rather than ReplicaSet.
+	ready map[types.UID]int
+	// controllers describes each controller counted in ready.
+	controllers map[types.UID]string
+	// unavailable are the workloads that had unavailable replicas.
+	unavailable sets.String
+}
+
+// rotateGated runs rotate to replace instanceGroups and then awaits the
+// health gates. Without gates, or in a dry run, it only runs rotate.
+func (r *Rotator) rotateGated(ctx context.Context, instanceGroups InstanceGroups, rotate func() error) error {
+	if r.gates.empty() || r.dryrun {
+		return rotate()
+	}
+	baseline, err := r.gateBaseline(ctx, instanceGroups)
+	if err != nil {
+		return fmt.Errorf("checking health gates: %v", err)
+	}
+	if err := rotate(); err != nil {
+		return err
+	}
+	return r.awaitGates(ctx, instanceGroups, baseline)
+}
+
+func (r *Rotator) gateBaseline(ctx context.Context, instanceGroups InstanceGroups) (*gateBaseline, error) {
+	b := &gateBaseline{
+		nodes:       sets.NewString(),
+		ready:       map[types.UID]int{},
+		controllers: map[types.UID]string{},
+		unavailable: sets.NewString(),
+	}
+	nodes, err := getClusterNodes(ctx, r.k8s)
+	if err != nil {
+		return nil, err
+	}
+	replaced := sets.NewString()
+	for _, node := range nodes {
+		b.nodes.Insert(node.Name)
+		for _, ig := range instanceGroups {
+			if nodeMatchesInstance(node, ig.instanceId(), "") {
+				replaced.Insert(node.Name)
+			}
+		}
+	}
+
+	if r.gates.Pods && replaced.Len() > 0 {
+		pods, err := r.k8s.CoreV1().Pods("").List(ctx, v1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("listing pods: %v", err)
+		}
+		owners, err := r.podOwners(ctx)
+		if err != nil {
+			return nil, err
+		}
+		selector := r.drain.podSelector()
+		for n := range pods.Items {
+			pod := &pods.Items[n]
+			if !replaced.Has(pod.Spec.NodeName) || !isEvicted(pod, selector) {
+				continue
+			}
+			// Nothing recreates a pod without a controller.
+			if owner := owners.of(pod); owner != nil {
+				b.ready[owner.UID] = 0
+				b.controllers[owner.UID] = fmt.Sprintf("%s '%s/%s'", owner.Kind, pod.Namespace, owner.Name)
+			}
+		}
+		countReady(pods.Items, owners, b.ready)
+	}
+
+	if r.gates.Workloads {
+		unavailable, err := r.unavailableWorkloads(ctx)
+		if err != nil {
+			return nil, err
+		}
+		b.unavailable.Insert(unavailable...)
+		for _, w := range unavailable {
+			logf(ctx, "%s already has unavailable replicas, so it is not waited for.", w)
+		}
+	}
+
+	for _, name := range r.gates.DaemonSets {
+		if _, err := r.k8s.AppsV1().DaemonSets(name.Namespace).Get(ctx, name.Name, v1.GetOptions{}); err != nil {
+			return nil, fmt.Errorf("DaemonSet '%s': %v", name, err)
+		}
+	}
+	return b, nil
+}
+
+// podOwners maps the ReplicaSets that Deployments manage to their
+// Deployment.
+type podOwners map[types.UID]v1.OwnerReference
+
+func (r *Rotator) podOwners(ctx context.Context) (podOwners, error) {
+	replicaSets, err := r.k8s.AppsV1().ReplicaSets("").List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing ReplicaSets: %v", err)
+	}
+	owners := podOwners{}
+	for n := range replicaSets.Items {
+		rs := &replicaSets.Items[n]
+		if owner := v1.GetControllerOf(rs); owner != nil {
+			owners[rs.UID] = *owner
+		}
+	}
+	return owners, nil
+}
+
+// of returns the controller a pod is counted by: its Deployment if it has
+// one, so that pods of all of its ReplicaSets count during a rollout, or
+// else its own controller. It returns nil for a pod without a controller.
+func (o podOwners) of(pod *coreV1.Pod) *v1.OwnerReference {
+	owner := v1.GetControllerOf(pod)
+	if owner == nil {
+		return nil
+	}
+	if deployment, ok := o[owner.UID]; ok {
+		return &deployment
+	}
+	return owner
+}
+
+// countReady counts the Running and Ready pods of the controllers in ready.
+func countReady(pods []coreV1.Pod, owners podOwners, ready map[types.UID]int) {
+	for n := range pods {
+		pod := &pods[n]
+		owner := owners.of(pod)
+		if owner == nil || !isPodReady(pod) {
+			continue
+		}
+		if _, ok := ready[owner.UID]; ok {
+			ready[owner.UID]++
+		}
+	}
+}
+
+func isPodReady(pod *coreV1.Pod) bool {
+	if pod.Status.Phase != coreV1.PodRunning || pod.DeletionTimestamp != nil {
+		return false
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == coreV1.PodReady {
+			return c.Status == coreV1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// awaitGates waits for the health gates to pass after instanceGroups were
+// replaced, then for the soak time. If the gates don't pass in time, the
+// rotation is paused or fails.
+func (r *Rotator) awaitGates(ctx context.Context, instanceGroups InstanceGroups, baseline *gateBaseline) error {
+	ids := make([]string, 0, len(instanceGroups))
+	for _, ig := range instanceGroups {
+		ids = append(ids, ig.instanceId())
+	}
+	replaced := fmt.Sprintf("replacing instance '%s'", strings.Join(ids, "', '"))
+
+	gateCtx := ctx
+	if r.gates.Timeout > 0 {
+		var cancel context.CancelFunc
+		gateCtx, cancel = context.WithTimeout(ctx, r.gates.Timeout)
+		defer cancel()
+	}
+	var problems []string
+	waiting := ""
+	err := wait.PollImmediateUntil(GatePollInterval, func() (bool, error) {
+		found, err := r.gateProblems(gateCtx, baseline)
+		if err != nil {
+			return false, err
+		}
+		problems = found
+		if summary := strings.Join(problems, "; "); summary != "" && summary != waiting {
+			logf(ctx, "Waiting for health gates: %s.", summary)
+			waiting = summary
+		}
+		return len(problems) == 0, nil
+	}, gateCtx.Done())
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == wait.ErrWaitTimeout || gateCtx.Err() != nil {
+		return r.gatesFailed(ctx, fmt.Sprintf("health gates did not pass within %s after %s: %s",
+			r.gates.Timeout, replaced, strings.Join(problems, "; ")))
+	}
+	if err != nil {
+		return fmt.Errorf("checking health gates after %s: %v", replaced, err)
+	}
+	if waiting != "" || r.gates.Pods || r.gates.Workloads || len(r.gates.DaemonSets) > 0 {
+		logln(ctx, "Health gates passed.")
+	}
+
+	if r.gates.Soak > 0 {
+		logf(ctx, "Soaking for %s before rotating the next node.", r.gates.Soak)
+		select {
+		case <-time.After(r.gates.Soak):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// gatesFailed pauses the rotation for problem or, with GateFailureAbort,
+// returns it as an error.
+func (r *Rotator) gatesFailed(ctx context.Context, problem string) error {
+	if r.gates.OnFailure == GateFailureAbort {
+		return errors.New(problem)
+	}
+	logf(ctx, "WARNING: %s.", problem)
+	logln(ctx, "Pausing the rotation.")
+	r.pause(problem)
+	return nil
+}
+
+// gateProblems returns why the health gates don't pass yet, sorted, or
+// nothing if they pass.
+func (r *Rotator) gateProblems(ctx context.Context, baseline *gateBaseline) ([]string, error) {
+	var problems []string
+	if len(baseline.ready) > 0 {
+		pods, err := r.k8s.CoreV1().Pods("").List(ctx, v1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("listing pods: %v", err)
+		}
+		owners, err := r.podOwners(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ready := map[types.UID]int{}
+		for uid := range baseline.ready {
+			ready[uid] = 0
+		}
+		countReady(pods.Items, owners, ready)
+		for uid, want := range baseline.ready {
+			if ready[uid] < want {
+				problems = append(problems, fmt.Sprintf("%s has %d of %d pods ready",
+					baseline.controllers[uid], ready[uid], want))
+			}
+		}
+	}
+
+	if r.gates.Workloads {
+		unavailable, err := r.unavailableWorkloads(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range unavailable {
+			if !baseline.unavailable.Has(w) {
+				problems = append(problems, w+" has unavailable replicas")
+			}
+		}
+	}
+
+	for _, name := range r.gates.DaemonSets {
+		problem, err := r.daemonSetProblem(ctx, name, baseline.nodes)
+		if err != nil {
+			return nil, err
+		}
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
+
+// unavailableWorkloads returns the Deployments and StatefulSets that have
+// fewer replicas available than they want.
+func (r *Rotator) unavailableWorkloads(ctx context.Context) ([]string, error) {
+	var unavailable []string
+	deployments, err := r.k8s.AppsV1().Deployments("").List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing Deployments: %v", err)
+	}
+	for _, d := range deployments.Items {
+		if d.Status.UnavailableReplicas > 0 || d.Status.AvailableReplicas < desiredReplicas(d.Spec.Replicas) {
+			unavailable = append(unavailable, fmt.Sprintf("Deployment '%s/%s'", d.Namespace, d.Name))
+		}
+	}
+	statefulSets, err := r.k8s.AppsV1().StatefulSets("").List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing StatefulSets: %v", err)
+	}
+	for _, s := range statefulSets.Items {
+		if s.Status.ReadyReplicas < desiredReplicas(s.Spec.Replicas) {
+			unavailable = append(unavailable, fmt.Sprintf("StatefulSet '%s/%s'", s.Namespace, s.Name))
+		}
+	}
+	return unavailable, nil
+}
+
+// desiredReplicas returns the replicas a workload's spec asks for, which
+// default to 1.
+func desiredReplicas(replicas *int32) int32 {
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}
+
+// daemonSetProblem tells why a DaemonSet isn't fully rolled out, or why its
+// pod on a node that isn't in before isn't Ready. It returns an empty string
+// if neither is the case.
+func (r *Rotator) daemonSetProblem(ctx context.Context, name types.NamespacedName, before sets.String) (string, error) {
+	ds, err := r.k8s.AppsV1().DaemonSets(name.Namespace).Get(ctx, name.Name, v1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("DaemonSet '%s': %v", name, err)
+	}
+	if problem := daemonSetRollout(ds); problem != "" {
+		return fmt.Sprintf("DaemonSet '%s' %s", name, problem), nil
+	}
+	selector, err := v1.LabelSelectorAsSelector(ds.Spec.Selector)
+	if err != nil {
+		return "", fmt.Errorf("DaemonSet '%s': %v", name, err)
+	}
+	pods, err := r.k8s.CoreV1().Pods(name.Namespace).List(ctx, v1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return "", fmt.Errorf("listing pods of DaemonSet '%s': %v", name, err)
+	}
+	for n := range pods.Items {
+		pod := &pods.Items[n]
+		owner := v1.GetControllerOf(pod)
+		if owner == nil || owner.UID != ds.UID || before.Has(pod.Spec.NodeName) {
+			continue
+		}
+		if !isPodReady(pod) {
+			return fmt.Sprintf("DaemonSet '%s' has pod '%s' on new node '%s' not ready",
+				name, pod.Name, pod.Spec.NodeName), nil
+		}
+	}
+	return "", nil
+}
+
+// daemonSetRollout tells why a DaemonSet isn't fully rolled out, or returns
+// an empty string if it is.
+func daemonSetRollout(ds *appsV1.DaemonSet) string {
+	s := ds.Status
+	if s.ObservedGeneration < ds.Generation {
+		return "has a rollout that hasn't started yet"
+	}
+	if s.UpdatedNumberScheduled < s.DesiredNumberScheduled {
+		return fmt.Sprintf("has %d of %d pods updated", s.UpdatedNumberScheduled, s.DesiredNumberScheduled)
+	}
+	if s.NumberAvailable < s.DesiredNumberScheduled {
+		return fmt.Sprintf("has %d of %d pods available", s.NumberAvailable, s.DesiredNumberScheduled)
+	}
+	return ""
+}
@@ -0,0 +1,244 @@
+package rotator
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	appsV1 "k8s.io/api/apps/v1"
+	coreV1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// controlledBy returns the metadata of an object named name in the default
+// namespace that owner controls.
+func controlledBy(name, kind string, owner v1.ObjectMeta) v1.ObjectMeta {
+	controller := true
+	return v1.ObjectMeta{
+		Name:      name,
+		Namespace: "default",
+		UID:       types.UID(name),
+		Labels:    map[string]string{"app": owner.Name},
+		OwnerReferences: []v1.OwnerReference{{
+			APIVersion: "apps/v1",
+			Kind:       kind,
+			Name:       owner.Name,
+			UID:        owner.UID,
+			Controller: &controller,
+		}},
+	}
+}
+
+// addDeployment adds a Deployment with a ReplicaSet for each of revisions
+// and returns their metadata.
+func (c *testCluster) addDeployment(t *testing.T, name string, revisions int) (v1.ObjectMeta, []v1.ObjectMeta) {
+	ctx := context.Background()
+	deployment := &appsV1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(name)},
+		Status:     appsV1.DeploymentStatus{AvailableReplicas: 1},
+	}
+	if _, err := c.client.AppsV1().Deployments("default").Create(ctx, deployment, v1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var replicaSets []v1.ObjectMeta
+	for n := 1; n <= revisions; n++ {
+		rs := &appsV1.ReplicaSet{ObjectMeta: controlledBy(fmt.Sprintf("%s-%d", name, n), "Deployment", deployment.ObjectMeta)}
+		if _, err := c.client.AppsV1().ReplicaSets("default").Create(ctx, rs, v1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		replicaSets = append(replicaSets, rs.ObjectMeta)
+	}
+	return deployment.ObjectMeta, replicaSets
+}
+
+// readyPod returns a Running and Ready pod of a ReplicaSet on a node.
+func readyPod(name string, rs v1.ObjectMeta, nodeName string) *coreV1.Pod {
+	return &coreV1.Pod{
+		ObjectMeta: controlledBy(name, "ReplicaSet", rs),
+		Spec:       coreV1.PodSpec{NodeName: nodeName},
+		Status: coreV1.PodStatus{
+			Phase:      coreV1.PodRunning,
+			Conditions: []coreV1.PodCondition{{Type: coreV1.PodReady, Status: coreV1.ConditionTrue}},
+		},
+	}
+}
+
+// addReadyPod adds a Running and Ready pod of a ReplicaSet to the node of an
+// instance.
+func (c *testCluster) addReadyPod(t *testing.T, name string, rs v1.ObjectMeta, instanceId string) {
+	ctx := context.Background()
+	node, err := GetNodeByInstanceID(ctx, c.client, instanceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.client.CoreV1().Pods("default").Create(ctx, readyPod(name, rs, node.Name), v1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// onDelete calls react with the name of every pod that is deleted.
+func (c *testCluster) onDelete(react func(name string)) {
+	c.client.PrependReactor("delete", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		react(action.(k8stesting.DeleteAction).GetName())
+		return false, nil, nil
+	})
+}
+
+func TestPodsGateCountsDeploymentAcrossRollout(t *testing.T) {
+	c := newTestCluster(t, 2)
+	_, replicaSets := c.addDeployment(t, "web", 2)
+	c.addReadyPod(t, "web-1-a", replicaSets[0], c.original[0])
+	// The Deployment is rolled out while the node is drained, so the pod
+	// comes back from the new ReplicaSet.
+	c.onDelete(func(name string) {
+		if name == "web-1-a" {
+			if err := c.client.Tracker().Add(readyPod("web-2-a", replicaSets[1], "elsewhere")); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	r := c.rotator(Options{Gates: Gates{Pods: true, Timeout: time.Second, OnFailure: GateFailureAbort}})
+
+	if err := r.Rotate(context.Background(), c.group); err != nil {
+		t.Fatal(err)
+	}
+	if left := c.running(c.original...); len(left) > 0 {
+		t.Errorf("old instances %v still run", left)
+	}
+}
+
+func TestPodsGateFailure(t *testing.T) {
+	for _, onFailure := range []GateFailure{GateFailurePause, GateFailureAbort} {
+		t.Run(string(onFailure), func(t *testing.T) {
+			c := newTestCluster(t, 2)
+			_, replicaSets := c.addDeployment(t, "web", 1)
+			c.addReadyPod(t, "web-1-a", replicaSets[0], c.original[0])
+			opts := Options{
+				Gates:     Gates{Pods: true, Timeout: 200 * time.Millisecond, OnFailure: onFailure},
+				StateFile: stateFile(t),
+			}
+
+			err := c.rotator(opts).Rotate(context.Background(), c.group)
+			if err == nil || !strings.Contains(err.Error(), "Deployment 'default/web' has 0 of 1 pods ready") {
+				t.Fatalf("rotation ended with %v, want the gate failure", err)
+			}
+			if paused := strings.Contains(err.Error(), "rotation paused"); paused != (onFailure == GateFailurePause) {
+				t.Errorf("rotation ended with '%s', paused %t", err, paused)
+			}
+			if detached := c.detached(t); len(detached) != 1 {
+				t.Errorf("instances %v were rotated, want only the first", detached)
+			}
+		})
+	}
+}
+
+func TestWorkloadsGate(t *testing.T) {
+	c := newTestCluster(t, 2)
+	ctx := context.Background()
+	// A Deployment that was unavailable before isn't waited for.
+	broken := &appsV1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: "broken", Namespace: "default"},
+		Status:     appsV1.DeploymentStatus{UnavailableReplicas: 1},
+	}
+	if _, err := c.client.AppsV1().Deployments("default").Create(ctx, broken, v1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	api, replicaSets := c.addDeployment(t, "api", 1)
+	c.addReadyPod(t, "api-1-a", replicaSets[0], c.original[0])
+	c.onDelete(func(name string) {
+		if name != "api-1-a" {
+			return
+		}
+		deployment := &appsV1.Deployment{ObjectMeta: api, Status: appsV1.DeploymentStatus{UnavailableReplicas: 1}}
+		if err := c.client.Tracker().Update(appsV1.SchemeGroupVersion.WithResource("deployments"), deployment, "default"); err != nil {
+			t.Error(err)
+		}
+	})
+	r := c.rotator(Options{Gates: Gates{Workloads: true, Timeout: 200 * time.Millisecond, OnFailure: GateFailureAbort}})
+
+	err := r.Rotate(ctx, c.group)
+	if err == nil || err.Error() != fmt.Sprintf("health gates did not pass within 200ms after replacing instance '%s': "+
+		"Deployment 'default/api' has unavailable replicas", c.original[0]) {
+		t.Fatalf("rotation ended with %v, want only Deployment 'default/api' to fail the gate", err)
+	}
+}
+
+func TestDaemonSetGate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		status  appsV1.DaemonSetStatus
+		problem string
+	}{
+		{name: "rolled out", status: appsV1.DaemonSetStatus{DesiredNumberScheduled: 2, UpdatedNumberScheduled: 2, NumberAvailable: 2}},
+		{
+			name:    "rolling out",
+			status:  appsV1.DaemonSetStatus{DesiredNumberScheduled: 2, UpdatedNumberScheduled: 1, NumberAvailable: 2},
+			problem: "DaemonSet 'kube-system/aws-node' has 1 of 2 pods updated",
+		},
+		{
+			name:    "unavailable",
+			status:  appsV1.DaemonSetStatus{DesiredNumberScheduled: 2, UpdatedNumberScheduled: 2, NumberAvailable: 1},
+			problem: "DaemonSet 'kube-system/aws-node' has 1 of 2 pods available",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCluster(t, 1)
+			ds := &appsV1.DaemonSet{ObjectMeta: v1.ObjectMeta{Name: "aws-node", Namespace: "kube-system"}, Status: tc.status}
+			if _, err := c.client.AppsV1().DaemonSets("kube-system").Create(context.Background(), ds, v1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			daemonSets, err := ParseDaemonSets([]string{"kube-system/aws-node"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			gates := Gates{DaemonSets: daemonSets, Timeout: 100 * time.Millisecond, OnFailure: GateFailureAbort}
+
+			err = c.rotator(Options{Gates: gates}).Rotate(context.Background(), c.group)
+			if tc.problem == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.problem != "" && (err == nil || !strings.Contains(err.Error(), tc.problem)) {
+				t.Errorf("rotation ended with %v, want it to fail with '%s'", err, tc.problem)
+			}
+		})
+	}
+}
+
+func TestParseDaemonSets(t *testing.T) {
+	got, err := ParseDaemonSets([]string{"kube-system/aws-node", "monitoring/node-exporter"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []types.NamespacedName{{Namespace: "kube-system", Name: "aws-node"}, {Namespace: "monitoring", Name: "node-exporter"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsed %v, want %v", got, want)
+	}
+	for _, name := range []string{"aws-node", "/aws-node", "kube-system/", "a/b/c"} {
+		if _, err := ParseDaemonSets([]string{name}); err == nil {
+			t.Errorf("DaemonSet '%s' was parsed", name)
+		}
+	}
+}
+
+func TestSoak(t *testing.T) {
+	c := newTestCluster(t, 2)
+	logged := captureLog(t)
+	r := c.rotator(Options{Gates: Gates{Soak: 100 * time.Millisecond}})
+
+	start := time.Now()
+	if err := r.Rotate(context.Background(), c.group); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < 200*time.Millisecond {
+		t.Errorf("rotation took %s, want it to soak after each of 2 nodes", took)
+	}
+	if n := strings.Count(logged.String(), "Soaking for 100ms"); n != 2 {
+		t.Errorf("log tells %d soaks, want 2:\n%s", n, logged)
+	}
+}
@@ -0,0 +1,104 @@
+package rotator
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// checkLifecycleHooks makes sure every ASG to rotate has the configured
+// lifecycle hook, and notes how often its actions need a heartbeat.
+func (r *Rotator) checkLifecycleHooks(ctx context.Context, instanceGroups InstanceGroups) error {
+	if r.lifecycleHook == "" {
+		return nil
+	}
+	groupIds, _ := instanceGroups.byGroup()
+	for _, groupId := range groupIds {
+		if _, ok := r.heartbeats[groupId]; ok {
+			continue
+		}
+		hook, err := GetTerminatingHook(ctx, r.asg, groupId, r.lifecycleHook)
+		if err != nil {
+			return err
+		}
+		timeout := time.Duration(aws.Int64Value(hook.HeartbeatTimeout)) * time.Second
+		if timeout <= 0 {
+			timeout = time.Hour
+		}
+		r.heartbeats[groupId] = timeout / 2
+	}
+	return nil
+}
+
+// holdForTermination has an ASG start terminating one of its instances,
+// which the lifecycle hook then holds in Terminating:Wait while the ASG
+// launches a replacement, unless decrement is set.
+func (r *Rotator) holdForTermination(ctx context.Context, groupId, id string, decrement bool) error {
+	if err := RequestTermination(ctx, r.asg, id, decrement); err != nil {
+		return err
+	}
+	return AwaitLifecycleState(ctx, r.asg, groupId, id, autoscaling.LifecycleStateTerminatingWait)
+}
+
+// keepLifecycleActionAlive records heartbeats for an instance held by the
+// lifecycle hook until the returned function is called, so the hook doesn't
+// time out while the node is replaced and drained.
+func (r *Rotator) keepLifecycleActionAlive(ctx context.Context, groupId, id string) func() {
+	done := make(chan struct{})
+	var stopped sync.WaitGroup
+	stopped.Add(1)
+	go func() {
+		defer stopped.Done()
+		ticker := time.NewTicker(r.heartbeats[groupId])
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := RecordLifecycleActionHeartbeat(ctx, r.asg, groupId, r.lifecycleHook, id); err != nil {
+					logf(ctx, "Failed to record lifecycle action heartbeat for instance '%s': %s", id, err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			stopped.Wait()
+		})
+	}
+}
+
+// releaseInstance completes the lifecycle action holding an instance and
+// waits for it to terminate.
+func (r *Rotator) releaseInstance(ctx context.Context, groupId, id string) error {
+	if err := CompleteLifecycleAction(ctx, r.asg, groupId, r.lifecycleHook, id); err != nil {
+		return err
+	}
+	return awaitInstanceTerminated(ctx, r.ec2, id)
+}
+
+// terminateInGroup terminates an instance through its ASG, servicing the
+// lifecycle hook if one is configured.
+func (r *Rotator) terminateInGroup(ctx context.Context, groupId, id string, decrement bool) error {
+	if r.lifecycleHook == "" {
+		return TerminateInstanceInGroup(ctx, r.asg, r.ec2, id, decrement)
+	}
+	state, err := getLifecycleState(r.asg, groupId, id)
+	if err != nil {
+		return err
+	}
+	if state != autoscaling.LifecycleStateTerminatingWait {
+		if err := r.holdForTermination(ctx, groupId, id, decrement); err != nil {
+			return err
+		}
+	}
+	return r.releaseInstance(ctx, groupId, id)
+}
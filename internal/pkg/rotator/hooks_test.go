@@ -0,0 +1,87 @@
+package rotator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const terminating = "autoscaling:EC2_INSTANCE_TERMINATING"
+
+// terminatedInstance tells whether an instance was terminated.
+func (c *testCluster) terminatedInstance(id string) bool {
+	return aws.StringValue(c.cloud.Instance(id).State.Name) == ec2.InstanceStateNameTerminated
+}
+
+func TestLifecycleHookHoldsInstanceUntilDrained(t *testing.T) {
+	for _, strategy := range []Strategy{StrategyDetach, StrategyDrainFirst} {
+		t.Run(string(strategy), func(t *testing.T) {
+			c := newTestCluster(t, 1)
+			c.cloud.AddLifecycleHook(c.group, "drain", terminating, time.Second)
+			// Heartbeats go out every half of the hook's timeout, so a
+			// replacement this slow needs a couple of them.
+			c.sim.ReadyDelay = 1200 * time.Millisecond
+			r := c.rotator(Options{Strategy: strategy, LifecycleHook: "drain"})
+
+			if err := r.Rotate(context.Background(), c.group); err != nil {
+				t.Fatal(err)
+			}
+			old := c.original[0]
+			if !c.terminatedInstance(old) {
+				t.Errorf("instance '%s' wasn't terminated", old)
+			}
+			if detached := c.detached(t); len(detached) > 0 {
+				t.Errorf("instances %v were detached, want them terminated through the hook", detached)
+			}
+			heartbeats := c.cloud.Heartbeats(old)
+			if strategy == StrategyDetach && heartbeats == 0 {
+				t.Errorf("no heartbeat was recorded for instance '%s' while its replacement got Ready", old)
+			}
+			if desired, _ := c.capacity(); desired != 1 {
+				t.Errorf("desired capacity is %d, want 1", desired)
+			}
+		})
+	}
+}
+
+func TestLifecycleHookMissing(t *testing.T) {
+	c := newTestCluster(t, 2)
+	c.cloud.AddLifecycleHook(c.group, "other", terminating, time.Minute)
+	r := c.rotator(Options{LifecycleHook: "drain"})
+
+	if err := r.Rotate(context.Background(), c.group); err == nil {
+		t.Fatal("rotation started without the lifecycle hook")
+	}
+	if left := c.running(c.original...); len(left) != 2 {
+		t.Errorf("ASG runs old instances %v, want both", left)
+	}
+}
+
+func TestTerminateInGroupReleasesHeldInstance(t *testing.T) {
+	c := newTestCluster(t, 2)
+	c.cloud.AddLifecycleHook(c.group, "drain", terminating, time.Minute)
+	ctx := context.Background()
+	r := c.rotator(Options{LifecycleHook: "drain"})
+	held := c.original[0]
+	// A rotation that was killed may leave the instance in Terminating:Wait.
+	if err := r.holdForTermination(ctx, c.group, held, false); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := getLifecycleState(r.asg, c.group, held); err != nil || state != autoscaling.LifecycleStateTerminatingWait {
+		t.Fatalf("instance '%s' is %s (%v), want it held", held, state, err)
+	}
+
+	if err := r.terminateInGroup(ctx, c.group, held, false); err != nil {
+		t.Fatal(err)
+	}
+	if !c.terminatedInstance(held) {
+		t.Errorf("held instance '%s' wasn't terminated", held)
+	}
+	if c.terminatedInstance(c.original[1]) {
+		t.Errorf("instance '%s' was terminated too", c.original[1])
+	}
+}
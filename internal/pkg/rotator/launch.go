@@ -0,0 +1,178 @@
+package rotator
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// launchTemplates looks up launch templates through EC2 to resolve the
+// versions ASGs and instances refer to, caching every template it finds.
+type launchTemplates struct {
+	ec2 ec2iface.EC2API
+	// byKey holds each template under both its ID and its name.
+	byKey map[string]*ec2.LaunchTemplate
+	// images holds the AMI of each template version looked up, keyed by
+	// template ID and version number.
+	images map[string]string
+}
+
+func newLaunchTemplates(ec2Client ec2iface.EC2API) *launchTemplates {
+	return &launchTemplates{ec2: ec2Client, byKey: map[string]*ec2.LaunchTemplate{}, images: map[string]string{}}
+}
+
+func (t *launchTemplates) lookup(ctx context.Context, spec *autoscaling.LaunchTemplateSpecification) (*ec2.LaunchTemplate, error) {
+	input := &ec2.DescribeLaunchTemplatesInput{}
+	key := aws.StringValue(spec.LaunchTemplateId)
+	if key != "" {
+		input.LaunchTemplateIds = []*string{aws.String(key)}
+	} else {
+		key = aws.StringValue(spec.LaunchTemplateName)
+		input.LaunchTemplateNames = []*string{aws.String(key)}
+	}
+	if template, ok := t.byKey[key]; ok {
+		return template, nil
+	}
+	output, err := t.ec2.DescribeLaunchTemplatesWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if len(output.LaunchTemplates) == 0 {
+		return nil, fmt.Errorf("launch template '%s' not found", key)
+	}
+	template := output.LaunchTemplates[0]
+	t.byKey[aws.StringValue(template.LaunchTemplateId)] = template
+	t.byKey[aws.StringValue(template.LaunchTemplateName)] = template
+	return template, nil
+}
+
+// versionOf resolves a launch template version, which may be a number or one
+// of the $Latest and $Default aliases.
+func versionOf(template *ec2.LaunchTemplate, version string) (int64, error) {
+	switch version {
+	case "", "$Default":
+		return aws.Int64Value(template.DefaultVersionNumber), nil
+	case "$Latest":
+		return aws.Int64Value(template.LatestVersionNumber), nil
+	}
+	n, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("launch template '%s' has no version '%s'", aws.StringValue(template.LaunchTemplateName), version)
+	}
+	return n, nil
+}
+
+// launchTemplateFor returns the launch template an ASG launches instances of
+// instanceType from, taking mixed instances policy overrides into account.
+func launchTemplateFor(group *autoscaling.Group, instanceType string) *autoscaling.LaunchTemplateSpecification {
+	if p := group.MixedInstancesPolicy; p != nil && p.LaunchTemplate != nil {
+		for _, o := range p.LaunchTemplate.Overrides {
+			if o.LaunchTemplateSpecification != nil && aws.StringValue(o.InstanceType) == instanceType {
+				return o.LaunchTemplateSpecification
+			}
+		}
+	}
+	return groupLaunchTemplate(group)
+}
+
+// outdated tells why an instance doesn't run the launch template version or
+// launch configuration its ASG launches new instances from. It returns an
+// empty string for an instance that is up to date.
+func (t *launchTemplates) outdated(ctx context.Context, instanceGroup *InstanceGroup) (string, error) {
+	group := instanceGroup.group
+	instance := instanceGroup.asgInstance()
+	if instance == nil {
+		return fmt.Sprintf("instance is not part of ASG '%s'", instanceGroup.groupId()), nil
+	}
+
+	if want := aws.StringValue(group.LaunchConfigurationName); want != "" {
+		have := aws.StringValue(instance.LaunchConfigurationName)
+		if have == "" {
+			return fmt.Sprintf("launched from a launch template, ASG uses launch configuration '%s'", want), nil
+		}
+		if have != want {
+			return fmt.Sprintf("launched from launch configuration '%s', ASG uses '%s'", have, want), nil
+		}
+		return "", nil
+	}
+
+	wantSpec := launchTemplateFor(group, aws.StringValue(instance.InstanceType))
+	if wantSpec == nil {
+		return "", nil
+	}
+	haveSpec := instance.LaunchTemplate
+	if haveSpec == nil {
+		return fmt.Sprintf("launched from launch configuration '%s', ASG uses a launch template",
+			aws.StringValue(instance.LaunchConfigurationName)), nil
+	}
+	template, err := t.lookup(ctx, wantSpec)
+	if err != nil {
+		return "", err
+	}
+	name := aws.StringValue(template.LaunchTemplateName)
+	// The instance's template is only looked up through the ASG's, as an old
+	// template may have been deleted since.
+	if aws.StringValue(haveSpec.LaunchTemplateId) != aws.StringValue(template.LaunchTemplateId) &&
+		aws.StringValue(haveSpec.LaunchTemplateName) != name {
+		have := aws.StringValue(haveSpec.LaunchTemplateName)
+		if have == "" {
+			have = aws.StringValue(haveSpec.LaunchTemplateId)
+		}
+		return fmt.Sprintf("launched from launch template '%s', ASG uses '%s'", have, name), nil
+	}
+	want, err := versionOf(template, aws.StringValue(wantSpec.Version))
+	if err != nil {
+		return "", err
+	}
+	have, err := versionOf(template, aws.StringValue(haveSpec.Version))
+	if err != nil {
+		return "", err
+	}
+	if have != want {
+		return fmt.Sprintf("launched from launch template '%s' version %d, ASG uses version %d", name, have, want), nil
+	}
+	return "", nil
+}
+
+// image returns the AMI a launch template version launches instances from.
+// It returns an empty string if the version leaves the AMI to be chosen
+// elsewhere, e.g. by EKS for a managed node group.
+func (t *launchTemplates) image(ctx context.Context, spec *autoscaling.LaunchTemplateSpecification) (string, error) {
+	template, err := t.lookup(ctx, spec)
+	if err != nil {
+		return "", err
+	}
+	version, err := versionOf(template, aws.StringValue(spec.Version))
+	if err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("%s:%d", aws.StringValue(template.LaunchTemplateId), version)
+	if image, ok := t.images[key]; ok {
+		return image, nil
+	}
+	output, err := t.ec2.DescribeLaunchTemplateVersionsWithContext(ctx, &ec2.DescribeLaunchTemplateVersionsInput{
+		LaunchTemplateId: template.LaunchTemplateId,
+		Versions:         []*string{aws.String(strconv.FormatInt(version, 10))},
+	})
+	if err != nil {
+		return "", err
+	}
+	image := ""
+	if len(output.LaunchTemplateVersions) > 0 {
+		if data := output.LaunchTemplateVersions[0].LaunchTemplateData; data != nil {
+			image = aws.StringValue(data.ImageId)
+		}
+	}
+	// An AMI may be resolved from an SSM parameter at launch.
+	if !strings.HasPrefix(image, "ami-") {
+		image = ""
+	}
+	t.images[key] = image
+	return image, nil
+}
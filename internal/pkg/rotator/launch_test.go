@@ -0,0 +1,159 @@
+package rotator
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"github.com/tenjin/rotate-eks-asg/internal/pkg/rotator/fake"
+)
+
+// newTemplateCluster returns a test cluster whose ASG launches its size
+// instances from version 1 of a launch template, referred to by version.
+func newTemplateCluster(t *testing.T, size int, version string) (*testCluster, string) {
+	c := newTestCluster(t, 0)
+	template := c.cloud.AddLaunchTemplate("nodes")
+	c.cloud.SetLaunchTemplate(c.group, template, version)
+	if err := SetGroupCapacity(context.Background(), c.cloud.AutoScaling(), c.group, int64(size), int64(size)); err != nil {
+		t.Fatal(err)
+	}
+	c.awaitNodes(t)
+	c.original = c.instances()
+	return c, template
+}
+
+func TestOutdatedLaunchTemplate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// version is the version of the template the ASG launches from.
+		version string
+		// update changes the ASG's launch template after its instances were
+		// launched.
+		update func(c *testCluster, template string)
+		want   string
+	}{
+		{name: "same version", version: "1", update: func(*testCluster, string) {}},
+		{
+			name:    "latest version",
+			version: "$Latest",
+			update: func(c *testCluster, template string) {
+				c.cloud.AddLaunchTemplateVersion(template, false)
+			},
+			want: "launched from launch template 'nodes' version 1, ASG uses version 2",
+		},
+		{
+			name:    "unchanged default version",
+			version: "$Default",
+			update: func(c *testCluster, template string) {
+				c.cloud.AddLaunchTemplateVersion(template, false)
+			},
+		},
+		{
+			name:    "new default version",
+			version: "$Default",
+			update: func(c *testCluster, template string) {
+				c.cloud.AddLaunchTemplateVersion(template, true)
+			},
+			want: "launched from launch template 'nodes' version 1, ASG uses version 2",
+		},
+		{
+			name:    "other template",
+			version: "1",
+			update: func(c *testCluster, _ string) {
+				c.cloud.SetLaunchTemplate(c.group, c.cloud.AddLaunchTemplate("nodes-v2"), "1")
+			},
+			want: "launched from launch template 'nodes', ASG uses 'nodes-v2'",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, template := newTemplateCluster(t, 1, tc.version)
+			tc.update(c, template)
+			igs, err := DescribeAutoScalingGroup(c.cloud.AutoScaling(), c.cloud.EC2(), c.group)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := newLaunchTemplates(c.cloud.EC2()).outdated(context.Background(), igs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("outdated() = '%s', want '%s'", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOutdatedLaunchConfiguration(t *testing.T) {
+	instance := func(launchConfiguration string, launchTemplate *autoscaling.LaunchTemplateSpecification) *InstanceGroup {
+		return &InstanceGroup{
+			group: &autoscaling.Group{
+				AutoScalingGroupName:    aws.String("ng-1"),
+				LaunchConfigurationName: aws.String("nodes-2"),
+				Instances: []*autoscaling.Instance{{
+					InstanceId:              aws.String("i-1"),
+					LaunchConfigurationName: aws.String(launchConfiguration),
+					LaunchTemplate:          launchTemplate,
+				}},
+			},
+			instance: &ec2.Instance{InstanceId: aws.String("i-1")},
+		}
+	}
+	for _, tc := range []struct {
+		name     string
+		instance *InstanceGroup
+		want     string
+	}{
+		{name: "same", instance: instance("nodes-2", nil)},
+		{
+			name:     "older",
+			instance: instance("nodes-1", nil),
+			want:     "launched from launch configuration 'nodes-1', ASG uses 'nodes-2'",
+		},
+		{
+			name:     "launch template",
+			instance: instance("", &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: aws.String("nodes")}),
+			want:     "launched from a launch template, ASG uses launch configuration 'nodes-2'",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := newLaunchTemplates(fake.NewCloud().EC2()).outdated(context.Background(), tc.instance)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("outdated() = '%s', want '%s'", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRotateOutdatedOnly(t *testing.T) {
+	c, template := newTemplateCluster(t, 2, "$Latest")
+	c.cloud.AddLaunchTemplateVersion(template, false)
+	if err := SetGroupCapacity(context.Background(), c.cloud.AutoScaling(), c.group, 3, 3); err != nil {
+		t.Fatal(err)
+	}
+	c.awaitNodes(t)
+	var current string
+	for _, id := range c.instances() {
+		if !sets.NewString(c.original...).Has(id) {
+			current = id
+		}
+	}
+	r := c.rotator(Options{Policies: Policies{LaunchOutdated: true}})
+
+	if err := r.Rotate(context.Background(), c.group); err != nil {
+		t.Fatal(err)
+	}
+	if left := c.running(c.original...); len(left) > 0 {
+		t.Errorf("outdated instances %v still run", left)
+	}
+	if len(c.running(current)) == 0 {
+		t.Errorf("instance '%s' on the current version was rotated", current)
+	}
+}
@@ -0,0 +1,69 @@
+package rotator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+type logPrefixKey struct{}
+
+// withLogPrefix makes the lines logged with ctx start with "[prefix] ", so
+// the output of ASGs rotated concurrently can be told apart.
+func withLogPrefix(ctx context.Context, prefix string) context.Context {
+	return context.WithValue(ctx, logPrefixKey{}, "["+prefix+"] ")
+}
+
+func logPrefix(ctx context.Context) string {
+	prefix, _ := ctx.Value(logPrefixKey{}).(string)
+	return prefix
+}
+
+func logf(ctx context.Context, format string, args ...interface{}) {
+	log.Print(logPrefix(ctx) + fmt.Sprintf(format, args...))
+}
+
+func logln(ctx context.Context, args ...interface{}) {
+	log.Print(logPrefix(ctx) + fmt.Sprintln(args...))
+}
+
+// logWriter returns a writer that logs every line written to it with the
+// prefix of ctx, for output such as the drain helper's.
+func logWriter(ctx context.Context) io.Writer {
+	return &lineLogger{ctx: ctx}
+}
+
+type lineLogger struct {
+	ctx context.Context
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf.Write(p)
+	for {
+		line, err := l.buf.ReadString('\n')
+		if err != nil {
+			// Keep the incomplete line for the next write.
+			l.buf.WriteString(line)
+			return len(p), nil
+		}
+		logf(l.ctx, "%s", line)
+	}
+}
+
+// cleanupContext returns a fresh context for restoring the cluster after a
+// failure, which may be the cancellation of ctx itself. It keeps the log
+// prefix of ctx.
+func cleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	cleanup := context.Background()
+	if prefix := logPrefix(ctx); prefix != "" {
+		cleanup = context.WithValue(cleanup, logPrefixKey{}, prefix)
+	}
+	return context.WithTimeout(cleanup, cleanupTimeout)
+}
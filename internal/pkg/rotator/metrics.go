@@ -0,0 +1,103 @@
+package rotator
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	coreV1 "k8s.io/api/core/v1"
+)
+
+// Metrics are the Prometheus metrics of a rotation. A nil *Metrics records
+// nothing.
+type Metrics struct {
+	planned   *prometheus.GaugeVec
+	rotated   *prometheus.CounterVec
+	failed    *prometheus.CounterVec
+	evicted   *prometheus.CounterVec
+	inPhase   *prometheus.GaugeVec
+	durations *prometheus.HistogramVec
+}
+
+// NewMetrics creates the metrics of a rotation and registers them with
+// registerer.
+func NewMetrics(registerer prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		planned: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "rotate_eks_asg_nodes_planned",
+			Help: "Nodes of the ASG the rotation set out to replace.",
+		}, []string{"group"}),
+		rotated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rotate_eks_asg_nodes_rotated_total",
+			Help: "Nodes of the ASG that were replaced and terminated.",
+		}, []string{"group"}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rotate_eks_asg_nodes_failed_total",
+			Help: "Nodes of the ASG whose rotation failed in one of its phases.",
+		}, []string{"group"}),
+		evicted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rotate_eks_asg_pods_evicted_total",
+			Help: "Pods evicted or deleted while draining nodes of the ASG.",
+		}, []string{"group"}),
+		inPhase: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "rotate_eks_asg_nodes_in_phase",
+			Help: "Nodes of the ASG currently in each phase of their rotation.",
+		}, []string{"group", "phase"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "rotate_eks_asg_phase_duration_seconds",
+			Help: "How long each phase of a node's rotation took, failed ones included.",
+			// From a second to about an hour.
+			Buckets: prometheus.ExponentialBuckets(1, 2, 13),
+		}, []string{"phase"}),
+	}
+	registerer.MustRegister(m.planned, m.rotated, m.failed, m.evicted, m.inPhase, m.durations)
+	return m
+}
+
+// plan records how many nodes of each ASG the rotation is about to replace.
+func (m *Metrics) plan(instanceGroups InstanceGroups) {
+	if m == nil {
+		return
+	}
+	groupIds, byGroup := instanceGroups.byGroup()
+	for _, groupId := range groupIds {
+		m.planned.WithLabelValues(groupId).Set(float64(len(byGroup[groupId])))
+	}
+}
+
+func (m *Metrics) nodeRotated(groupId string) {
+	if m == nil {
+		return
+	}
+	m.rotated.WithLabelValues(groupId).Inc()
+}
+
+func (m *Metrics) nodeFailed(groupId string) {
+	if m == nil {
+		return
+	}
+	m.failed.WithLabelValues(groupId).Inc()
+}
+
+// podEvicted returns the function counting the pods drained from a node of
+// an ASG.
+func (r *Rotator) podEvicted(groupId string) func(*coreV1.Pod) {
+	if r.metrics == nil {
+		return nil
+	}
+	return func(*coreV1.Pod) { r.metrics.evicted.WithLabelValues(groupId).Inc() }
+}
+
+// startPhase records that a node of an ASG entered phase, and returns the
+// function recording that it left it.
+func (m *Metrics) startPhase(groupId string, phase Phase) func() {
+	if m == nil {
+		return func() {}
+	}
+	start := time.Now()
+	gauge := m.inPhase.WithLabelValues(groupId, string(phase))
+	gauge.Inc()
+	return func() {
+		gauge.Dec()
+		m.durations.WithLabelValues(string(phase)).Observe(time.Since(start).Seconds())
+	}
+}
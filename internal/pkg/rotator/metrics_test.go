@@ -0,0 +1,79 @@
+package rotator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/tenjin/rotate-eks-asg/internal/pkg/rotator/fake"
+)
+
+// counterValue returns the value of the counter name for group in registry.
+func counterValue(t *testing.T, registry *prometheus.Registry, name, group string) float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "group" && label.GetValue() == group {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestMetricsCountRotatedNodes(t *testing.T) {
+	c := newTestCluster(t, 3)
+	registry := prometheus.NewRegistry()
+	r := c.rotator(Options{Metrics: NewMetrics(registry)})
+	if err := r.Rotate(context.Background(), c.group); err != nil {
+		t.Fatal(err)
+	}
+	if rotated := counterValue(t, registry, "rotate_eks_asg_nodes_rotated_total", c.group); rotated != 3 {
+		t.Errorf("%g nodes counted as rotated, want 3", rotated)
+	}
+	if failed := counterValue(t, registry, "rotate_eks_asg_nodes_failed_total", c.group); failed != 0 {
+		t.Errorf("%g nodes counted as failed, want 0", failed)
+	}
+}
+
+func TestMetricsCountFailedNodeOfBatchOnce(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.sim.Faults = func(string, *ec2.Instance) fake.Fault { return fake.NeverReady }
+	registry := prometheus.NewRegistry()
+	opts := surgeOptions(2)
+	opts.Timeouts = Timeouts{Ready: 200 * time.Millisecond}
+	opts.Metrics = NewMetrics(registry)
+	r := c.rotator(opts)
+	if err := r.Rotate(context.Background(), c.group); err == nil {
+		t.Fatal("rotation succeeded with replacements that never get Ready")
+	}
+	if failed := counterValue(t, registry, "rotate_eks_asg_nodes_failed_total", c.group); failed != 1 {
+		t.Errorf("%g nodes counted as failed, want 1", failed)
+	}
+}
+
+func TestMetricsSkipCancelledRotation(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.sim.Faults = func(string, *ec2.Instance) fake.Fault { return fake.NeverReady }
+	registry := prometheus.NewRegistry()
+	r := c.rotator(Options{Metrics: NewMetrics(registry)})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := r.Rotate(ctx, c.group); err == nil {
+		t.Fatal("cancelled rotation succeeded")
+	}
+	if failed := counterValue(t, registry, "rotate_eks_asg_nodes_failed_total", c.group); failed != 0 {
+		t.Errorf("%g nodes counted as failed, want 0", failed)
+	}
+}
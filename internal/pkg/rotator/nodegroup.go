@@ -0,0 +1,164 @@
+package rotator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/eks"
+	"github.com/aws/aws-sdk-go/service/eks/eksiface"
+)
+
+// Tags EKS puts on the ASGs of its managed node groups.
+const (
+	eksClusterNameTag   = "eks:cluster-name"
+	eksNodegroupNameTag = "eks:nodegroup-name"
+)
+
+// PlannedNodegroup is the EKS managed node group an ASG belongs to.
+type PlannedNodegroup struct {
+	Name string `json:"name"`
+	// ReleaseVersion is the version of the EKS optimized AMI the node group
+	// launches nodes from.
+	ReleaseVersion string `json:"releaseVersion,omitempty"`
+	AMIType        string `json:"amiType,omitempty"`
+	// Version is the Kubernetes version of the node group.
+	Version string `json:"version,omitempty"`
+}
+
+func newPlannedNodegroup(nodegroup *eks.Nodegroup) *PlannedNodegroup {
+	if nodegroup == nil {
+		return nil
+	}
+	return &PlannedNodegroup{
+		Name:           aws.StringValue(nodegroup.NodegroupName),
+		ReleaseVersion: aws.StringValue(nodegroup.ReleaseVersion),
+		AMIType:        aws.StringValue(nodegroup.AmiType),
+		Version:        aws.StringValue(nodegroup.Version),
+	}
+}
+
+// GetNodegroups describes the managed node groups of an EKS cluster.
+func GetNodegroups(ctx context.Context, client eksiface.EKSAPI, clusterName string) ([]*eks.Nodegroup, error) {
+	var names []*string
+	input := &eks.ListNodegroupsInput{ClusterName: aws.String(clusterName)}
+	err := client.ListNodegroupsPagesWithContext(ctx, input, func(out *eks.ListNodegroupsOutput, _ bool) bool {
+		names = append(names, out.Nodegroups...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	nodegroups := make([]*eks.Nodegroup, 0, len(names))
+	for _, name := range names {
+		nodegroup, err := GetNodegroup(ctx, client, clusterName, aws.StringValue(name))
+		if err != nil {
+			return nil, err
+		}
+		nodegroups = append(nodegroups, nodegroup)
+	}
+	return nodegroups, nil
+}
+
+// GetNodegroup describes one managed node group of an EKS cluster.
+func GetNodegroup(ctx context.Context, client eksiface.EKSAPI, clusterName, name string) (*eks.Nodegroup, error) {
+	out, err := client.DescribeNodegroupWithContext(ctx, &eks.DescribeNodegroupInput{
+		ClusterName:   aws.String(clusterName),
+		NodegroupName: aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Nodegroup, nil
+}
+
+// nodegroupGroups returns the names of the ASGs a node group consists of.
+func nodegroupGroups(nodegroup *eks.Nodegroup) []string {
+	var names []string
+	if nodegroup.Resources == nil {
+		return names
+	}
+	for _, group := range nodegroup.Resources.AutoScalingGroups {
+		names = append(names, aws.StringValue(group.Name))
+	}
+	return names
+}
+
+// groupTag returns the value of an ASG's tag, or an empty string.
+func groupTag(group *autoscaling.Group, key string) string {
+	for _, tag := range group.Tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	return ""
+}
+
+// addNodegroup remembers which ASGs make up a node group.
+func (r *Rotator) addNodegroup(nodegroup *eks.Nodegroup) {
+	for _, name := range nodegroupGroups(nodegroup) {
+		r.nodegroups[name] = nodegroup
+	}
+}
+
+// nodegroupOf returns the managed node group an ASG belongs to, or nil for a
+// self-managed ASG. Node groups not seen yet are looked up through the tags
+// EKS puts on their ASGs.
+func (r *Rotator) nodegroupOf(ctx context.Context, group *autoscaling.Group) *eks.Nodegroup {
+	groupId := aws.StringValue(group.AutoScalingGroupName)
+	if nodegroup, ok := r.nodegroups[groupId]; ok {
+		return nodegroup
+	}
+	clusterName, name := groupTag(group, eksClusterNameTag), groupTag(group, eksNodegroupNameTag)
+	if clusterName == "" || name == "" {
+		return nil
+	}
+	nodegroup, err := GetNodegroup(ctx, r.eks, clusterName, name)
+	if err != nil {
+		logf(ctx, "Failed to describe node group '%s' of ASG '%s': %s", name, groupId, err)
+		return nil
+	}
+	r.addNodegroup(nodegroup)
+	return nodegroup
+}
+
+// describeNodegroup logs that an ASG is managed by EKS as part of a node
+// group.
+func describeNodegroup(ctx context.Context, groupId string, nodegroup *eks.Nodegroup) {
+	logf(ctx, "ASG '%s' belongs to managed node group '%s' (release version %s, AMI type %s).\n",
+		groupId, aws.StringValue(nodegroup.NodegroupName),
+		aws.StringValue(nodegroup.ReleaseVersion), aws.StringValue(nodegroup.AmiType))
+}
+
+// resolveGroupNames maps the names of managed node groups to the ASGs they
+// consist of. Names of existing ASGs are kept as they are.
+func (r *Rotator) resolveGroupNames(ctx context.Context, names []string) ([]string, error) {
+	var groups []string
+	for _, name := range names {
+		if _, err := getAutoScalingGroup(r.asg, name); err == nil {
+			groups = append(groups, name)
+			continue
+		}
+		if r.clusterName == "" {
+			eksCluster, err := GetEKSCluserByURL(r.eks, r.k8sConfig.Host)
+			if err != nil {
+				return nil, fmt.Errorf("'%s' is not an ASG, and looking it up as a node group failed: %v", name, err)
+			}
+			r.clusterName = *eksCluster.Name
+		}
+		nodegroup, err := GetNodegroup(ctx, r.eks, r.clusterName, name)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is neither an ASG nor a node group of cluster '%s': %v", name, r.clusterName, err)
+		}
+		r.addNodegroup(nodegroup)
+		asgs := nodegroupGroups(nodegroup)
+		if len(asgs) == 0 {
+			return nil, fmt.Errorf("node group '%s' has no ASGs", name)
+		}
+		logf(ctx, "Node group '%s' consists of ASG(s) '%s'.\n", name, strings.Join(asgs, "', '"))
+		groups = append(groups, asgs...)
+	}
+	return groups, nil
+}
@@ -0,0 +1,84 @@
+package rotator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/rest"
+)
+
+const testEndpoint = "https://cluster.example.com"
+
+// nodegroupCluster returns a test cluster whose EKS cluster has a managed
+// node group 'workers' made of the ASG 'ng-2', next to the self-managed ASG
+// 'ng-1'.
+func nodegroupCluster(t *testing.T) *testCluster {
+	c := newTestCluster(t, 1)
+	c.cloud.AddCluster("prod", testEndpoint)
+	c.addGroup(t, "ng-2", 1)
+	c.cloud.AddNodegroup("prod", "workers", "ng-2", "1.21.2-20210722", "AL2_x86_64")
+	return c
+}
+
+// clusterRotator returns a rotator that only knows the API server URL of
+// the cluster, as when it runs with a kubeconfig.
+func (c *testCluster) clusterRotator(opts Options) *Rotator {
+	r := c.rotator(opts)
+	r.k8sConfig = &rest.Config{Host: testEndpoint}
+	return r
+}
+
+func TestResolveGroupNames(t *testing.T) {
+	c := nodegroupCluster(t)
+	r := c.clusterRotator(Options{})
+
+	groups, err := r.resolveGroupNames(context.Background(), []string{"ng-1", "workers"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ng-1", "ng-2"}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("resolved ASGs %v, want %v", groups, want)
+	}
+	if r.clusterName != "prod" {
+		t.Errorf("cluster is '%s', want it found by its endpoint", r.clusterName)
+	}
+}
+
+func TestResolveGroupNamesRejectsUnknownNames(t *testing.T) {
+	c := nodegroupCluster(t)
+	r := c.clusterRotator(Options{})
+
+	_, err := r.resolveGroupNames(context.Background(), []string{"ng-1", "spot"})
+	if err == nil || !strings.Contains(err.Error(), "neither an ASG nor a node group of cluster 'prod'") {
+		t.Errorf("resolving an unknown name failed with %v", err)
+	}
+}
+
+func TestPlanRecordsNodegroup(t *testing.T) {
+	c := nodegroupCluster(t)
+	var out bytes.Buffer
+	r := c.clusterRotator(Options{DryRun: true, PlanFormat: "json", PlanOutput: &out})
+
+	if err := r.RotateAll(context.Background(), []string{"workers", "ng-1"}); err != nil {
+		t.Fatal(err)
+	}
+	var plan Plan
+	if err := json.Unmarshal(out.Bytes(), &plan); err != nil {
+		t.Fatal(err)
+	}
+	for _, group := range plan.Groups {
+		switch {
+		case group.Name == "ng-1" && group.Nodegroup != nil:
+			t.Errorf("self-managed ASG 'ng-1' is planned as part of node group '%s'", group.Nodegroup.Name)
+		case group.Name == "ng-2" && (group.Nodegroup == nil || group.Nodegroup.ReleaseVersion != "1.21.2-20210722"):
+			t.Errorf("ASG 'ng-2' is planned with node group %+v, want 'workers' at its release version", group.Nodegroup)
+		}
+	}
+	if len(plan.Groups) != 2 {
+		t.Errorf("plan has ASGs %+v, want 'ng-1' and 'ng-2'", plan.Groups)
+	}
+}
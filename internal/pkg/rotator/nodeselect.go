@@ -0,0 +1,279 @@
+package rotator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	coreV1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+// NodeSelector picks the instances to rotate by their Kubernetes node. A node
+// must match each kind of criterion that is set; the taints and conditions
+// listed are alternatives.
+type NodeSelector struct {
+	// Labels is a label selector the node must match.
+	Labels string
+	// Taints the node may carry.
+	Taints []TaintSelector
+	// Conditions the node may be in.
+	Conditions []ConditionSelector
+	// KubeletVersion constrains the version of the node's kubelet.
+	KubeletVersion *VersionConstraint
+}
+
+// ParseNodeSelector parses a label selector, taints written as
+// key[=value][:effect], conditions written as type[=status] or NotReady, and
+// a kubelet version constraint like <1.21.
+func ParseNodeSelector(selector string, taints, conditions []string, kubeletVersion string) (NodeSelector, error) {
+	s := NodeSelector{Labels: selector}
+	if _, err := labels.Parse(selector); err != nil {
+		return s, fmt.Errorf("invalid node selector '%s': %v", selector, err)
+	}
+	for _, t := range taints {
+		taint, err := ParseTaintSelector(t)
+		if err != nil {
+			return s, err
+		}
+		s.Taints = append(s.Taints, taint)
+	}
+	for _, c := range conditions {
+		condition, err := ParseConditionSelector(c)
+		if err != nil {
+			return s, err
+		}
+		s.Conditions = append(s.Conditions, condition)
+	}
+	if kubeletVersion != "" {
+		constraint, err := ParseVersionConstraint(kubeletVersion)
+		if err != nil {
+			return s, err
+		}
+		s.KubeletVersion = &constraint
+	}
+	return s, nil
+}
+
+func (s NodeSelector) empty() bool {
+	return s.Labels == "" && len(s.Taints) == 0 && len(s.Conditions) == 0 && s.KubeletVersion == nil
+}
+
+// rejects tells why the selector leaves out a node whose labels already
+// match. It returns an empty string if the node is selected.
+func (s NodeSelector) rejects(node *coreV1.Node) string {
+	if len(s.Taints) > 0 {
+		tainted := false
+		for _, t := range s.Taints {
+			if t.matches(node) {
+				tainted = true
+				break
+			}
+		}
+		if !tainted {
+			return "it has none of the selected taints"
+		}
+	}
+	if len(s.Conditions) > 0 {
+		inCondition := false
+		for _, c := range s.Conditions {
+			if c.matches(node) {
+				inCondition = true
+				break
+			}
+		}
+		if !inCondition {
+			return "it is in none of the selected conditions"
+		}
+	}
+	if s.KubeletVersion != nil {
+		kubelet := node.Status.NodeInfo.KubeletVersion
+		ok, err := s.KubeletVersion.matches(kubelet)
+		if err != nil {
+			return fmt.Sprintf("its kubelet version '%s' can't be compared: %v", kubelet, err)
+		}
+		if !ok {
+			return fmt.Sprintf("its kubelet version %s is not %s", kubelet, s.KubeletVersion)
+		}
+	}
+	return ""
+}
+
+// TaintSelector matches the taints with Key, and with Value and Effect if set.
+type TaintSelector struct {
+	Key    string
+	Value  string
+	Effect coreV1.TaintEffect
+}
+
+// ParseTaintSelector parses a taint written as key[=value][:effect].
+func ParseTaintSelector(s string) (TaintSelector, error) {
+	var t TaintSelector
+	rest := s
+	if i := strings.LastIndex(rest, ":"); i >= 0 {
+		t.Effect = coreV1.TaintEffect(rest[i+1:])
+		rest = rest[:i]
+		switch t.Effect {
+		case coreV1.TaintEffectNoSchedule, coreV1.TaintEffectPreferNoSchedule, coreV1.TaintEffectNoExecute:
+		default:
+			return t, fmt.Errorf("taint '%s' has an invalid effect '%s'", s, t.Effect)
+		}
+	}
+	if i := strings.Index(rest, "="); i >= 0 {
+		t.Key, t.Value = rest[:i], rest[i+1:]
+	} else {
+		t.Key = rest
+	}
+	if t.Key == "" {
+		return t, fmt.Errorf("taint '%s' has no key", s)
+	}
+	return t, nil
+}
+
+func (t TaintSelector) matches(node *coreV1.Node) bool {
+	for _, taint := range node.Spec.Taints {
+		if taint.Key != t.Key {
+			continue
+		}
+		if (t.Value == "" || taint.Value == t.Value) && (t.Effect == "" || taint.Effect == t.Effect) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConditionSelector matches nodes whose condition of Type has Status, or, if
+// Negate is set, any other status.
+type ConditionSelector struct {
+	Type   coreV1.NodeConditionType
+	Status coreV1.ConditionStatus
+	Negate bool
+}
+
+// ParseConditionSelector parses a condition written as type, meaning its
+// status is True, or type=status. NotReady selects nodes that are not Ready,
+// including nodes whose status is Unknown.
+func ParseConditionSelector(s string) (ConditionSelector, error) {
+	if s == "NotReady" {
+		return ConditionSelector{Type: coreV1.NodeReady, Status: coreV1.ConditionTrue, Negate: true}, nil
+	}
+	c := ConditionSelector{Type: coreV1.NodeConditionType(s), Status: coreV1.ConditionTrue}
+	if i := strings.Index(s, "="); i >= 0 {
+		c.Type, c.Status = coreV1.NodeConditionType(s[:i]), coreV1.ConditionStatus(s[i+1:])
+		switch c.Status {
+		case coreV1.ConditionTrue, coreV1.ConditionFalse, coreV1.ConditionUnknown:
+		default:
+			return c, fmt.Errorf("condition '%s' has an invalid status '%s'", s, c.Status)
+		}
+	}
+	if c.Type == "" {
+		return c, fmt.Errorf("condition '%s' has no type", s)
+	}
+	return c, nil
+}
+
+func (c ConditionSelector) matches(node *coreV1.Node) bool {
+	status := coreV1.ConditionUnknown
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == c.Type {
+			status = condition.Status
+			break
+		}
+	}
+	return (status == c.Status) != c.Negate
+}
+
+// VersionConstraint compares versions against a version with an operator:
+// one of <, <=, >, >=, = and !=.
+type VersionConstraint struct {
+	Op      string
+	Version *version.Version
+}
+
+// ParseVersionConstraint parses a constraint like <1.21 or >=1.20.4. Without
+// an operator the versions must be equal.
+func ParseVersionConstraint(s string) (VersionConstraint, error) {
+	c := VersionConstraint{Op: "="}
+	rest := s
+	for _, op := range []string{"<=", ">=", "!=", "<", ">", "="} {
+		if strings.HasPrefix(rest, op) {
+			c.Op, rest = op, rest[len(op):]
+			break
+		}
+	}
+	v, err := version.ParseGeneric(strings.TrimSpace(rest))
+	if err != nil {
+		return c, fmt.Errorf("invalid version constraint '%s': %v", s, err)
+	}
+	c.Version = v
+	return c, nil
+}
+
+func (c VersionConstraint) String() string {
+	return c.Op + c.Version.String()
+}
+
+// matches compares a version such as a kubelet's v1.20.4-eks-6b7464 against
+// the constraint, ignoring anything after the numbers.
+func (c VersionConstraint) matches(s string) (bool, error) {
+	v, err := version.ParseGeneric(s)
+	if err != nil {
+		return false, err
+	}
+	cmp, err := v.Compare(c.Version.String())
+	if err != nil {
+		return false, err
+	}
+	switch c.Op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	case "!=":
+		return cmp != 0, nil
+	default:
+		return cmp == 0, nil
+	}
+}
+
+// filterNodes keeps the instances whose node the node selector picks. Nodes
+// are listed with the label selector applied by the API server and mapped
+// back to their instances through their provider IDs.
+func (r *Rotator) filterNodes(ctx context.Context, instanceGroups InstanceGroups) (InstanceGroups, error) {
+	list, err := r.k8s.CoreV1().Nodes().List(ctx, v1.ListOptions{LabelSelector: r.nodeSelector.Labels})
+	if err != nil {
+		return nil, fmt.Errorf("listing nodes: %v", err)
+	}
+	var selected InstanceGroups
+	for _, ig := range instanceGroups {
+		var node *coreV1.Node
+		for n := range list.Items {
+			if nodeMatchesInstance(&list.Items[n], ig.instanceId(), "") {
+				node = &list.Items[n]
+				break
+			}
+		}
+		if node == nil && r.nodeSelector.Labels == "" {
+			logf(ctx, "Skipping instance '%s' of ASG '%s', it has no node.", ig.instanceId(), ig.groupId())
+			continue
+		}
+		if node == nil {
+			logf(ctx, "Skipping instance '%s' of ASG '%s', it has no node matching '%s'.",
+				ig.instanceId(), ig.groupId(), r.nodeSelector.Labels)
+			continue
+		}
+		if reason := r.nodeSelector.rejects(node); reason != "" {
+			logf(ctx, "Skipping instance '%s' of ASG '%s', %s.", ig.instanceId(), ig.groupId(), reason)
+			continue
+		}
+		logf(ctx, "Node '%s' (instance '%s') is selected.", node.Name, ig.instanceId())
+		selected = append(selected, ig)
+	}
+	return selected, nil
+}
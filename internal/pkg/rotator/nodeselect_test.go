@@ -0,0 +1,145 @@
+package rotator
+
+import (
+	"context"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// updateNode changes the node of an instance.
+func (c *testCluster) updateNode(t *testing.T, instanceId string, update func(*coreV1.Node)) {
+	ctx := context.Background()
+	node, err := GetNodeByInstanceID(ctx, c.client, instanceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update(node)
+	if _, err := c.client.CoreV1().Nodes().Update(ctx, node, v1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseNodeSelector(t *testing.T) {
+	for _, tc := range []struct {
+		name                   string
+		labels, kubeletVersion string
+		taints, conditions     []string
+		wantErr                bool
+		wantTaint              TaintSelector
+		wantCondition          ConditionSelector
+		wantConstraint         string
+	}{
+		{name: "taint key", taints: []string{"spot"}, wantTaint: TaintSelector{Key: "spot"}},
+		{
+			name:      "taint with value and effect",
+			taints:    []string{"dedicated=gpu:NoSchedule"},
+			wantTaint: TaintSelector{Key: "dedicated", Value: "gpu", Effect: coreV1.TaintEffectNoSchedule},
+		},
+		{name: "taint with invalid effect", taints: []string{"spot:Never"}, wantErr: true},
+		{name: "taint without key", taints: []string{"=gpu"}, wantErr: true},
+		{
+			name:          "condition",
+			conditions:    []string{"MemoryPressure"},
+			wantCondition: ConditionSelector{Type: coreV1.NodeMemoryPressure, Status: coreV1.ConditionTrue},
+		},
+		{
+			name:          "condition with status",
+			conditions:    []string{"Ready=Unknown"},
+			wantCondition: ConditionSelector{Type: coreV1.NodeReady, Status: coreV1.ConditionUnknown},
+		},
+		{
+			name:          "not ready",
+			conditions:    []string{"NotReady"},
+			wantCondition: ConditionSelector{Type: coreV1.NodeReady, Status: coreV1.ConditionTrue, Negate: true},
+		},
+		{name: "condition with invalid status", conditions: []string{"Ready=Maybe"}, wantErr: true},
+		{name: "version", kubeletVersion: "<1.21", wantConstraint: "<1.21"},
+		{name: "version without operator", kubeletVersion: "1.20.4", wantConstraint: "=1.20.4"},
+		{name: "invalid version", kubeletVersion: ">=latest", wantErr: true},
+		{name: "invalid labels", labels: "role in (web", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := ParseNodeSelector(tc.labels, tc.taints, tc.conditions, tc.kubeletVersion)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("parsed %+v, want an error", s)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tc.taints) > 0 && s.Taints[0] != tc.wantTaint {
+				t.Errorf("taint parsed as %+v, want %+v", s.Taints[0], tc.wantTaint)
+			}
+			if len(tc.conditions) > 0 && s.Conditions[0] != tc.wantCondition {
+				t.Errorf("condition parsed as %+v, want %+v", s.Conditions[0], tc.wantCondition)
+			}
+			if tc.kubeletVersion != "" && s.KubeletVersion.String() != tc.wantConstraint {
+				t.Errorf("version constraint parsed as %s, want %s", s.KubeletVersion, tc.wantConstraint)
+			}
+		})
+	}
+}
+
+func TestNodeSelectorRejects(t *testing.T) {
+	node := &coreV1.Node{
+		Spec: coreV1.NodeSpec{Taints: []coreV1.Taint{{Key: "dedicated", Value: "gpu", Effect: coreV1.TaintEffectNoSchedule}}},
+		Status: coreV1.NodeStatus{
+			Conditions: []coreV1.NodeCondition{{Type: coreV1.NodeReady, Status: coreV1.ConditionUnknown}},
+			NodeInfo:   coreV1.NodeSystemInfo{KubeletVersion: "v1.20.4-eks-6b7464"},
+		},
+	}
+	for _, tc := range []struct {
+		name               string
+		taints, conditions []string
+		kubeletVersion     string
+		selected           bool
+	}{
+		{name: "no criteria", selected: true},
+		{name: "any of the taints", taints: []string{"spot", "dedicated:NoSchedule"}, selected: true},
+		{name: "other taint value", taints: []string{"dedicated=ml"}},
+		{name: "not ready includes unknown", conditions: []string{"NotReady"}, selected: true},
+		{name: "ready", conditions: []string{"Ready"}},
+		{name: "older kubelet", kubeletVersion: "<1.21", selected: true},
+		{name: "kubelet suffix ignored", kubeletVersion: "1.20.4", selected: true},
+		{name: "newer kubelet", kubeletVersion: ">=1.21"},
+		{name: "every kind must match", taints: []string{"dedicated"}, kubeletVersion: ">=1.21"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := ParseNodeSelector("", tc.taints, tc.conditions, tc.kubeletVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reason := s.rejects(node)
+			if selected := reason == ""; selected != tc.selected {
+				t.Errorf("node selected %t (%s), want %t", selected, reason, tc.selected)
+			}
+		})
+	}
+}
+
+func TestRotateSelectedNodes(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.updateNode(t, c.original[0], func(node *coreV1.Node) {
+		node.Labels["role"] = "web"
+	})
+	c.updateNode(t, c.original[1], func(node *coreV1.Node) {
+		node.Labels["role"] = "web"
+		node.Spec.Taints = []coreV1.Taint{{Key: "spot", Effect: coreV1.TaintEffectNoSchedule}}
+	})
+	selector, err := ParseNodeSelector("role=web", []string{"spot"}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := c.rotator(Options{NodeSelector: selector})
+
+	if err := r.Rotate(context.Background(), c.group); err != nil {
+		t.Fatal(err)
+	}
+	if left := c.running(c.original...); len(left) != 2 || left[0] != c.original[0] || left[1] != c.original[2] {
+		t.Errorf("ASG runs old instances %v, want all but '%s'", left, c.original[1])
+	}
+}
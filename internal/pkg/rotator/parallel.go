@@ -0,0 +1,130 @@
+package rotator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// errHalted is returned by the rotation of an ASG that stopped early because
+// the rotation of another ASG failed.
+var errHalted = errors.New("rotation halted after another ASG failed")
+
+// halt stops new nodes from being rotated and cancels an open prompt; nodes
+// already being rotated are finished.
+func (r *Rotator) halt() {
+	atomic.StoreInt32(&r.halted, 1)
+	r.haltOnce.Do(func() { close(r.halts) })
+}
+
+func (r *Rotator) isHalted() bool { return atomic.LoadInt32(&r.halted) == 1 }
+
+// pause halts the rotation without it having failed, for the given reason.
+func (r *Rotator) pause(reason string) {
+	r.paused.Store(reason)
+	r.halt()
+}
+
+// pausedError returns the error a paused rotation stops with, or nil if the
+// rotation wasn't paused.
+func (r *Rotator) pausedError() error {
+	reason, _ := r.paused.Load().(string)
+	if reason == "" {
+		return nil
+	}
+	if r.state != nil {
+		return fmt.Errorf("rotation paused: %s; run again with --resume to continue", reason)
+	}
+	return fmt.Errorf("rotation paused: %s", reason)
+}
+
+// rotateGroups rotates up to r.parallel ASGs at once, each ASG one node or
+// batch at a time. After the first failure no further ASGs are started and
+// the running ones stop after their current node; the first error is
+// returned.
+func (r *Rotator) rotateGroups(ctx context.Context, instanceGroups InstanceGroups) error {
+	groupIds, byGroup := instanceGroups.byGroup()
+	slots := make(chan struct{}, r.parallel)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for _, groupId := range groupIds {
+		slots <- struct{}{}
+		if r.isHalted() {
+			<-slots
+			logf(ctx, "Not starting the rotation of ASG '%s'.", groupId)
+			continue
+		}
+		wg.Add(1)
+		go func(groupId string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			groupCtx := withLogPrefix(ctx, groupId)
+			err := r.rotateGroup(groupCtx, groupId, byGroup[groupId])
+			if err == nil {
+				logf(groupCtx, "Rotation of ASG '%s' finished.", groupId)
+				return
+			}
+			if err == errHalted {
+				logf(groupCtx, "Rotation of ASG '%s' stopped early.", groupId)
+				return
+			}
+			logf(groupCtx, "Rotation of ASG '%s' failed: %s", groupId, err)
+			r.halt()
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			mu.Unlock()
+		}(groupId)
+	}
+	wg.Wait()
+	if firstErr == nil {
+		return r.pausedError()
+	}
+	return firstErr
+}
+
+// rotateGroup rotates the instances of one ASG with its strategy.
+func (r *Rotator) rotateGroup(ctx context.Context, groupId string, instanceGroups InstanceGroups) error {
+	if r.strategyFor(groupId) == StrategySurge {
+		return r.surgeGroup(ctx, groupId, instanceGroups)
+	}
+	for _, ig := range instanceGroups {
+		if err := r.awaitRelease(ctx, ig.instanceId()); err != nil {
+			return err
+		}
+		if r.isHalted() {
+			return errHalted
+		}
+		if !r.step(ctx, groupId, InstanceGroups{ig}) {
+			continue
+		}
+		err := r.attempt(ctx, groupId, InstanceGroups{ig}, func() error {
+			return r.rotateGated(ctx, InstanceGroups{ig}, func() error {
+				return r.rotateInstanceFrom(ctx, ig, r.state.nodeName(ig.instanceId()), false)
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drainWithSlot runs drain once fewer than the configured number of nodes are
+// being drained across all ASGs.
+func (r *Rotator) drainWithSlot(ctx context.Context, drain func() error) error {
+	if r.drainSlots == nil {
+		return drain()
+	}
+	select {
+	case r.drainSlots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-r.drainSlots }()
+	return drain()
+}
@@ -0,0 +1,107 @@
+package rotator
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/tenjin/rotate-eks-asg/internal/pkg/rotator/fake"
+)
+
+// addGroup adds an ASG of size instances to the cluster and returns their
+// IDs once their nodes are Ready.
+func (c *testCluster) addGroup(t *testing.T, name string, size int) []string {
+	c.cloud.AddGroup(name, size, []string{"us-east-1a", "us-east-1b"}, nil)
+	c.awaitNodes(t)
+	return c.instancesOf(name)
+}
+
+// launchBarrier makes the first launch of each of groups wait until all of
+// them launched one, or until a second passed. It returns whether none of the
+// launches had to give up waiting.
+func launchBarrier(sim *fake.Simulator, groups ...string) func() bool {
+	var mu sync.Mutex
+	launched := map[string]bool{}
+	gaveUp := false
+	all := make(chan struct{})
+	sim.Faults = func(group string, _ *ec2.Instance) fake.Fault {
+		mu.Lock()
+		if !launched[group] {
+			launched[group] = true
+			if len(launched) == len(groups) {
+				close(all)
+			}
+		}
+		mu.Unlock()
+		select {
+		case <-all:
+		case <-time.After(time.Second):
+			mu.Lock()
+			gaveUp = true
+			mu.Unlock()
+		}
+		return fake.NoFault
+	}
+	return func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return !gaveUp
+	}
+}
+
+func TestRotateGroupsInParallel(t *testing.T) {
+	c := newTestCluster(t, 2)
+	second := c.addGroup(t, "ng-2", 2)
+	overlapped := launchBarrier(c.sim, c.group, "ng-2")
+	r := c.rotator(Options{Parallel: 2})
+
+	if err := r.RotateAll(context.Background(), []string{c.group, "ng-2"}); err != nil {
+		t.Fatal(err)
+	}
+	if !overlapped() {
+		t.Error("ASGs were not rotated at the same time")
+	}
+	if left := append(c.running(c.original...), c.runningIn("ng-2", second...)...); len(left) > 0 {
+		t.Errorf("old instances %v still run", left)
+	}
+}
+
+func TestRotateGroupsHaltsAfterFailure(t *testing.T) {
+	c := newTestCluster(t, 2)
+	second := c.addGroup(t, "ng-2", 6)
+	third := c.addGroup(t, "ng-3", 1)
+	c.sim.ReadyDelay = 100 * time.Millisecond
+	c.sim.Faults = func(group string, _ *ec2.Instance) fake.Fault {
+		if group == c.group {
+			return fake.NeverReady
+		}
+		return fake.NoFault
+	}
+	r := c.rotator(Options{Parallel: 2, Timeouts: Timeouts{Ready: 200 * time.Millisecond}})
+
+	err := r.RotateAll(context.Background(), []string{c.group, "ng-2", "ng-3"})
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) || phaseErr.Phase != PhaseReady {
+		t.Fatalf("rotation failed with %v, want the ready phase error of ASG '%s'", err, c.group)
+	}
+	left := c.runningIn("ng-2", second...)
+	if len(left) == 0 {
+		t.Error("ASG 'ng-2' was rotated completely after ASG 'ng-1' failed")
+	}
+	for _, id := range left {
+		node, err := GetNodeByInstanceID(context.Background(), c.client, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.Spec.Unschedulable {
+			t.Errorf("node '%s' of ASG 'ng-2' was left cordoned", node.Name)
+		}
+	}
+	if c.runningIn("ng-3", third...) == nil {
+		t.Error("ASG 'ng-3' was rotated after ASG 'ng-1' failed")
+	}
+}
@@ -0,0 +1,277 @@
+package rotator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	coreV1 "k8s.io/api/core/v1"
+	policyV1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// PDBPolicy is what to do with nodes whose drain a PodDisruptionBudget would
+// block.
+type PDBPolicy string
+
+const (
+	// PDBRefuse refuses to start the rotation.
+	PDBRefuse PDBPolicy = "refuse"
+	// PDBSkip leaves the blocked nodes out of the rotation.
+	PDBSkip PDBPolicy = "skip"
+	// PDBIgnore only reports the blocked nodes and rotates them anyway.
+	PDBIgnore PDBPolicy = "ignore"
+)
+
+var PDBPolicies = []string{string(PDBRefuse), string(PDBSkip), string(PDBIgnore)}
+
+// disruptionBudget is a PodDisruptionBudget with its selector parsed.
+type disruptionBudget struct {
+	pdb      *policyV1.PodDisruptionBudget
+	selector labels.Selector
+}
+
+// covers tells whether the budget applies to pod.
+func (b *disruptionBudget) covers(pod *coreV1.Pod) bool {
+	return b.pdb.Namespace == pod.Namespace && b.selector.Matches(labels.Set(pod.Labels))
+}
+
+// blockReason tells why the budget would block draining a node that runs
+// count of the pods it covers. It returns an empty string if that many
+// evictions are currently allowed.
+func (b *disruptionBudget) blockReason(count int) string {
+	spec, status := b.pdb.Spec, b.pdb.Status
+	name := b.pdb.Namespace + "/" + b.pdb.Name
+	if spec.MaxUnavailable != nil && (spec.MaxUnavailable.String() == "0" || spec.MaxUnavailable.String() == "0%") {
+		return fmt.Sprintf("PDB '%s' has maxUnavailable %s", name, spec.MaxUnavailable)
+	}
+	if int(status.DisruptionsAllowed) >= count {
+		return ""
+	}
+	if spec.MinAvailable != nil {
+		return fmt.Sprintf("PDB '%s' has minAvailable %s and allows %d disruptions for %d pods on the node (%d of %d pods healthy)",
+			name, spec.MinAvailable, status.DisruptionsAllowed, count, status.CurrentHealthy, status.ExpectedPods)
+	}
+	return fmt.Sprintf("PDB '%s' allows %d disruptions for %d pods on the node (%d of %d pods healthy, %d required)",
+		name, status.DisruptionsAllowed, count, status.CurrentHealthy, status.ExpectedPods, status.DesiredHealthy)
+}
+
+// listDisruptionBudgets lists the PodDisruptionBudgets of all namespaces,
+// through policy/v1beta1 on clusters that don't serve policy/v1 yet.
+func listDisruptionBudgets(ctx context.Context, k8s kubernetes.Interface) ([]*disruptionBudget, error) {
+	var pdbs []policyV1.PodDisruptionBudget
+	list, err := k8s.PolicyV1().PodDisruptionBudgets(coreV1.NamespaceAll).List(ctx, v1.ListOptions{})
+	if err == nil {
+		pdbs = list.Items
+	} else if apierrors.IsNotFound(err) {
+		betaList, err := k8s.PolicyV1beta1().PodDisruptionBudgets(coreV1.NamespaceAll).List(ctx, v1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, beta := range betaList.Items {
+			selector := beta.Spec.Selector
+			if selector != nil && len(selector.MatchLabels) == 0 && len(selector.MatchExpressions) == 0 {
+				// An empty selector matches no pods in policy/v1beta1.
+				selector = nil
+			}
+			pdbs = append(pdbs, policyV1.PodDisruptionBudget{
+				ObjectMeta: beta.ObjectMeta,
+				Spec: policyV1.PodDisruptionBudgetSpec{
+					MinAvailable:   beta.Spec.MinAvailable,
+					MaxUnavailable: beta.Spec.MaxUnavailable,
+					Selector:       selector,
+				},
+				Status: policyV1.PodDisruptionBudgetStatus{
+					DisruptionsAllowed: beta.Status.DisruptionsAllowed,
+					CurrentHealthy:     beta.Status.CurrentHealthy,
+					DesiredHealthy:     beta.Status.DesiredHealthy,
+					ExpectedPods:       beta.Status.ExpectedPods,
+				},
+			})
+		}
+	} else {
+		return nil, err
+	}
+
+	budgets := make([]*disruptionBudget, 0, len(pdbs))
+	for n := range pdbs {
+		pdb := &pdbs[n]
+		selector, err := v1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("PDB '%s/%s' has an invalid selector: %v", pdb.Namespace, pdb.Name, err)
+		}
+		budgets = append(budgets, &disruptionBudget{pdb: pdb, selector: selector})
+	}
+	return budgets, nil
+}
+
+// isEvicted tells whether draining a node evicts pod. Like the drain helper,
+// this leaves out finished pods, DaemonSet pods, mirror pods and pods the
+// selector doesn't match.
+func isEvicted(pod *coreV1.Pod, selector labels.Selector) bool {
+	if !selector.Matches(labels.Set(pod.Labels)) {
+		return false
+	}
+	if pod.Status.Phase == coreV1.PodSucceeded || pod.Status.Phase == coreV1.PodFailed {
+		return false
+	}
+	if _, ok := pod.Annotations[coreV1.MirrorPodAnnotationKey]; ok {
+		return false
+	}
+	if owner := v1.GetControllerOf(pod); owner != nil && owner.Kind == "DaemonSet" {
+		return false
+	}
+	return true
+}
+
+// blockedDrains finds the nodes whose drain a PodDisruptionBudget would block
+// right now, because the node runs more of the budget's pods than it allows
+// to be disrupted. It returns the reasons for each blocked node by name.
+func blockedDrains(
+	ctx context.Context,
+	k8s kubernetes.Interface,
+	nodeNames []string,
+	selector labels.Selector,
+) (map[string][]string, error) {
+	budgets, err := listDisruptionBudgets(ctx, k8s)
+	if err != nil {
+		return nil, fmt.Errorf("listing PodDisruptionBudgets: %v", err)
+	}
+	blocked := map[string][]string{}
+	if len(budgets) == 0 {
+		return blocked, nil
+	}
+	candidates := map[string]bool{}
+	for _, name := range nodeNames {
+		candidates[name] = true
+	}
+	pods, err := k8s.CoreV1().Pods(coreV1.NamespaceAll).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing pods: %v", err)
+	}
+	// covered holds the pods each budget covers on each node.
+	covered := map[string]map[*disruptionBudget][]string{}
+	for n := range pods.Items {
+		pod := &pods.Items[n]
+		if !candidates[pod.Spec.NodeName] || !isEvicted(pod, selector) {
+			continue
+		}
+		for _, budget := range budgets {
+			if !budget.covers(pod) {
+				continue
+			}
+			if covered[pod.Spec.NodeName] == nil {
+				covered[pod.Spec.NodeName] = map[*disruptionBudget][]string{}
+			}
+			covered[pod.Spec.NodeName][budget] = append(covered[pod.Spec.NodeName][budget], pod.Namespace+"/"+pod.Name)
+		}
+	}
+	for nodeName, byBudget := range covered {
+		for _, budget := range budgets {
+			pods := byBudget[budget]
+			if len(pods) == 0 {
+				continue
+			}
+			if reason := budget.blockReason(len(pods)); reason != "" {
+				blocked[nodeName] = append(blocked[nodeName],
+					fmt.Sprintf("pods '%s': %s", strings.Join(pods, "', '"), reason))
+			}
+		}
+	}
+	return blocked, nil
+}
+
+// checkDisruptionBudgets reports the instances whose node can't be drained
+// because of a PodDisruptionBudget and applies the PDB policy to them: it
+// refuses to rotate if any of the first limit instances is blocked, or leaves
+// the blocked ones out. A dry run only reports the refusal. Instances the
+// state file records as drained are not checked again.
+func (r *Rotator) checkDisruptionBudgets(ctx context.Context, instanceGroups InstanceGroups) (InstanceGroups, error) {
+	if r.drain.DisableEviction {
+		logln(ctx, "Pods are deleted instead of evicted, so PodDisruptionBudgets are not checked.")
+		return instanceGroups, nil
+	}
+	nodes, err := getClusterNodes(ctx, r.k8s)
+	if err != nil {
+		return nil, err
+	}
+	nodeNames := map[string]string{}
+	for _, ig := range instanceGroups {
+		if r.state.Instance(ig.instanceId()).Status.reached(StatusDrained) {
+			continue
+		}
+		for _, node := range nodes {
+			if nodeMatchesInstance(node, ig.instanceId(), "") {
+				nodeNames[ig.instanceId()] = node.Name
+				break
+			}
+		}
+	}
+	names := make([]string, 0, len(nodeNames))
+	for _, name := range nodeNames {
+		names = append(names, name)
+	}
+	blocked, err := blockedDrains(ctx, r.k8s, names, r.drain.podSelector())
+	if err != nil {
+		return nil, err
+	}
+
+	var allowed InstanceGroups
+	var refused []string
+	for _, ig := range instanceGroups {
+		nodeName, ok := nodeNames[ig.instanceId()]
+		reasons := blocked[nodeName]
+		if !ok || len(reasons) == 0 {
+			allowed = append(allowed, ig)
+			continue
+		}
+		logf(ctx, "Draining node '%s' (instance '%s') would be blocked: %s.",
+			nodeName, ig.instanceId(), strings.Join(reasons, "; "))
+		r.blocked[ig.instanceId()] = reasons
+		switch r.pdbPolicy {
+		case PDBSkip:
+			logf(ctx, "Skipping instance '%s' of ASG '%s'.", ig.instanceId(), ig.groupId())
+		case PDBIgnore:
+			allowed = append(allowed, ig)
+		default:
+			if r.limit == 0 || len(allowed) < int(r.limit) {
+				refused = append(refused, nodeName)
+			}
+			allowed = append(allowed, ig)
+		}
+	}
+	if len(refused) > 0 {
+		err := fmt.Errorf("PodDisruptionBudgets would block draining nodes '%s'; "+
+			"fix the budgets or rotate with --pdb-policy skip or ignore", strings.Join(refused, "', '"))
+		if !r.dryrun {
+			return nil, err
+		}
+		logf(ctx, "The rotation would not start: %s.", err)
+	}
+	return allowed, nil
+}
+
+// checkPlanBudgets checks the PodDisruptionBudgets of the instances of a plan
+// as checkDisruptionBudgets does, leaving the skipped instances out of both.
+func (r *Rotator) checkPlanBudgets(ctx context.Context, plan *Plan, instanceGroups InstanceGroups) (InstanceGroups, error) {
+	allowed, err := r.checkDisruptionBudgets(ctx, instanceGroups)
+	if err != nil {
+		return nil, err
+	}
+	kept := map[string]bool{}
+	for _, ig := range allowed {
+		kept[ig.instanceId()] = true
+	}
+	instances := plan.Instances[:0]
+	for _, planned := range plan.Instances {
+		if kept[planned.InstanceID] {
+			planned.DrainBlockedBy = r.blocked[planned.InstanceID]
+			instances = append(instances, planned)
+		}
+	}
+	plan.Instances = instances
+	return allowed, nil
+}
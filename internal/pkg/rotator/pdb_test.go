@@ -0,0 +1,204 @@
+package rotator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	policyV1 "k8s.io/api/policy/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// evictingOptions are the options of a rotation that evicts pods, so that
+// PodDisruptionBudgets apply.
+func evictingOptions(policy PDBPolicy) Options {
+	drain := DefaultDrainOptions
+	return Options{PDBPolicy: policy, Drain: &drain}
+}
+
+// addPods adds count pods labelled app=name to the node of an instance.
+func (c *testCluster) addPods(t *testing.T, name, instanceId string, count int) {
+	ctx := context.Background()
+	node, err := GetNodeByInstanceID(ctx, c.client, instanceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < count; n++ {
+		pod := &coreV1.Pod{
+			ObjectMeta: v1.ObjectMeta{
+				Name:      fmt.Sprintf("%s-%s-%d", name, instanceId, n),
+				Namespace: "default",
+				Labels:    map[string]string{"app": name},
+			},
+			Spec: coreV1.PodSpec{NodeName: node.Name},
+		}
+		if _, err := c.client.CoreV1().Pods("default").Create(ctx, pod, v1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// addBudget adds a PodDisruptionBudget with minAvailable 1 for the pods
+// labelled app=name, which currently allows the given number of disruptions.
+func (c *testCluster) addBudget(t *testing.T, name string, allowed int32) {
+	minAvailable := intstr.FromInt(1)
+	pdb := &policyV1.PodDisruptionBudget{
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: policyV1.PodDisruptionBudgetSpec{
+			MinAvailable: &minAvailable,
+			Selector:     &v1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+		},
+		Status: policyV1.PodDisruptionBudgetStatus{DisruptionsAllowed: allowed},
+	}
+	_, err := c.client.PolicyV1().PodDisruptionBudgets("default").Create(context.Background(), pdb, v1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// cordoned returns the names of the cordoned nodes.
+func (c *testCluster) cordoned(t *testing.T) []string {
+	nodes, err := c.client.CoreV1().Nodes().List(context.Background(), v1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, node := range nodes.Items {
+		if node.Spec.Unschedulable {
+			names = append(names, node.Name)
+		}
+	}
+	return names
+}
+
+func TestPDBPolicies(t *testing.T) {
+	for _, tc := range []struct {
+		policy PDBPolicy
+		// rotated are the instances the rotation replaces, by index in
+		// c.original; nil if it refuses to start.
+		rotated []int
+	}{
+		{policy: PDBRefuse},
+		{policy: PDBSkip, rotated: []int{1, 2}},
+		{policy: PDBIgnore, rotated: []int{0, 1, 2}},
+	} {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			c := newTestCluster(t, 3)
+			blocked := c.original[0]
+			c.addPods(t, "db", blocked, 1)
+			c.addBudget(t, "db", 0)
+			r := c.rotator(evictingOptions(tc.policy))
+
+			err := r.Rotate(context.Background(), c.group)
+			if tc.rotated == nil {
+				if err == nil || !strings.Contains(err.Error(), "PodDisruptionBudgets would block") {
+					t.Fatalf("rotation ended with %v, want it refused", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			want := len(c.original) - len(tc.rotated)
+			if left := c.running(c.original...); len(left) != want {
+				t.Errorf("ASG runs old instances %v, want %d of them", left, want)
+			}
+			if tc.policy == PDBSkip && len(c.running(blocked)) == 0 {
+				t.Errorf("blocked instance '%s' was rotated", blocked)
+			}
+			if cordoned := c.cordoned(t); len(cordoned) > 0 {
+				t.Errorf("nodes %v were left cordoned", cordoned)
+			}
+		})
+	}
+}
+
+func TestPDBCountsAllPodsOfTheNode(t *testing.T) {
+	c := newTestCluster(t, 3)
+	// The budget allows one disruption, so only the node running two of its
+	// pods is blocked.
+	c.addPods(t, "web", c.original[0], 2)
+	c.addPods(t, "web", c.original[1], 1)
+	c.addBudget(t, "web", 1)
+	r := c.rotator(evictingOptions(PDBSkip))
+
+	if err := r.Rotate(context.Background(), c.group); err != nil {
+		t.Fatal(err)
+	}
+	if left := c.running(c.original...); len(left) != 1 || left[0] != c.original[0] {
+		t.Errorf("ASG runs old instances %v, want only '%s'", left, c.original[0])
+	}
+}
+
+func TestPDBDryRunReportsBlockedDrains(t *testing.T) {
+	c := newTestCluster(t, 2)
+	c.addPods(t, "db", c.original[0], 1)
+	c.addBudget(t, "db", 0)
+	var out bytes.Buffer
+	opts := evictingOptions(PDBRefuse)
+	opts.DryRun = true
+	opts.PlanFormat = "json"
+	opts.PlanOutput = &out
+
+	if err := c.rotator(opts).Rotate(context.Background(), c.group); err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	var plan Plan
+	if err := json.Unmarshal(out.Bytes(), &plan); err != nil {
+		t.Fatal(err)
+	}
+	for _, planned := range plan.Instances {
+		blocked := len(planned.DrainBlockedBy) > 0
+		if want := planned.InstanceID == c.original[0]; blocked != want {
+			t.Errorf("plan tells instance '%s' blocked %t, want %t", planned.InstanceID, blocked, want)
+		}
+	}
+}
+
+func TestPDBCheckedForPlansAndResumes(t *testing.T) {
+	for _, path := range []string{"plan", "resume", "instance"} {
+		t.Run(path, func(t *testing.T) {
+			c := newTestCluster(t, 2)
+			ctx := context.Background()
+			opts := evictingOptions(PDBRefuse)
+			opts.StateFile = stateFile(t)
+			r := c.rotator(opts)
+			igs, err := DescribeAutoScalingGroup(r.asg, r.ec2, c.group)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plan, err := r.newPlan(ctx, igs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The budget only blocks the drain once the plan was made.
+			c.addPods(t, "db", c.original[0], 1)
+			c.addBudget(t, "db", 0)
+
+			switch path {
+			case "plan":
+				err = r.RotatePlan(ctx, plan)
+			case "resume":
+				if _, err := NewState(r.stateFile, plan); err != nil {
+					t.Fatal(err)
+				}
+				err = r.Resume(ctx)
+			case "instance":
+				for _, ig := range igs {
+					if ig.instanceId() == c.original[0] {
+						err = r.RotateInstance(ctx, ig, false)
+					}
+				}
+			}
+			if err == nil || !strings.Contains(err.Error(), "PodDisruptionBudgets would block") {
+				t.Fatalf("rotation ended with %v, want it refused", err)
+			}
+			if left := c.running(c.original...); len(left) != 2 {
+				t.Errorf("ASG runs old instances %v, want both", left)
+			}
+		})
+	}
+}
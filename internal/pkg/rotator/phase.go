@@ -0,0 +1,148 @@
+package rotator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// Phase is one step of rotating a single instance.
+type Phase string
+
+const (
+	PhaseCordon    Phase = "cordon"
+	PhaseDetach    Phase = "detach"
+	PhaseScaleUp   Phase = "scale-up"
+	PhaseJoin      Phase = "join"
+	PhaseReady     Phase = "ready"
+	PhaseDrain     Phase = "drain"
+	PhaseTerminate Phase = "terminate"
+)
+
+// Timeouts bounds how long each phase of a rotation may take. A zero duration
+// means the phase may take as long as it needs.
+type Timeouts struct {
+	Join      time.Duration
+	Ready     time.Duration
+	Drain     time.Duration
+	Terminate time.Duration
+}
+
+var DefaultTimeouts = Timeouts{
+	Join:      10 * time.Minute,
+	Ready:     10 * time.Minute,
+	Drain:     10 * time.Minute,
+	Terminate: 10 * time.Minute,
+}
+
+func (t Timeouts) forPhase(phase Phase) time.Duration {
+	switch phase {
+	case PhaseJoin:
+		return t.Join
+	case PhaseReady:
+		return t.Ready
+	case PhaseDrain:
+		return t.Drain
+	case PhaseTerminate:
+		return t.Terminate
+	}
+	return 0
+}
+
+// PhaseError reports which phase of which instance's rotation failed.
+type PhaseError struct {
+	Phase      Phase
+	InstanceID string
+	NodeName   string
+	// Replacement is the instance launched in place of InstanceID, if one
+	// was found before the phase failed.
+	Replacement string
+	// Details are what AWS reports about a failed replacement: failed
+	// scaling activities and the replacement's console output.
+	Details []string
+	// RolledBack is set once the failure was rolled back, leaving the old
+	// instance serving in its ASG as before.
+	RolledBack bool
+	Err        error
+}
+
+func (e *PhaseError) Error() string {
+	msg := fmt.Sprintf("instance '%s' (node '%s'): %s phase failed: %s", e.InstanceID, e.NodeName, e.Phase, e.Err)
+	for _, detail := range e.Details {
+		msg += "\n" + detail
+	}
+	return msg
+}
+
+func (e *PhaseError) Unwrap() error { return e.Err }
+
+// runPhase runs fn under the deadline configured for phase and wraps any
+// failure in a PhaseError.
+func (r *Rotator) runPhase(
+	ctx context.Context,
+	phase Phase,
+	instanceGroup *InstanceGroup,
+	nodeName string,
+	fn func(context.Context) error,
+) error {
+	defer r.metrics.startPhase(instanceGroup.groupId(), phase)()
+	timeout := r.timeouts.forPhase(phase)
+	phaseCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		phaseCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	err := fn(phaseCtx)
+	if err == nil {
+		return nil
+	}
+	// The drain helper gives up on its own timeout, which may fire just
+	// before the phase's deadline does.
+	expired := phaseCtx.Err() == context.DeadlineExceeded || timeout > 0 && time.Since(start) >= timeout
+	if expired && ctx.Err() == nil {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	return &PhaseError{
+		Phase:      phase,
+		InstanceID: instanceGroup.instanceId(),
+		NodeName:   nodeName,
+		Err:        err,
+	}
+}
+
+// diagnose records in a failed join or ready phase the replacement launched
+// for it, if any, and what AWS reports about the failure: the ASG's failed
+// scaling activities that are not in known and the replacement's console
+// output.
+func (r *Rotator) diagnose(ctx context.Context, failure error, groupId string, known sets.String, replacement *Replacement) error {
+	var phaseErr *PhaseError
+	if !errors.As(failure, &phaseErr) || phaseErr.Phase != PhaseJoin && phaseErr.Phase != PhaseReady {
+		return failure
+	}
+	// The rotation context may be what failed, so look up with a fresh one.
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+	if known != nil {
+		activities, err := GetFailedScalingActivities(ctx, r.asg, groupId, known)
+		if err != nil {
+			logf(ctx, "Failed to look up the scaling activities of ASG '%s': %s", groupId, err)
+		}
+		phaseErr.Details = append(phaseErr.Details, activities...)
+	}
+	if replacement != nil {
+		phaseErr.Replacement = replacement.InstanceID
+		output, err := GetConsoleOutput(ctx, r.ec2, replacement.InstanceID)
+		if err != nil {
+			logf(ctx, "Failed to get the console output of instance '%s': %s", replacement.InstanceID, err)
+		} else if output != "" {
+			phaseErr.Details = append(phaseErr.Details,
+				fmt.Sprintf("console output of instance '%s':\n%s", replacement.InstanceID, output))
+		}
+	}
+	return failure
+}
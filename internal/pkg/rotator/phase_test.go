@@ -0,0 +1,116 @@
+package rotator
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	coreV1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/tenjin/rotate-eks-asg/internal/pkg/rotator/fake"
+)
+
+func TestReplacementTimeouts(t *testing.T) {
+	for _, tc := range []struct {
+		phase Phase
+		fault fake.Fault
+	}{
+		{phase: PhaseJoin, fault: fake.NeverJoin},
+		{phase: PhaseReady, fault: fake.NeverReady},
+	} {
+		t.Run(string(tc.phase), func(t *testing.T) {
+			c := newTestCluster(t, 2)
+			c.sim.Faults = func(string, *ec2.Instance) fake.Fault { return tc.fault }
+			r := c.rotator(Options{Timeouts: Timeouts{Join: 200 * time.Millisecond, Ready: 200 * time.Millisecond}})
+
+			err := r.Rotate(context.Background(), c.group)
+			var phaseErr *PhaseError
+			if !errors.As(err, &phaseErr) || phaseErr.Phase != tc.phase {
+				t.Fatalf("rotation failed with %v, want a %s phase error", err, tc.phase)
+			}
+			if !strings.Contains(phaseErr.Error(), "timed out after 200ms") {
+				t.Errorf("error '%s' doesn't tell the phase timed out", phaseErr)
+			}
+			if phaseErr.Replacement == "" {
+				t.Error("error doesn't name the replacement")
+			}
+			node, err := GetNodeByInstanceID(context.Background(), c.client, phaseErr.InstanceID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if node.Spec.Unschedulable {
+				t.Errorf("node '%s' is still cordoned", node.Name)
+			}
+		})
+	}
+}
+
+func TestCordonFailureLeavesInstanceAttached(t *testing.T) {
+	c := newTestCluster(t, 2)
+	c.client.PrependReactor("patch", "nodes", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("apiserver unavailable")
+	})
+	logged := captureLog(t)
+	r := c.rotator(Options{StateFile: stateFile(t)})
+
+	err := r.Rotate(context.Background(), c.group)
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) || phaseErr.Phase != PhaseCordon {
+		t.Fatalf("rotation failed with %v, want a cordon phase error", err)
+	}
+	if left := c.running(c.original...); len(left) != 2 {
+		t.Errorf("ASG runs old instances %v, want both", left)
+	}
+	if strings.Contains(logged.String(), "is detached") {
+		t.Errorf("log reports instance '%s' as detached:\n%s", phaseErr.InstanceID, logged)
+	}
+	if got := r.state.Instance(phaseErr.InstanceID).Status; got != StatusPending {
+		t.Errorf("instance '%s' is %s in the state file, want %s", phaseErr.InstanceID, got, StatusPending)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	c := newTestCluster(t, 2)
+	ctx := context.Background()
+	first, err := GetNodeByInstanceID(ctx, c.client, c.original[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := &coreV1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: "stuck", Namespace: "default"},
+		Spec:       coreV1.PodSpec{NodeName: first.Name},
+	}
+	if _, err := c.client.CoreV1().Pods("default").Create(ctx, pod, v1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// The pod never goes away, as if its finalizers were stuck.
+	c.client.PrependReactor("delete", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, nil
+	})
+	r := c.rotator(Options{Timeouts: Timeouts{Drain: 200 * time.Millisecond}})
+
+	err = r.Rotate(ctx, c.group)
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) || phaseErr.Phase != PhaseDrain {
+		t.Fatalf("rotation failed with %v, want a drain phase error", err)
+	}
+	if !strings.Contains(phaseErr.Error(), "timed out after 200ms") {
+		t.Errorf("error '%s' doesn't tell the phase timed out", phaseErr)
+	}
+	node, err := GetNodeByInstanceID(ctx, c.client, phaseErr.InstanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Spec.Unschedulable {
+		t.Errorf("node '%s' that wasn't drained is still cordoned", node.Name)
+	}
+	if len(c.running(phaseErr.InstanceID)) > 0 {
+		t.Errorf("instance '%s' is still attached to its ASG", phaseErr.InstanceID)
+	}
+}
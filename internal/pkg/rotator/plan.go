@@ -0,0 +1,223 @@
+package rotator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	coreV1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// Plan lists the instances a rotation replaces, in the order they are rotated.
+// It can be written out during a dry run, reviewed, and executed as is.
+type Plan struct {
+	Cluster string `json:"cluster,omitempty"`
+	// Endpoint is the API server URL of the cluster.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Strategy is how the instances are replaced.
+	Strategy  Strategy          `json:"strategy,omitempty"`
+	Groups    []PlannedGroup    `json:"groups,omitempty"`
+	Instances []PlannedInstance `json:"instances"`
+}
+
+type PlannedGroup struct {
+	Name                string             `json:"name"`
+	DesiredCapacity     int64              `json:"desiredCapacity"`
+	MinSize             int64              `json:"minSize"`
+	MaxSize             int64              `json:"maxSize"`
+	LaunchTemplate      *LaunchTemplateRef `json:"launchTemplate,omitempty"`
+	LaunchConfiguration string             `json:"launchConfiguration,omitempty"`
+	// Strategy overrides the plan's strategy for this ASG.
+	Strategy Strategy `json:"strategy,omitempty"`
+	// Nodegroup is the EKS managed node group the ASG belongs to.
+	Nodegroup *PlannedNodegroup `json:"nodegroup,omitempty"`
+}
+
+type PlannedInstance struct {
+	// Order is the 1-based position of the instance in the rotation.
+	Order               int                `json:"order,omitempty"`
+	InstanceID          string             `json:"instanceId"`
+	Group               string             `json:"group"`
+	NodeName            string             `json:"nodeName,omitempty"`
+	AvailabilityZone    string             `json:"availabilityZone,omitempty"`
+	LaunchTime          *time.Time         `json:"launchTime,omitempty"`
+	LaunchTemplate      *LaunchTemplateRef `json:"launchTemplate,omitempty"`
+	LaunchConfiguration string             `json:"launchConfiguration,omitempty"`
+	PodCount            int                `json:"podCount"`
+	// Reasons tell why the rotation policies picked the instance.
+	Reasons []string `json:"reasons,omitempty"`
+	// DrainBlockedBy tells which PodDisruptionBudgets would block draining
+	// the instance's node when the plan was made.
+	DrainBlockedBy []string `json:"drainBlockedBy,omitempty"`
+}
+
+type LaunchTemplateRef struct {
+	ID      string `json:"id,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+func newLaunchTemplateRef(spec *autoscaling.LaunchTemplateSpecification) *LaunchTemplateRef {
+	if spec == nil {
+		return nil
+	}
+	return &LaunchTemplateRef{
+		ID:      aws.StringValue(spec.LaunchTemplateId),
+		Name:    aws.StringValue(spec.LaunchTemplateName),
+		Version: aws.StringValue(spec.Version),
+	}
+}
+
+// groupLaunchTemplate returns the launch template an ASG launches new
+// instances from, if it uses one.
+func groupLaunchTemplate(group *autoscaling.Group) *autoscaling.LaunchTemplateSpecification {
+	if group.LaunchTemplate != nil {
+		return group.LaunchTemplate
+	}
+	if p := group.MixedInstancesPolicy; p != nil && p.LaunchTemplate != nil {
+		return p.LaunchTemplate.LaunchTemplateSpecification
+	}
+	return nil
+}
+
+// PlanFormats are the formats a plan can be written in.
+var PlanFormats = []string{"json", "yaml"}
+
+// WritePlan writes plan to w as JSON or YAML.
+func WritePlan(w io.Writer, plan *Plan, format string) error {
+	var data []byte
+	var err error
+	switch format {
+	case "json":
+		data, err = json.MarshalIndent(plan, "", "  ")
+		data = append(data, '\n')
+	case "yaml":
+		data, err = yaml.Marshal(plan)
+	default:
+		return fmt.Errorf("unknown plan format '%s'", format)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// LoadPlan reads a plan written by WritePlan, in either format.
+func LoadPlan(path string) (*Plan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{}
+	if err := yaml.UnmarshalStrict(data, plan); err != nil {
+		return nil, fmt.Errorf("reading plan '%s': %v", path, err)
+	}
+	if len(plan.Instances) == 0 {
+		return nil, fmt.Errorf("plan '%s' lists no instances", path)
+	}
+	return plan, nil
+}
+
+func (r *Rotator) newPlan(ctx context.Context, instanceGroups InstanceGroups) (*Plan, error) {
+	nodes, err := getClusterNodes(ctx, r.k8s)
+	if err != nil {
+		return nil, err
+	}
+	podCounts, err := countPodsByNode(ctx, r.k8s)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{Cluster: r.clusterName, Endpoint: r.endpoint(), Strategy: r.strategy}
+	seenGroups := map[string]bool{}
+	for n, ig := range instanceGroups {
+		group := ig.group
+		if !seenGroups[ig.groupId()] {
+			seenGroups[ig.groupId()] = true
+			plan.Groups = append(plan.Groups, PlannedGroup{
+				Name:                ig.groupId(),
+				DesiredCapacity:     aws.Int64Value(group.DesiredCapacity),
+				MinSize:             aws.Int64Value(group.MinSize),
+				MaxSize:             aws.Int64Value(group.MaxSize),
+				LaunchTemplate:      newLaunchTemplateRef(groupLaunchTemplate(group)),
+				LaunchConfiguration: aws.StringValue(group.LaunchConfigurationName),
+				Strategy:            r.groupStrategies[ig.groupId()],
+				Nodegroup:           newPlannedNodegroup(r.nodegroupOf(ctx, group)),
+			})
+		}
+		planned := PlannedInstance{
+			Order:            n + 1,
+			InstanceID:       ig.instanceId(),
+			Group:            ig.groupId(),
+			AvailabilityZone: ig.zone(),
+			LaunchTime:       ig.instance.LaunchTime,
+			Reasons:          r.reasons[ig.instanceId()],
+			DrainBlockedBy:   r.blocked[ig.instanceId()],
+		}
+		if asgInstance := ig.asgInstance(); asgInstance != nil {
+			planned.LaunchTemplate = newLaunchTemplateRef(asgInstance.LaunchTemplate)
+			planned.LaunchConfiguration = aws.StringValue(asgInstance.LaunchConfigurationName)
+		}
+		for _, node := range nodes {
+			if nodeMatchesInstance(node, planned.InstanceID, "") {
+				planned.NodeName = node.Name
+				planned.PodCount = podCounts[node.Name]
+				break
+			}
+		}
+		plan.Instances = append(plan.Instances, planned)
+	}
+	return plan, nil
+}
+
+// resolvePlan looks up the instances of a plan, failing if any of them can no
+// longer be rotated as planned.
+func (r *Rotator) resolvePlan(ctx context.Context, plan *Plan) (InstanceGroups, error) {
+	if endpoint := r.endpoint(); plan.Endpoint != "" && plan.Endpoint != endpoint {
+		return nil, fmt.Errorf("plan is for the cluster at '%s', not '%s'", plan.Endpoint, endpoint)
+	}
+	instanceGroups := make(InstanceGroups, 0, len(plan.Instances))
+	for _, planned := range plan.Instances {
+		ig, err := DescribeInstanceByID(r.ec2, r.asg, planned.InstanceID, planned.Group)
+		if err != nil {
+			return nil, err
+		}
+		if !ig.attached() {
+			return nil, fmt.Errorf("planned instance '%s' is no longer part of ASG '%s'", planned.InstanceID, planned.Group)
+		}
+		node, err := GetNodeByInstanceID(ctx, r.k8s, planned.InstanceID)
+		if err != nil {
+			return nil, err
+		}
+		if planned.NodeName != "" && node.Name != planned.NodeName {
+			return nil, fmt.Errorf("planned instance '%s' now runs node '%s', not '%s'",
+				planned.InstanceID, node.Name, planned.NodeName)
+		}
+		instanceGroups = append(instanceGroups, ig)
+	}
+	return instanceGroups, nil
+}
+
+// countPodsByNode counts the pods that are not finished on every node.
+func countPodsByNode(ctx context.Context, k8s kubernetes.Interface) (map[string]int, error) {
+	pods, err := k8s.CoreV1().Pods(coreV1.NamespaceAll).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == coreV1.PodSucceeded || pod.Status.Phase == coreV1.PodFailed {
+			continue
+		}
+		counts[pod.Spec.NodeName]++
+	}
+	return counts, nil
+}
@@ -0,0 +1,140 @@
+package rotator
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// writePlan writes the plan of a dry run of the ASG's rotation to a file in
+// format and returns its path.
+func (c *testCluster) writePlan(t *testing.T, opts Options, format string) string {
+	var out bytes.Buffer
+	opts.DryRun = true
+	opts.PlanFormat = format
+	opts.PlanOutput = &out
+	if err := c.rotator(opts).Rotate(context.Background(), c.group); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "plan."+format)
+	if err := ioutil.WriteFile(path, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// detached returns the instances detached from the ASG, in the order they
+// were detached.
+func (c *testCluster) detached(t *testing.T) []string {
+	out, err := c.cloud.AutoScaling().DescribeScalingActivitiesWithContext(context.Background(), &autoscaling.DescribeScalingActivitiesInput{
+		AutoScalingGroupName: aws.String(c.group),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	const prefix = "Detaching EC2 instance: "
+	for n := len(out.Activities) - 1; n >= 0; n-- {
+		if description := aws.StringValue(out.Activities[n].Description); strings.HasPrefix(description, prefix) {
+			ids = append(ids, strings.TrimPrefix(description, prefix))
+		}
+	}
+	return ids
+}
+
+func TestPlanRoundTrip(t *testing.T) {
+	for _, format := range PlanFormats {
+		t.Run(format, func(t *testing.T) {
+			c := newTestCluster(t, 3)
+			path := c.writePlan(t, Options{Limit: 2}, format)
+			written, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			plan, err := LoadPlan(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plan.Instances) != 2 || plan.Instances[0].NodeName == "" || plan.Groups[0].Name != c.group {
+				t.Errorf("loaded plan %+v doesn't list the 2 oldest nodes of ASG '%s'", plan, c.group)
+			}
+			var again bytes.Buffer
+			if err := WritePlan(&again, plan, format); err != nil {
+				t.Fatal(err)
+			}
+			if again.String() != string(written) {
+				t.Errorf("plan written again as\n%s\nwant\n%s", again.String(), written)
+			}
+		})
+	}
+}
+
+func TestLoadPlanRejectsUnknownFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plan.yaml")
+	if err := ioutil.WriteFile(path, []byte("instances:\n- instanceId: i-1\n  group: ng-1\n  nodeNmae: node-1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPlan(path); err == nil {
+		t.Error("plan with a misspelled field was loaded")
+	}
+}
+
+func TestRotatePlanFollowsThePlan(t *testing.T) {
+	c := newTestCluster(t, 3)
+	plan, err := LoadPlan(c.writePlan(t, Options{Limit: 2}, "yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reviewing the plan may reorder it.
+	plan.Instances[0], plan.Instances[1] = plan.Instances[1], plan.Instances[0]
+
+	if err := c.rotator(Options{}).RotatePlan(context.Background(), plan); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{plan.Instances[0].InstanceID, plan.Instances[1].InstanceID}
+	if got := c.detached(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("detached instances %v, want %v", got, want)
+	}
+	if left := c.running(c.original...); len(left) != 1 || left[0] == want[0] || left[0] == want[1] {
+		t.Errorf("ASG runs old instances %v, want only the unplanned one", left)
+	}
+}
+
+func TestRotatePlanRefusesChangedCluster(t *testing.T) {
+	c := newTestCluster(t, 3)
+	ctx := context.Background()
+	plan, err := LoadPlan(c.writePlan(t, Options{}, "json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone := plan.Instances[len(plan.Instances)-1].InstanceID
+	if err := DetachInstance(ctx, c.cloud.AutoScaling(), c.group, gone, true); err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.rotator(Options{}).RotatePlan(ctx, plan)
+	if err == nil || !strings.Contains(err.Error(), gone) {
+		t.Fatalf("rotation of a stale plan ended with %v, want it refused for instance '%s'", err, gone)
+	}
+	if detached := c.detached(t); len(detached) != 1 {
+		t.Errorf("instances %v were detached, want only '%s'", detached, gone)
+	}
+	nodes, err := c.client.CoreV1().Nodes().List(ctx, v1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes.Items {
+		if node.Spec.Unschedulable {
+			t.Errorf("node '%s' was cordoned", node.Name)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package rotator
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/eks"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+// Policies pick the instances to rotate. Without any policy every instance is
+// rotated; otherwise an instance is rotated if any of the policies picks it.
+type Policies struct {
+	// OlderThan picks instances launched longer ago than this.
+	OlderThan time.Duration
+	// LaunchOutdated picks instances not running their ASG's current launch
+	// template version or launch configuration.
+	LaunchOutdated bool
+	// AMIOutdated picks instances running another AMI than the one their
+	// ASG's launch template version or launch configuration launches.
+	AMIOutdated bool
+	// KubeletBehind picks nodes whose kubelet minor version is behind the
+	// version of the cluster's control plane.
+	KubeletBehind bool
+}
+
+const (
+	PolicyOlderThan      = "older-than"
+	PolicyLaunchOutdated = "launch-outdated"
+	PolicyAMIOutdated    = "ami-outdated"
+	PolicyKubeletBehind  = "kubelet-behind"
+)
+
+// ParsePolicies parses policies written as launch-outdated, ami-outdated,
+// kubelet-behind or older-than=<age>, where the age is a duration like 36h or
+// a number of days like 14d.
+func ParsePolicies(specs []string) (Policies, error) {
+	var p Policies
+	for _, spec := range specs {
+		name, arg := spec, ""
+		if i := strings.Index(spec, "="); i >= 0 {
+			name, arg = spec[:i], spec[i+1:]
+		}
+		switch name {
+		case PolicyOlderThan:
+			age, err := parseAge(arg)
+			if err != nil {
+				return p, fmt.Errorf("policy '%s': %v", spec, err)
+			}
+			p.OlderThan = age
+			continue
+		case PolicyLaunchOutdated:
+			p.LaunchOutdated = true
+		case PolicyAMIOutdated:
+			p.AMIOutdated = true
+		case PolicyKubeletBehind:
+			p.KubeletBehind = true
+		default:
+			return p, fmt.Errorf("unknown policy '%s', expected one of %s=<age>, %s, %s or %s",
+				spec, PolicyOlderThan, PolicyLaunchOutdated, PolicyAMIOutdated, PolicyKubeletBehind)
+		}
+		if arg != "" {
+			return p, fmt.Errorf("policy '%s' takes no argument", name)
+		}
+	}
+	return p, nil
+}
+
+// parseAge parses a duration, which may also be given in days, like 14d.
+func parseAge(s string) (time.Duration, error) {
+	var age time.Duration
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid age '%s'", s)
+		}
+		age = time.Duration(days * float64(24*time.Hour))
+	} else {
+		var err error
+		if age, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("invalid age '%s'", s)
+		}
+	}
+	if age <= 0 {
+		return 0, fmt.Errorf("age '%s' must be positive", s)
+	}
+	return age, nil
+}
+
+// formatAge formats an age in days once it is more than a day.
+func formatAge(age time.Duration) string {
+	if age < 48*time.Hour {
+		return age.Round(time.Second).String()
+	}
+	return fmt.Sprintf("%dd", int(age/(24*time.Hour)))
+}
+
+func (p Policies) empty() bool {
+	return p.OlderThan == 0 && !p.LaunchOutdated && !p.AMIOutdated && !p.KubeletBehind
+}
+
+// policyChecker tells why the policies pick instances, looking up what they
+// need once for all instances.
+type policyChecker struct {
+	r         *Rotator
+	now       time.Time
+	templates *launchTemplates
+	// configImages holds the AMI of each launch configuration looked up.
+	configImages map[string]string
+	nodes        []*coreV1.Node
+	controlPlane *version.Version
+}
+
+func (r *Rotator) newPolicyChecker(ctx context.Context) (*policyChecker, error) {
+	c := &policyChecker{
+		r:            r,
+		now:          time.Now(),
+		templates:    newLaunchTemplates(r.ec2),
+		configImages: map[string]string{},
+	}
+	if r.policies.KubeletBehind {
+		var err error
+		if c.nodes, err = getClusterNodes(ctx, r.k8s); err != nil {
+			return nil, err
+		}
+		if c.controlPlane, err = r.controlPlaneVersion(); err != nil {
+			return nil, fmt.Errorf("looking up the control plane version: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// controlPlaneVersion returns the Kubernetes version of the EKS cluster.
+func (r *Rotator) controlPlaneVersion() (*version.Version, error) {
+	var cluster *eks.Cluster
+	var err error
+	if r.clusterName != "" {
+		cluster, err = GetEKSCluserByName(r.eks, r.clusterName)
+	} else {
+		cluster, err = GetEKSCluserByURL(r.eks, r.k8sConfig.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return version.ParseGeneric(aws.StringValue(cluster.Version))
+}
+
+// reasons returns why the policies pick an instance, or nothing if none do.
+func (c *policyChecker) reasons(ctx context.Context, instanceGroup *InstanceGroup) ([]string, error) {
+	var reasons []string
+	policies := c.r.policies
+	if launched := instanceGroup.instance.LaunchTime; policies.OlderThan > 0 && launched != nil {
+		if age := c.now.Sub(*launched); age > policies.OlderThan {
+			reasons = append(reasons, fmt.Sprintf("launched %s ago, more than %s",
+				formatAge(age), formatAge(policies.OlderThan)))
+		}
+	}
+	if policies.LaunchOutdated {
+		reason, err := c.templates.outdated(ctx, instanceGroup)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			reasons = append(reasons, reason)
+		}
+	}
+	if policies.AMIOutdated {
+		reason, err := c.imageOutdated(ctx, instanceGroup)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			reasons = append(reasons, reason)
+		}
+	}
+	if policies.KubeletBehind {
+		if reason := c.kubeletBehind(instanceGroup); reason != "" {
+			reasons = append(reasons, reason)
+		}
+	}
+	return reasons, nil
+}
+
+// imageOutdated tells why an instance runs another AMI than its ASG launches
+// new instances from. It returns an empty string if the AMIs match or the
+// ASG's AMI isn't known up front.
+func (c *policyChecker) imageOutdated(ctx context.Context, instanceGroup *InstanceGroup) (string, error) {
+	group := instanceGroup.group
+	have := aws.StringValue(instanceGroup.instance.ImageId)
+	var want, source string
+	if name := aws.StringValue(group.LaunchConfigurationName); name != "" {
+		image, err := c.configImage(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		want, source = image, fmt.Sprintf("launch configuration '%s'", name)
+	} else if spec := launchTemplateFor(group, aws.StringValue(instanceGroup.instance.InstanceType)); spec != nil {
+		image, err := c.templates.image(ctx, spec)
+		if err != nil {
+			return "", err
+		}
+		template, err := c.templates.lookup(ctx, spec)
+		if err != nil {
+			return "", err
+		}
+		number, err := versionOf(template, aws.StringValue(spec.Version))
+		if err != nil {
+			return "", err
+		}
+		want = image
+		source = fmt.Sprintf("launch template '%s' version %d", aws.StringValue(template.LaunchTemplateName), number)
+	}
+	if want == "" || want == have {
+		return "", nil
+	}
+	return fmt.Sprintf("runs AMI '%s', %s uses '%s'", have, source, want), nil
+}
+
+// configImage returns the AMI of a launch configuration.
+func (c *policyChecker) configImage(ctx context.Context, name string) (string, error) {
+	if image, ok := c.configImages[name]; ok {
+		return image, nil
+	}
+	output, err := c.r.asg.DescribeLaunchConfigurationsWithContext(ctx, &autoscaling.DescribeLaunchConfigurationsInput{
+		LaunchConfigurationNames: []*string{aws.String(name)},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(output.LaunchConfigurations) == 0 {
+		return "", fmt.Errorf("launch configuration '%s' not found", name)
+	}
+	image := aws.StringValue(output.LaunchConfigurations[0].ImageId)
+	c.configImages[name] = image
+	return image, nil
+}
+
+// kubeletBehind tells why an instance's kubelet is behind the control plane.
+// It returns an empty string if it isn't, or if the instance has no node.
+func (c *policyChecker) kubeletBehind(instanceGroup *InstanceGroup) string {
+	for _, node := range c.nodes {
+		if !nodeMatchesInstance(node, instanceGroup.instanceId(), "") {
+			continue
+		}
+		kubelet, err := version.ParseGeneric(node.Status.NodeInfo.KubeletVersion)
+		if err != nil {
+			return ""
+		}
+		if kubelet.Major() < c.controlPlane.Major() ||
+			kubelet.Major() == c.controlPlane.Major() && kubelet.Minor() < c.controlPlane.Minor() {
+			return fmt.Sprintf("kubelet %s is behind the control plane's %s",
+				node.Status.NodeInfo.KubeletVersion, c.controlPlane)
+		}
+		return ""
+	}
+	return ""
+}
+
+// applyPolicies returns the instances the policies pick, in the given order,
+// and remembers why each was picked.
+func (r *Rotator) applyPolicies(ctx context.Context, instanceGroups InstanceGroups) (InstanceGroups, error) {
+	checker, err := r.newPolicyChecker(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var picked InstanceGroups
+	for _, ig := range instanceGroups {
+		reasons, err := checker.reasons(ctx, ig)
+		if err != nil {
+			return nil, fmt.Errorf("checking instance '%s' of ASG '%s': %v", ig.instanceId(), ig.groupId(), err)
+		}
+		if len(reasons) == 0 {
+			logf(ctx, "Skipping instance '%s' of ASG '%s', no policy picks it.", ig.instanceId(), ig.groupId())
+			continue
+		}
+		logf(ctx, "Instance '%s' of ASG '%s' is picked: %s.", ig.instanceId(), ig.groupId(), strings.Join(reasons, "; "))
+		r.reasons[ig.instanceId()] = reasons
+		picked = append(picked, ig)
+	}
+	return picked, nil
+}
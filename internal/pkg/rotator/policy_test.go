@@ -0,0 +1,192 @@
+package rotator
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestParsePolicies(t *testing.T) {
+	for _, tc := range []struct {
+		specs   []string
+		want    Policies
+		wantErr bool
+	}{
+		{specs: []string{"older-than=14d"}, want: Policies{OlderThan: 14 * 24 * time.Hour}},
+		{specs: []string{"older-than=36h", "kubelet-behind"}, want: Policies{OlderThan: 36 * time.Hour, KubeletBehind: true}},
+		{specs: []string{"launch-outdated", "ami-outdated"}, want: Policies{LaunchOutdated: true, AMIOutdated: true}},
+		{specs: []string{"older-than=0d"}, wantErr: true},
+		{specs: []string{"older-than"}, wantErr: true},
+		{specs: []string{"launch-outdated=true"}, wantErr: true},
+		{specs: []string{"outdated"}, wantErr: true},
+	} {
+		t.Run(strings.Join(tc.specs, ","), func(t *testing.T) {
+			got, err := ParsePolicies(tc.specs)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("parsed %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("parsed %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+// picked returns the sorted IDs of the instances of the ASG the rotator's
+// policies pick, and why they are picked.
+func (c *testCluster) picked(t *testing.T, r *Rotator) ([]string, map[string][]string) {
+	igs, err := DescribeAutoScalingGroup(r.asg, r.ec2, c.group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	picked, err := r.applyPolicies(context.Background(), igs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, ig := range picked {
+		ids = append(ids, ig.instanceId())
+	}
+	sort.Strings(ids)
+	return ids, r.reasons
+}
+
+// scaleUp adds an instance to the ASG and returns it once its node is Ready.
+func (c *testCluster) scaleUp(t *testing.T) string {
+	before := sets.NewString(c.instances()...)
+	desired, _ := c.capacity()
+	if err := SetGroupCapacity(context.Background(), c.cloud.AutoScaling(), c.group, desired+1, desired+1); err != nil {
+		t.Fatal(err)
+	}
+	c.awaitNodes(t)
+	for _, id := range c.instances() {
+		if !before.Has(id) {
+			return id
+		}
+	}
+	t.Fatal("ASG launched no instance")
+	return ""
+}
+
+func TestPolicyOlderThan(t *testing.T) {
+	c := newTestCluster(t, 2)
+	c.cloud.SetLaunchTime(c.original[0], time.Now().Add(-15*24*time.Hour))
+	r := c.rotator(Options{Policies: Policies{OlderThan: 14 * 24 * time.Hour}})
+
+	picked, reasons := c.picked(t, r)
+	if want := c.original[:1]; !reflect.DeepEqual(picked, want) {
+		t.Fatalf("policy picked %v, want %v", picked, want)
+	}
+	if got := reasons[c.original[0]]; len(got) != 1 || got[0] != "launched 15d ago, more than 14d" {
+		t.Errorf("instance picked because %v", got)
+	}
+}
+
+func TestPolicyLaunchOutdatedConfiguration(t *testing.T) {
+	c := newTestCluster(t, 0)
+	c.cloud.AddLaunchConfiguration("nodes-1", "ami-1")
+	c.cloud.AddLaunchConfiguration("nodes-2", "ami-1")
+	c.cloud.SetLaunchConfiguration(c.group, "nodes-1")
+	old := c.scaleUp(t)
+	c.cloud.SetLaunchConfiguration(c.group, "nodes-2")
+	current := c.scaleUp(t)
+	r := c.rotator(Options{Policies: Policies{LaunchOutdated: true}})
+
+	picked, reasons := c.picked(t, r)
+	if want := []string{old}; !reflect.DeepEqual(picked, want) {
+		t.Fatalf("policy picked %v, want %v and not '%s'", picked, want, current)
+	}
+	if got := reasons[old]; len(got) != 1 || got[0] != "launched from launch configuration 'nodes-1', ASG uses 'nodes-2'" {
+		t.Errorf("instance picked because %v", got)
+	}
+}
+
+func TestPolicyAMIOutdated(t *testing.T) {
+	t.Run("launch configuration", func(t *testing.T) {
+		c := newTestCluster(t, 0)
+		c.cloud.AddLaunchConfiguration("nodes-1", "ami-1")
+		c.cloud.AddLaunchConfiguration("nodes-2", "ami-1")
+		c.cloud.AddLaunchConfiguration("nodes-3", "ami-2")
+		c.cloud.SetLaunchConfiguration(c.group, "nodes-1")
+		c.scaleUp(t)
+		// The launch configuration changes, but not its AMI.
+		c.cloud.SetLaunchConfiguration(c.group, "nodes-2")
+		r := c.rotator(Options{Policies: Policies{AMIOutdated: true}})
+		if picked, _ := c.picked(t, r); len(picked) > 0 {
+			t.Fatalf("policy picked %v running the ASG's AMI", picked)
+		}
+
+		c.cloud.SetLaunchConfiguration(c.group, "nodes-3")
+		r = c.rotator(Options{Policies: Policies{AMIOutdated: true}})
+		picked, reasons := c.picked(t, r)
+		if len(picked) != 1 {
+			t.Fatalf("policy picked %v, want the instance running 'ami-1'", picked)
+		}
+		if got := reasons[picked[0]]; len(got) != 1 || got[0] != "runs AMI 'ami-1', launch configuration 'nodes-3' uses 'ami-2'" {
+			t.Errorf("instance picked because %v", got)
+		}
+	})
+	t.Run("launch template", func(t *testing.T) {
+		c, template := newTemplateCluster(t, 1, "$Latest")
+		c.cloud.SetLaunchTemplateImage(template, c.cloud.AddLaunchTemplateVersion(template, false), "ami-2")
+		current := c.scaleUp(t)
+		r := c.rotator(Options{Policies: Policies{AMIOutdated: true}})
+
+		picked, reasons := c.picked(t, r)
+		if !reflect.DeepEqual(picked, c.original) {
+			t.Fatalf("policy picked %v, want %v and not '%s'", picked, c.original, current)
+		}
+		want := "runs AMI 'ami-00000000000000000', launch template 'nodes' version 2 uses 'ami-2'"
+		if got := reasons[c.original[0]]; len(got) != 1 || got[0] != want {
+			t.Errorf("instance picked because %v", got)
+		}
+	})
+}
+
+func TestPolicyKubeletBehind(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.cloud.AddCluster("prod", testEndpoint)
+	for n, kubelet := range []string{"v1.20.4-eks-6b7464", "v1.21.2-eks-0389ca3", "v1.22.1"} {
+		c.updateNode(t, c.original[n], func(node *coreV1.Node) {
+			node.Status.NodeInfo.KubeletVersion = kubelet
+		})
+	}
+	r := c.clusterRotator(Options{Policies: Policies{KubeletBehind: true}})
+
+	picked, reasons := c.picked(t, r)
+	if want := c.original[:1]; !reflect.DeepEqual(picked, want) {
+		t.Fatalf("policy picked %v, want %v", picked, want)
+	}
+	if got := reasons[c.original[0]]; len(got) != 1 || got[0] != "kubelet v1.20.4-eks-6b7464 is behind the control plane's 1.21" {
+		t.Errorf("instance picked because %v", got)
+	}
+}
+
+func TestPoliciesPickIfAnyPolicyDoes(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.cloud.AddCluster("prod", testEndpoint)
+	c.cloud.SetLaunchTime(c.original[0], time.Now().Add(-48*time.Hour))
+	c.updateNode(t, c.original[1], func(node *coreV1.Node) {
+		node.Status.NodeInfo.KubeletVersion = "v1.20.4-eks-6b7464"
+	})
+	r := c.clusterRotator(Options{Policies: Policies{OlderThan: 24 * time.Hour, KubeletBehind: true}})
+
+	if err := r.Rotate(context.Background(), c.group); err != nil {
+		t.Fatal(err)
+	}
+	if left := c.running(c.original...); len(left) != 1 || left[0] != c.original[2] {
+		t.Errorf("ASG runs old instances %v, want only '%s'", left, c.original[2])
+	}
+}
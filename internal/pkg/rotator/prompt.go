@@ -0,0 +1,245 @@
+package rotator
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// StepAction is what to do with the next node of a rotation in step mode.
+type StepAction string
+
+const (
+	// StepContinue rotates the node and asks again before the next one.
+	StepContinue StepAction = "continue"
+	// StepSkip leaves the node as it is and moves on to the next one.
+	StepSkip StepAction = "skip"
+	// StepAbort pauses the rotation before the node.
+	StepAbort StepAction = "abort"
+	// StepAll rotates the node and all the following ones without asking.
+	StepAll StepAction = "all"
+)
+
+// stepAnswers map the answers to the step prompt to their action.
+var stepAnswers = map[string]StepAction{
+	"c": StepContinue, "continue": StepContinue,
+	"s": StepSkip, "skip": StepSkip,
+	"a": StepAbort, "abort": StepAbort,
+	"A": StepAll, "all": StepAll,
+}
+
+// prompter asks whoever runs the rotation to confirm its plan before any
+// node is touched and, in step mode, before each node.
+type prompter struct {
+	confirm bool
+	step    bool
+
+	// mu keeps the prompts of ASGs rotated in parallel from interleaving.
+	mu      sync.Mutex
+	in      io.Reader
+	out     io.Writer
+	reading sync.Once
+	answers chan string
+	readErr error
+	// halts is closed once the rotation halts, which cancels the prompt.
+	halts <-chan struct{}
+}
+
+// errPromptHalted is returned by a prompt cancelled because the rotation
+// halted, e.g. when it was stopped.
+var errPromptHalted = errors.New("rotation halted")
+
+func newPrompter(confirm, step bool, in io.Reader, out io.Writer, halts <-chan struct{}) *prompter {
+	if !confirm && !step {
+		return nil
+	}
+	return &prompter{confirm: confirm, step: step, in: in, out: out, answers: make(chan string), halts: halts}
+}
+
+// readAnswers sends each line read from the input to p.answers, until the
+// input fails or ends.
+func (p *prompter) readAnswers() {
+	defer close(p.answers)
+	in := bufio.NewReader(p.in)
+	for {
+		line, err := in.ReadString('\n')
+		if line != "" {
+			p.answers <- strings.TrimSpace(line)
+		}
+		if err != nil {
+			p.readErr = err
+			return
+		}
+	}
+}
+
+// ask writes question and reads a line of answer. Reading doesn't block
+// past the cancellation of ctx or the rotation halting.
+func (p *prompter) ask(ctx context.Context, question string) (string, error) {
+	p.reading.Do(func() { go p.readAnswers() })
+	fmt.Fprint(p.out, question)
+	select {
+	case answer, ok := <-p.answers:
+		if !ok {
+			fmt.Fprintln(p.out)
+			return "", fmt.Errorf("reading the answer: %v", p.readErr)
+		}
+		return answer, nil
+	case <-ctx.Done():
+		fmt.Fprintln(p.out)
+		return "", ctx.Err()
+	case <-p.halts:
+		fmt.Fprintln(p.out)
+		return "", errPromptHalted
+	}
+}
+
+// confirmPlan prints a summary of plan and tells whether the rotation should
+// go ahead with it.
+func (p *prompter) confirmPlan(ctx context.Context, r *Rotator, plan *Plan) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := r.writePlanSummary(p.out, plan); err != nil {
+		return false, err
+	}
+	answer, err := p.ask(ctx, "Rotate these nodes? [y/N] ")
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(answer) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
+
+// nextStep asks what to do with instanceGroups, the next node or batch of
+// nodes of an ASG, until it gets a valid answer.
+func (p *prompter) nextStep(ctx context.Context, groupId string, instanceGroups InstanceGroups) (StepAction, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.step {
+		return StepContinue, nil
+	}
+	ids := make([]string, 0, len(instanceGroups))
+	for _, ig := range instanceGroups {
+		ids = append(ids, ig.instanceId())
+	}
+	for {
+		answer, err := p.ask(ctx, fmt.Sprintf("Next in ASG '%s': %s. [c]ontinue, [s]kip, [a]bort or continue [A]ll? ",
+			groupId, strings.Join(ids, ", ")))
+		if err != nil {
+			return StepAbort, err
+		}
+		if action, ok := stepAnswers[answer]; ok {
+			if action == StepAll {
+				p.step = false
+			}
+			return action, nil
+		}
+		fmt.Fprintf(p.out, "Unknown answer '%s'.\n", answer)
+	}
+}
+
+// writePlanSummary writes a table of the instances in plan, in their order.
+func (r *Rotator) writePlanSummary(w io.Writer, plan *Plan) error {
+	cluster := plan.Cluster
+	if cluster == "" {
+		cluster = r.clusterName
+	}
+	if cluster != "" {
+		fmt.Fprintf(w, "Rotation plan for cluster '%s', %d nodes:\n", cluster, len(plan.Instances))
+	} else {
+		fmt.Fprintf(w, "Rotation plan, %d nodes:\n", len(plan.Instances))
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tINSTANCE\tNODE\tASG\tSTRATEGY\tZONE\tLAUNCHED\tPODS\tREASONS")
+	for n, planned := range plan.Instances {
+		launched := "-"
+		if planned.LaunchTime != nil {
+			launched = planned.LaunchTime.Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			n+1, planned.InstanceID, orDash(planned.NodeName), planned.Group, r.strategyFor(planned.Group),
+			orDash(planned.AvailabilityZone), launched, planned.PodCount, orDash(strings.Join(planned.Reasons, "; ")))
+	}
+	return tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// confirmPlan asks to confirm plan if confirmation is required, and fails if
+// it isn't given.
+func (r *Rotator) confirmPlan(ctx context.Context, plan *Plan) error {
+	if r.prompt == nil || !r.prompt.confirm || r.dryrun {
+		return nil
+	}
+	ok, err := r.prompt.confirmPlan(ctx, r, plan)
+	if r.isHalted() {
+		return r.pausedError()
+	}
+	if err != nil {
+		return fmt.Errorf("no confirmation to rotate: %v", err)
+	}
+	if !ok {
+		return fmt.Errorf("rotation not confirmed, no node was touched")
+	}
+	logln(ctx, "Rotation confirmed.")
+	return nil
+}
+
+// step asks in step mode whether to rotate instanceGroups, the next node or
+// batch of nodes of an ASG, and tells whether to go ahead. Aborting pauses
+// the rotation.
+func (r *Rotator) step(ctx context.Context, groupId string, instanceGroups InstanceGroups) bool {
+	if r.prompt == nil || r.dryrun {
+		return true
+	}
+	action, err := r.prompt.nextStep(ctx, groupId, instanceGroups)
+	// The rotation may have been stopped while waiting for the answer.
+	if r.isHalted() {
+		return false
+	}
+	if err != nil {
+		r.pause(fmt.Sprintf("no answer to the step prompt: %s", err))
+		return false
+	}
+	switch action {
+	case StepSkip:
+		for _, ig := range instanceGroups {
+			logf(ctx, "Skipping instance '%s' of ASG '%s'; it is left as it is.", ig.instanceId(), groupId)
+			r.recordSkipped(ctx, ig)
+		}
+		return false
+	case StepAbort:
+		r.pause(fmt.Sprintf("aborted before instance '%s' of ASG '%s'", instanceGroups[0].instanceId(), groupId))
+		return false
+	case StepAll:
+		logln(ctx, "Continuing without further prompts.")
+	}
+	return true
+}
+
+// recordSkipped marks an instance skipped in the state file, so resuming
+// leaves it alone too. An instance whose rotation had already started keeps
+// its progress, so resuming can finish it.
+func (r *Rotator) recordSkipped(ctx context.Context, instanceGroup *InstanceGroup) {
+	id := instanceGroup.instanceId()
+	if status := r.state.Instance(id).Status; status.reached(StatusCordoned) {
+		logf(ctx, "Instance '%s' stays '%s' in the state file; its rotation had started.", id, status)
+		return
+	}
+	if err := r.state.record(id, StatusSkipped, nil); err != nil {
+		logf(ctx, "Failed to update state file '%s': %s", r.stateFile, err)
+	}
+}
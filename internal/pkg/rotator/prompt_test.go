@@ -0,0 +1,109 @@
+package rotator
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func stepOptions(t *testing.T, answers string) Options {
+	return Options{
+		Step:         true,
+		PromptInput:  strings.NewReader(answers),
+		PromptOutput: ioutil.Discard,
+		StateFile:    stateFile(t),
+	}
+}
+
+func TestStepSkipLeavesNodeAlone(t *testing.T) {
+	c := newTestCluster(t, 3)
+	r := c.rotator(stepOptions(t, "s\nc\nA\n"))
+	igs, err := DescribeAutoScalingGroup(r.asg, r.ec2, c.group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(ByAge{igs})
+	skipped := igs[0].instanceId()
+
+	if err := r.Rotate(context.Background(), c.group); err != nil {
+		t.Fatal(err)
+	}
+	if left := c.running(c.original...); len(left) != 1 || left[0] != skipped {
+		t.Errorf("ASG runs old instances %v, want only the skipped '%s'", left, skipped)
+	}
+	state, err := LoadState(r.stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := state.Instance(skipped).Status; got != StatusSkipped {
+		t.Errorf("skipped instance is %s in the state file, want %s", got, StatusSkipped)
+	}
+	if unfinished := state.Unfinished(); len(unfinished) > 0 {
+		t.Errorf("instances %v are left to resume, want none", unfinished)
+	}
+}
+
+func TestStepAbortPausesRotation(t *testing.T) {
+	c := newTestCluster(t, 3)
+	r := c.rotator(stepOptions(t, "c\na\n"))
+	if err := r.Rotate(context.Background(), c.group); err == nil || !strings.Contains(err.Error(), "aborted") {
+		t.Fatalf("rotation ended with %v, want it paused by the abort", err)
+	}
+	if left := c.running(c.original...); len(left) != 2 {
+		t.Errorf("ASG runs old instances %v, want all but the first", left)
+	}
+	state, err := LoadState(r.stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unfinished := state.Unfinished(); len(unfinished) != 2 {
+		t.Errorf("%d instances are left to resume, want 2", len(unfinished))
+	}
+}
+
+// askedWriter discards what it is written, closing asked on the first write.
+type askedWriter struct {
+	once  sync.Once
+	asked chan struct{}
+}
+
+func (w *askedWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.asked) })
+	return len(p), nil
+}
+
+func TestStopCancelsPrompt(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts Options
+	}{
+		{name: "confirm", opts: Options{Confirm: true}},
+		{name: "step", opts: Options{Step: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCluster(t, 2)
+			// Nobody answers.
+			in, answer := io.Pipe()
+			defer answer.Close()
+			out := &askedWriter{asked: make(chan struct{})}
+			tc.opts.PromptInput, tc.opts.PromptOutput, tc.opts.StateFile = in, out, stateFile(t)
+			r := c.rotator(tc.opts)
+			go func() {
+				<-out.asked
+				r.Stop("stopped by interrupt")
+			}()
+
+			err := r.Rotate(context.Background(), c.group)
+			if err == nil || !strings.HasPrefix(err.Error(), "rotation paused: stopped by interrupt") {
+				t.Fatalf("rotation ended with %v, want it stopped", err)
+			}
+			if left := c.running(c.original...); len(left) != 2 {
+				t.Errorf("ASG runs old instances %v, want all of them", left)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package rotator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// rollbackReport collects the steps of a rollback that were done and the
+// ones that failed and are left to do by hand.
+type rollbackReport struct {
+	done   []string
+	failed []string
+}
+
+// step records the outcome of a rollback step and tells whether it was done.
+func (rr *rollbackReport) step(err error, format string, args ...interface{}) bool {
+	what := fmt.Sprintf(format, args...)
+	if err != nil {
+		rr.failed = append(rr.failed, fmt.Sprintf("%s: %s", what, err))
+		return false
+	}
+	rr.done = append(rr.done, what)
+	return true
+}
+
+func (rr *rollbackReport) log(ctx context.Context, instanceId string) {
+	if len(rr.failed) == 0 {
+		logf(ctx, "Rolled back the rotation of instance '%s':", instanceId)
+	} else {
+		logf(ctx, "Rolled back the rotation of instance '%s' only in part:", instanceId)
+	}
+	for _, what := range rr.done {
+		logf(ctx, "  - done: %s", what)
+	}
+	for _, what := range rr.failed {
+		logf(ctx, "  - FAILED, do it manually: %s", what)
+	}
+}
+
+// rollBack undoes the rotation of a detached instance whose replacement never
+// became Ready. The replacement is terminated, lowering the ASG's desired
+// capacity, so that attaching the old instance again brings the ASG back to
+// its original capacity. If the replacement isn't known, it is looked up in
+// the scaling activities since the ones recorded before detaching; if none
+// is found, the capacity is left alone and the rollback reported for manual
+// cleanup. The old node is uncordoned and the instance's progress reset, so
+// resuming rotates it from the start.
+func (r *Rotator) rollBack(ctx context.Context, phaseErr *PhaseError, instanceGroup *InstanceGroup, node *coreV1.Node) {
+	groupId, instanceId := instanceGroup.groupId(), phaseErr.InstanceID
+	logf(ctx, "Rolling back the rotation of instance '%s'.", instanceId)
+
+	// The rotation context may be what failed, so clean up with a fresh one.
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+	var report rollbackReport
+	if phaseErr.Replacement == "" {
+		replacement, err := r.findReplacement(ctx, instanceGroup, r.state.Instance(instanceId).ActivitiesUntil)
+		if err != nil {
+			report.step(err, "find the instance ASG '%s' launched in place of instance '%s' and terminate it",
+				groupId, instanceId)
+		} else {
+			logf(ctx, "ASG '%s' launched instance '%s' in place of instance '%s'.", groupId, replacement, instanceId)
+			phaseErr.Replacement = replacement
+		}
+	}
+	var lowered bool
+	if phaseErr.Replacement != "" {
+		err := RequestTermination(ctx, r.asg, phaseErr.Replacement, true)
+		lowered = report.step(err, "terminate replacement instance '%s', lowering the desired capacity of ASG '%s'",
+			phaseErr.Replacement, groupId)
+	}
+	attached := false
+	if lowered {
+		err := AttachInstance(ctx, r.asg, groupId, instanceId)
+		attached = report.step(err, "re-attach instance '%s' to ASG '%s'", instanceId, groupId)
+	} else {
+		report.step(errors.New("the ASG's desired capacity was not lowered first"),
+			"re-attach instance '%s' to ASG '%s'", instanceId, groupId)
+	}
+	report.step(UncordonNode(ctx, r.k8s, node), "uncordon node '%s'", node.Name)
+	if attached && r.state != nil {
+		err := r.state.record(instanceId, StatusPending, func(s *InstanceState) {
+			s.ActivitiesUntil = nil
+			s.Replacement = ""
+		})
+		report.step(err, "reset the progress of instance '%s' in '%s'", instanceId, r.stateFile)
+	}
+	report.log(ctx, instanceId)
+	phaseErr.RolledBack = len(report.failed) == 0
+}
+
+// findReplacement returns the instance the ASG launched in place of a
+// detached instance through the scaling activities that started after until,
+// preferring one in the instance's zone. Instances recorded as the
+// replacement of another are not considered.
+func (r *Rotator) findReplacement(ctx context.Context, instanceGroup *InstanceGroup, until *time.Time) (string, error) {
+	groupId := instanceGroup.groupId()
+	if until == nil {
+		return "", errors.New("no scaling activities were recorded before detaching it")
+	}
+	known, err := GetScalingActivityIDsUntil(ctx, r.asg, groupId, *until)
+	if err != nil {
+		return "", err
+	}
+	launches, err := GetLaunchedInstances(ctx, r.asg, groupId, known)
+	if err != nil {
+		return "", err
+	}
+	group, err := getAutoScalingGroup(r.asg, groupId)
+	if err != nil {
+		return "", err
+	}
+	running := sets.NewString()
+	for _, i := range group.Instances {
+		if !strings.HasPrefix(aws.StringValue(i.LifecycleState), "Terminating") {
+			running.Insert(aws.StringValue(i.InstanceId))
+		}
+	}
+	assigned := r.state.replacements()
+	var found *Replacement
+	for _, l := range launches {
+		if !running.Has(l.InstanceID) || assigned.Has(l.InstanceID) {
+			continue
+		}
+		if found == nil || l.AvailabilityZone == instanceGroup.zone() && found.AvailabilityZone != instanceGroup.zone() {
+			found = l
+		}
+	}
+	if found == nil {
+		return "", fmt.Errorf("no running instance was launched after %s", until.Format(time.RFC3339))
+	}
+	return found.InstanceID, nil
+}
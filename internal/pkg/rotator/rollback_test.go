@@ -0,0 +1,136 @@
+package rotator
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/tenjin/rotate-eks-asg/internal/pkg/rotator/fake"
+)
+
+func rollbackOptions(t *testing.T) Options {
+	return Options{
+		Rollback:  true,
+		Timeouts:  Timeouts{Join: 200 * time.Millisecond, Ready: 200 * time.Millisecond},
+		StateFile: stateFile(t),
+	}
+}
+
+func TestRollbackTerminatesReplacementThatNeverGetsReady(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.sim.Faults = func(string, *ec2.Instance) fake.Fault { return fake.NeverReady }
+	r := c.rotator(rollbackOptions(t))
+
+	err := r.Rotate(context.Background(), c.group)
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) || phaseErr.Phase != PhaseReady {
+		t.Fatalf("rotation failed with %v, want a ready phase error", err)
+	}
+	if !phaseErr.RolledBack || phaseErr.Replacement == "" {
+		t.Errorf("rotation rolled back %t with replacement '%s', want rolled back with a replacement",
+			phaseErr.RolledBack, phaseErr.Replacement)
+	}
+	if got := c.instances(); strings.Join(got, ",") != strings.Join(c.original, ",") {
+		t.Errorf("ASG runs %v, want the original %v", got, c.original)
+	}
+	if desired, _ := c.capacity(); desired != 3 {
+		t.Errorf("desired capacity is %d, want 3", desired)
+	}
+	node, err := GetNodeByInstanceID(context.Background(), c.client, phaseErr.InstanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Spec.Unschedulable {
+		t.Errorf("node '%s' is still cordoned", node.Name)
+	}
+	if got := r.state.Instance(phaseErr.InstanceID).Status; got != StatusPending {
+		t.Errorf("instance '%s' is %s in the state file, want %s", phaseErr.InstanceID, got, StatusPending)
+	}
+}
+
+// TestRollbackFindsUnseenReplacement rolls back a rotation that failed before
+// it saw the launch of the replacement.
+func TestRollbackFindsUnseenReplacement(t *testing.T) {
+	c := newTestCluster(t, 3)
+	r := c.rotator(rollbackOptions(t))
+	ctx := context.Background()
+	igs, err := DescribeAutoScalingGroup(r.asg, r.ec2, c.group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := r.newPlan(ctx, igs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.state, err = NewState(r.stateFile, plan); err != nil {
+		t.Fatal(err)
+	}
+	ig := igs[0]
+	node, err := GetNodeByInstanceID(ctx, c.client, ig.instanceId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, until, err := GetScalingActivityIDs(ctx, r.asg, c.group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.state.record(ig.instanceId(), StatusDetached, func(s *InstanceState) { s.ActivitiesUntil = &until })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DetachInstance(ctx, r.asg, c.group, ig.instanceId(), false); err != nil {
+		t.Fatal(err)
+	}
+	// Instance IDs grow with each launch.
+	replacement := c.instances()[len(c.original)-1]
+
+	phaseErr := &PhaseError{Phase: PhaseJoin, InstanceID: ig.instanceId(), NodeName: node.Name, Err: context.DeadlineExceeded}
+	r.rollBack(ctx, phaseErr, ig, node)
+	if !phaseErr.RolledBack {
+		t.Error("rotation was not rolled back")
+	}
+	if phaseErr.Replacement != replacement {
+		t.Errorf("rollback found replacement '%s', want '%s'", phaseErr.Replacement, replacement)
+	}
+	if got := c.instances(); strings.Join(got, ",") != strings.Join(c.original, ",") {
+		t.Errorf("ASG runs %v, want the original %v", got, c.original)
+	}
+	if desired, _ := c.capacity(); desired != 3 {
+		t.Errorf("desired capacity is %d, want 3", desired)
+	}
+}
+
+func TestRollbackLeavesCapacityWithoutReplacement(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.cloud.FailLaunches(c.group, "We currently do not have sufficient m5.large capacity.")
+	r := c.rotator(rollbackOptions(t))
+
+	err := r.Rotate(context.Background(), c.group)
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) || phaseErr.Phase != PhaseJoin {
+		t.Fatalf("rotation failed with %v, want a join phase error", err)
+	}
+	if phaseErr.RolledBack {
+		t.Error("rotation was rolled back without a replacement to terminate")
+	}
+	if desired, _ := c.capacity(); desired != 3 {
+		t.Errorf("desired capacity is %d, want it left at 3", desired)
+	}
+	var left []string
+	for _, id := range c.original {
+		if id != phaseErr.InstanceID {
+			left = append(left, id)
+		}
+	}
+	if got := c.instances(); strings.Join(got, ",") != strings.Join(left, ",") {
+		t.Errorf("ASG runs %v, want %v without the detached instance", got, left)
+	}
+	if state := aws.StringValue(c.cloud.Instance(phaseErr.InstanceID).State.Name); state != ec2.InstanceStateNameRunning {
+		t.Errorf("detached instance '%s' is %s, want it left running", phaseErr.InstanceID, state)
+	}
+}
@@ -2,31 +2,157 @@ package rotator
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"os"
 	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/aws/aws-sdk-go/service/eks"
+	"github.com/aws/aws-sdk-go/service/eks/eksiface"
+	coreV1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/exec"
 	"k8s.io/client-go/rest"
 )
 
+// Options configures a Rotator.
+type Options struct {
+	// DryRun only reports what would be rotated.
+	DryRun bool
+	// Limit rotates at most this many of the oldest nodes; 0 rotates all.
+	Limit uint
+	// Policies pick the instances to rotate; without any, all instances
+	// are rotated.
+	Policies Policies
+	// Order is the order instances are rotated in; it defaults to OrderAge.
+	// Limit still picks the oldest instances.
+	Order Order
+	// ZoneMismatch is what to do when a replacement is launched in another
+	// availability zone; it defaults to ZoneMismatchWarn.
+	ZoneMismatch ZoneMismatch
+	// Strategy is how nodes are replaced; it defaults to StrategyDetach.
+	Strategy Strategy
+	// GroupStrategies overrides Strategy for the ASGs it names.
+	GroupStrategies map[string]Strategy
+	// BatchSizes is how many nodes StrategySurge replaces at once.
+	BatchSizes BatchSizes
+	// Parallel is how many ASGs are rotated at once; each ASG still rotates
+	// one node or batch at a time.
+	Parallel uint
+	// MaxDraining caps how many nodes are drained at once across all ASGs;
+	// 0 means no cap.
+	MaxDraining uint
+	// PDBPolicy is what to do with nodes whose drain a PodDisruptionBudget
+	// would block; it defaults to PDBRefuse.
+	PDBPolicy PDBPolicy
+	// Discovery picks the ASGs RotateForCluster rotates.
+	Discovery GroupSelector
+	// NodeSelector, if set, only rotates the instances whose node it picks.
+	NodeSelector NodeSelector
+	// Drain configures how nodes are drained; it defaults to
+	// DefaultDrainOptions.
+	Drain *DrainOptions
+	// LifecycleHook, if set, names an autoscaling:EC2_INSTANCE_TERMINATING
+	// lifecycle hook of every ASG. Instances are then terminated through
+	// their ASG instead of being detached, and the hook holds them until
+	// their node is drained.
+	LifecycleHook string
+	// FailureBudget is how many failed replacements the rotation tolerates
+	// before it halts; by default it halts at the first.
+	FailureBudget FailureBudget
+	// Rollback, if set, attaches an instance back to its ASG when its
+	// replacement fails to join the cluster or become Ready, terminating the
+	// replacement and restoring the ASG's desired capacity.
+	Rollback bool
+	// Timeouts bounds each phase of an instance's rotation.
+	Timeouts Timeouts
+	// Gates are the health checks awaited between the rotations of nodes.
+	Gates Gates
+	// StateFile, if set, is where the progress of a rotation is recorded so
+	// it can be resumed.
+	StateFile string
+	// PlanFormat, if set, makes a dry run write the rotation plan in this
+	// format ("json" or "yaml") instead of logging each step.
+	PlanFormat string
+	// PlanOutput is where the plan is written; it defaults to stdout.
+	PlanOutput io.Writer
+	// Confirm, if set, prints the plan and asks on PromptOutput to confirm it
+	// before any node is touched.
+	Confirm bool
+	// Step, if set, asks before each node whether to rotate it, skip it,
+	// abort the rotation or rotate the remaining nodes without asking.
+	Step bool
+	// PromptInput is where the answers to prompts are read from; it defaults
+	// to stdin.
+	PromptInput io.Reader
+	// PromptOutput is where prompts are written; it defaults to stderr.
+	PromptOutput io.Writer
+	// ControlFile, if set, holds the rotation while it exists: the nodes
+	// being rotated are finished, and the next one waits until it is removed.
+	ControlFile string
+	// Metrics, if set, records the progress of the rotation.
+	Metrics *Metrics
+}
+
+// cleanupTimeout bounds the API calls made to restore a node after a failure.
+const cleanupTimeout = time.Minute
+
 type Rotator struct {
-	dryrun    bool
-	limit     uint
-	session   *session.Session
-	asg       *autoscaling.AutoScaling
-	ec2       *ec2.EC2
-	eks       *eks.EKS
-	k8sConfig *rest.Config
-	k8s       *kubernetes.Clientset
+	dryrun          bool
+	limit           uint
+	policies        Policies
+	reasons         map[string][]string
+	blocked         map[string][]string
+	order           Order
+	zoneMismatch    ZoneMismatch
+	strategy        Strategy
+	groupStrategies map[string]Strategy
+	batchSizes      BatchSizes
+	parallel        int
+	drainSlots      chan struct{}
+	halted          int32
+	halts           chan struct{}
+	haltOnce        sync.Once
+	held            int32
+	paused          atomic.Value
+	pdbPolicy       PDBPolicy
+	discovery       GroupSelector
+	nodeSelector    NodeSelector
+	drain           DrainOptions
+	lifecycleHook   string
+	heartbeats      map[string]time.Duration
+	rollback        bool
+	breaker         *breaker
+	timeouts        Timeouts
+	gates           Gates
+	stateFile       string
+	state           *State
+	planFormat      string
+	planOutput      io.Writer
+	prompt          *prompter
+	controlFile     string
+	metrics         *Metrics
+	clusterName     string
+	nodegroups      map[string]*eks.Nodegroup
+	asg             autoscalingiface.AutoScalingAPI
+	ec2             ec2iface.EC2API
+	eks             eksiface.EKSAPI
+	k8sConfig       *rest.Config
+	k8s             kubernetes.Interface
 }
 
-func NewRotator(dryrun bool, limit uint, clusterName string) (*Rotator, error) {
+func NewRotator(clusterName string, opts Options) (*Rotator, error) {
 	sess, err := session.NewSession()
 	if err != nil {
 		return nil, err
@@ -50,26 +176,110 @@ func NewRotator(dryrun bool, limit uint, clusterName string) (*Rotator, error) {
 		return nil, err
 	}
 
-	r := &Rotator{
-		dryrun:    dryrun,
-		limit:     limit,
-		session:   sess,
-		asg:       asgClient,
-		ec2:       ec2Client,
-		eks:       eksClient,
-		k8sConfig: k8sConfig,
-		k8s:       k8s,
-	}
+	r := NewRotatorWithClients(opts, asgClient, ec2Client, eksClient, k8sConfig, k8s)
+	r.clusterName = clusterName
 	return r, nil
 }
 
+// NewRotatorWithClients builds a Rotator around already constructed clients,
+// e.g. the in-memory fakes from the fake package.
+func NewRotatorWithClients(
+	opts Options,
+	asgClient autoscalingiface.AutoScalingAPI,
+	ec2Client ec2iface.EC2API,
+	eksClient eksiface.EKSAPI,
+	k8sConfig *rest.Config,
+	k8s kubernetes.Interface,
+) *Rotator {
+	planOutput := opts.PlanOutput
+	if planOutput == nil {
+		planOutput = os.Stdout
+	}
+	promptInput, promptOutput := opts.PromptInput, opts.PromptOutput
+	if promptInput == nil {
+		promptInput = os.Stdin
+	}
+	if promptOutput == nil {
+		promptOutput = os.Stderr
+	}
+	strategy := opts.Strategy
+	if strategy == "" {
+		strategy = StrategyDetach
+	}
+	groupStrategies := map[string]Strategy{}
+	for group, s := range opts.GroupStrategies {
+		groupStrategies[group] = s
+	}
+	pdbPolicy := opts.PDBPolicy
+	if pdbPolicy == "" {
+		pdbPolicy = PDBRefuse
+	}
+	drainOpts := DefaultDrainOptions
+	if opts.Drain != nil {
+		drainOpts = *opts.Drain
+	}
+	var drainSlots chan struct{}
+	if opts.MaxDraining > 0 {
+		drainSlots = make(chan struct{}, opts.MaxDraining)
+	}
+	halts := make(chan struct{})
+	return &Rotator{
+		dryrun:          opts.DryRun,
+		limit:           opts.Limit,
+		policies:        opts.Policies,
+		reasons:         map[string][]string{},
+		blocked:         map[string][]string{},
+		order:           opts.Order,
+		zoneMismatch:    opts.ZoneMismatch,
+		strategy:        strategy,
+		groupStrategies: groupStrategies,
+		batchSizes:      opts.BatchSizes,
+		parallel:        int(opts.Parallel),
+		drainSlots:      drainSlots,
+		halts:           halts,
+		pdbPolicy:       pdbPolicy,
+		discovery:       opts.Discovery,
+		nodeSelector:    opts.NodeSelector,
+		drain:           drainOpts,
+		lifecycleHook:   opts.LifecycleHook,
+		heartbeats:      map[string]time.Duration{},
+		rollback:        opts.Rollback,
+		breaker:         newBreaker(opts.FailureBudget),
+		nodegroups:      map[string]*eks.Nodegroup{},
+		timeouts:        opts.Timeouts,
+		gates:           opts.Gates,
+		stateFile:       opts.StateFile,
+		planFormat:      opts.PlanFormat,
+		planOutput:      planOutput,
+		prompt:          newPrompter(opts.Confirm, opts.Step, promptInput, promptOutput, halts),
+		controlFile:     opts.ControlFile,
+		metrics:         opts.Metrics,
+		asg:             asgClient,
+		ec2:             ec2Client,
+		eks:             eksClient,
+		k8sConfig:       k8sConfig,
+		k8s:             k8s,
+	}
+}
+
 func (r *Rotator) RotateAll(ctx context.Context, groups []string) error {
+	groups, err := r.resolveGroupNames(ctx, groups)
+	if err != nil {
+		return err
+	}
+	var instanceGroups InstanceGroups
 	for _, group := range groups {
-		if err := r.Rotate(ctx, group); err != nil {
+		igs, err := DescribeAutoScalingGroup(r.asg, r.ec2, group)
+		if err != nil {
 			return err
 		}
+		logf(ctx, "Rotating ASG '%s'...\n", group)
+		if nodegroup := r.nodegroups[group]; nodegroup != nil {
+			describeNodegroup(ctx, group, nodegroup)
+		}
+		instanceGroups = append(instanceGroups, igs...)
 	}
-	return nil
+	return r.RotateInstanceGroups(ctx, instanceGroups)
 }
 
 func (r *Rotator) RotateForCluster(ctx context.Context) error {
@@ -78,27 +288,36 @@ func (r *Rotator) RotateForCluster(ctx context.Context) error {
 		return err
 	}
 
-	ownerKey := fmt.Sprintf("k8s.io/cluster/%s", *eksCluster.Name)
+	r.clusterName = *eksCluster.Name
+
+	// The ASGs of managed node groups don't carry the owner tag.
+	nodegroups, err := GetNodegroups(ctx, r.eks, *eksCluster.Name)
+	if err != nil {
+		logf(ctx, "Failed to list managed node groups of cluster '%s', rotating self-managed ASGs only: %s\n",
+			*eksCluster.Name, err)
+	}
+	for _, nodegroup := range nodegroups {
+		r.addNodegroup(nodegroup)
+	}
 
-	groups, err := GetAllAutoScalingGroups(r.asg)
+	names, err := r.findGroups(ctx, *eksCluster.Name)
+	if err != nil {
+		return err
+	}
+	groups, err := GetAutoScalingGroups(r.asg, names)
 	if err != nil {
 		return err
 	}
 	found := false
 	var instanceGroups InstanceGroups
 	for _, group := range groups {
-		for _, tag := range group.Tags {
-			if *tag.Key == ownerKey && *tag.Value == "owned" {
-				log.Printf("ASG '%s' is owned by cluster '%s'.\n", *group.AutoScalingGroupName, *eksCluster.Name)
-				found = true
-				igs, err := GetInstancesForGroup(r.ec2, group)
-				if err != nil {
-					return err
-				}
-				instanceGroups = append(instanceGroups, igs...)
-				break
-			}
+		r.describeSelected(ctx, group, *eksCluster.Name)
+		found = true
+		igs, err := GetInstancesForGroup(r.ec2, group)
+		if err != nil {
+			return err
 		}
+		instanceGroups = append(instanceGroups, igs...)
 	}
 	if !found {
 		return fmt.Errorf("no ASGs found for cluster '%s'", *eksCluster.Name)
@@ -111,27 +330,227 @@ func (r *Rotator) Rotate(ctx context.Context, groupId string) error {
 	if err != nil {
 		return err
 	}
-	log.Printf("Rotating ASG '%s'...\n", groupId)
+	logf(ctx, "Rotating ASG '%s'...\n", groupId)
 	return r.RotateInstanceGroups(ctx, instanceGroups)
 }
 
 func (r *Rotator) RotateInstanceGroups(ctx context.Context, instanceGroups InstanceGroups) error {
 	sort.Sort(ByAge{instanceGroups})
-	if r.limit > 0 {
+	var err error
+	if !r.nodeSelector.empty() {
+		if instanceGroups, err = r.filterNodes(ctx, instanceGroups); err != nil {
+			return err
+		}
+	}
+	if !r.policies.empty() {
+		if instanceGroups, err = r.applyPolicies(ctx, instanceGroups); err != nil {
+			return err
+		}
+	}
+	if instanceGroups, err = r.checkDisruptionBudgets(ctx, instanceGroups); err != nil {
+		return err
+	}
+	if r.limit > 0 && int(r.limit) < len(instanceGroups) {
 		instanceGroups = instanceGroups[:r.limit]
 	}
+	order := "oldest to newest"
+	if r.order == OrderZone {
+		instanceGroups = orderByZone(instanceGroups)
+		order = "taking turns between availability zones"
+	}
 
-	log.Printf("Rotating %d nodes, oldest to newest.", len(instanceGroups))
-	for _, group := range instanceGroups {
-		if err := r.RotateInstance(ctx, group, false); err != nil {
+	plan, err := r.newPlan(ctx, instanceGroups)
+	if err != nil {
+		return err
+	}
+	logf(ctx, "Rotating %d nodes, %s.", len(instanceGroups), order)
+	return r.execute(ctx, plan, instanceGroups)
+}
+
+// RotatePlan rotates exactly the instances of a previously written plan, in
+// the plan's order. It fails before touching any node if the cluster no
+// longer matches the plan.
+func (r *Rotator) RotatePlan(ctx context.Context, plan *Plan) error {
+	instanceGroups, err := r.resolvePlan(ctx, plan)
+	if err != nil {
+		return err
+	}
+	if instanceGroups, err = r.checkPlanBudgets(ctx, plan, instanceGroups); err != nil {
+		return err
+	}
+	if plan.Cluster == "" {
+		plan.Cluster = r.clusterName
+	}
+	r.useStrategies(plan)
+	if plan.Endpoint == "" {
+		plan.Endpoint = r.endpoint()
+	}
+	logf(ctx, "Rotating %d nodes in the order of the plan.", len(instanceGroups))
+	return r.execute(ctx, plan, instanceGroups)
+}
+
+// execute rotates the instances of plan, which are given in the same order
+// as instanceGroups.
+func (r *Rotator) execute(ctx context.Context, plan *Plan, instanceGroups InstanceGroups) error {
+	if r.dryrun && r.planFormat != "" {
+		return WritePlan(r.planOutput, plan, r.planFormat)
+	}
+	if err := r.confirmPlan(ctx, plan); err != nil {
+		return err
+	}
+
+	if r.stateFile != "" && !r.dryrun {
+		var err error
+		if r.state, err = NewState(r.stateFile, plan); err != nil {
 			return err
 		}
+		logf(ctx, "Recording rotation progress in '%s'.", r.stateFile)
 	}
-	return nil
+	return r.rotateInstances(ctx, instanceGroups)
+}
+
+// rotateInstances rotates instances with the configured strategy, picking
+// each up where the state file says it stopped.
+func (r *Rotator) rotateInstances(ctx context.Context, instanceGroups InstanceGroups) error {
+	remaining := make(InstanceGroups, 0, len(instanceGroups))
+	for _, ig := range instanceGroups {
+		// A drain-first rotation terminates an instance before awaiting its
+		// replacement.
+		if !ig.terminated() || r.state.Instance(ig.instanceId()).Status == StatusRemoved {
+			remaining = append(remaining, ig)
+			continue
+		}
+		logf(ctx, "Instance '%s' was already terminated.", ig.instanceId())
+		if err := r.state.record(ig.instanceId(), StatusTerminated, nil); err != nil {
+			return err
+		}
+	}
+	if err := r.checkLifecycleHooks(ctx, remaining); err != nil {
+		return err
+	}
+	if !r.dryrun {
+		r.metrics.plan(remaining)
+	}
+	var err error
+	if r.parallel > 1 {
+		err = r.rotateGroups(ctx, remaining)
+	} else {
+		err = r.rotateInOrder(ctx, remaining)
+	}
+	r.breaker.report(ctx, remaining)
+	r.recordNotAttempted(ctx, remaining)
+	if err == nil {
+		err = r.breaker.err(r.state != nil)
+	}
+	return err
+}
+
+// rotateInOrder rotates instances one at a time in order, except that surge
+// rotates all of an ASG's instances when it gets to the first one.
+func (r *Rotator) rotateInOrder(ctx context.Context, remaining InstanceGroups) error {
+	_, byGroup := remaining.byGroup()
+	surged := map[string]bool{}
+	for _, ig := range remaining {
+		if r.isHalted() {
+			return r.pausedError()
+		}
+		groupId := ig.groupId()
+		if r.strategyFor(groupId) != StrategySurge {
+			if err := r.awaitRelease(ctx, ig.instanceId()); err != nil {
+				return err
+			}
+			if r.isHalted() {
+				return r.pausedError()
+			}
+			if !r.step(ctx, groupId, InstanceGroups{ig}) {
+				continue
+			}
+			err := r.attempt(ctx, groupId, InstanceGroups{ig}, func() error {
+				return r.rotateGated(ctx, InstanceGroups{ig}, func() error {
+					return r.rotateInstanceFrom(ctx, ig, r.state.nodeName(ig.instanceId()), false)
+				})
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !surged[groupId] {
+			surged[groupId] = true
+			err := r.surgeGroup(ctx, groupId, byGroup[groupId])
+			if err == errHalted {
+				return r.pausedError()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return r.pausedError()
+}
+
+// useStrategies makes the rotation use the strategies plan records, after
+// recording the configured ones in a plan that has none.
+func (r *Rotator) useStrategies(plan *Plan) {
+	if plan.Strategy == "" {
+		plan.Strategy = r.strategy
+		for n := range plan.Groups {
+			plan.Groups[n].Strategy = r.groupStrategies[plan.Groups[n].Name]
+		}
+	}
+	r.strategy = plan.Strategy
+	r.groupStrategies = map[string]Strategy{}
+	for _, group := range plan.Groups {
+		if group.Strategy != "" {
+			r.groupStrategies[group.Name] = group.Strategy
+		}
+	}
+}
+
+// Resume continues the rotation recorded in the state file, picking up each
+// unfinished instance at the step where it stopped.
+func (r *Rotator) Resume(ctx context.Context) error {
+	state, err := LoadState(r.stateFile)
+	if err != nil {
+		return err
+	}
+	if endpoint := r.endpoint(); state.Plan.Endpoint != endpoint {
+		return fmt.Errorf("state file '%s' belongs to the cluster at '%s', not '%s'", r.stateFile, state.Plan.Endpoint, endpoint)
+	}
+	unfinished := state.Unfinished()
+	logf(ctx, "Resuming rotation from '%s': %d of %d nodes left.",
+		r.stateFile, len(unfinished), len(state.Plan.Instances))
+	instanceGroups := make(InstanceGroups, 0, len(unfinished))
+	for _, planned := range unfinished {
+		instanceGroup, err := DescribeInstanceByID(r.ec2, r.asg, planned.InstanceID, planned.Group)
+		if err != nil {
+			return err
+		}
+		instanceGroups = append(instanceGroups, instanceGroup)
+	}
+	r.state = state
+	left := state.Plan
+	left.Instances = unfinished
+	if instanceGroups, err = r.checkPlanBudgets(ctx, &left, instanceGroups); err != nil {
+		return err
+	}
+	if r.dryrun {
+		for _, planned := range left.Instances {
+			logf(ctx, "Would resume instance '%s' (node '%s') after step '%s'.",
+				planned.InstanceID, planned.NodeName, state.Instance(planned.InstanceID).Status)
+		}
+		logln(ctx, "DRY RUN is enabled. Skipping rotate.")
+		return nil
+	}
+	r.useStrategies(&state.Plan)
+	if err := r.confirmPlan(ctx, &left); err != nil {
+		return err
+	}
+	return r.rotateInstances(ctx, instanceGroups)
 }
 
 func (r *Rotator) RotateByInternalDNS(ctx context.Context, instanceInternalIP string, removeNode bool) error {
-	instanceGroup, err := DescribeInstanceByInternalDNS(r.ec2, r.asg, instanceInternalIP)
+	instanceGroup, err := DescribeInstanceByInternalDNS(ctx, r.ec2, r.asg, instanceInternalIP)
 	if err != nil {
 		return err
 	}
@@ -142,44 +561,290 @@ func (r *Rotator) RotateInstance(
 	ctx context.Context,
 	instanceGroup *InstanceGroup,
 	removeNode bool,
+) error {
+	if err := r.checkLifecycleHooks(ctx, InstanceGroups{instanceGroup}); err != nil {
+		return err
+	}
+	allowed, err := r.checkDisruptionBudgets(ctx, InstanceGroups{instanceGroup})
+	if err != nil {
+		return err
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+	// The rotation may have been stopped while it was being checked.
+	if r.isHalted() {
+		return r.pausedError()
+	}
+	return r.rotateInstanceFrom(ctx, instanceGroup, "", removeNode)
+}
+
+// rotateInstanceFrom rotates an instance, skipping the steps the state file
+// records as done. nodeName is used when the instance's node can no longer be
+// found, which is expected once it has been drained.
+func (r *Rotator) rotateInstanceFrom(
+	ctx context.Context,
+	instanceGroup *InstanceGroup,
+	nodeName string,
+	removeNode bool,
 ) error {
 	instanceId := instanceGroup.instanceId()
-	groupId := instanceGroup.groupId()
+	progress := r.state.Instance(instanceId)
 
-	node, err := GetNodeByInstanceID(ctx, r.k8s, instanceId)
+	node, err := r.nodeForInstance(ctx, instanceGroup, nodeName, progress)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Rotating node '%s' (instance '%s').\n", node.Name, instanceId)
+	if !progress.Status.reached(StatusCordoned) {
+		logf(ctx, "Rotating node '%s' (instance '%s').\n", node.Name, instanceId)
+	} else {
+		logf(ctx, "Resuming rotation of node '%s' (instance '%s') after step '%s'.\n", node.Name, instanceId, progress.Status)
+	}
 
 	if r.dryrun {
-		log.Println("DRY RUN is enabled. Skipping rotate.")
+		logln(ctx, "DRY RUN is enabled. Skipping rotate.")
 		return nil
 	}
 
-	if err := CordonNode(ctx, r.k8s, node); err != nil {
+	if removeNode || r.strategyFor(instanceGroup.groupId()) == StrategyDrainFirst {
+		if err := r.rotateNodeDrainFirst(ctx, instanceGroup, node, progress, removeNode); err != nil {
+			r.recoverDrainFirst(ctx, err, instanceGroup, node)
+			return err
+		}
+		return nil
+	}
+	if err := r.rotateNode(ctx, instanceGroup, node, progress); err != nil {
+		r.recoverFromFailure(ctx, err, instanceGroup, node)
 		return err
 	}
-	nodeSet, err := GetClusterNodeSet(ctx, r.k8s)
+	return nil
+}
+
+// nodeForInstance returns the node of an instance. nodeName is used when the
+// node can no longer be found, which is expected once it has been drained.
+func (r *Rotator) nodeForInstance(
+	ctx context.Context,
+	instanceGroup *InstanceGroup,
+	nodeName string,
+	progress InstanceState,
+) (*coreV1.Node, error) {
+	node, err := GetNodeByInstanceID(ctx, r.k8s, instanceGroup.instanceId())
 	if err != nil {
-		return err
+		if !progress.Status.reached(StatusDrained) || nodeName == "" {
+			return nil, err
+		}
+		node = &coreV1.Node{ObjectMeta: v1.ObjectMeta{Name: nodeName}}
 	}
-	if err := DetachInstance(r.asg, groupId, instanceId, removeNode); err != nil {
-		return err
+	return node, nil
+}
+
+// checkpoint records in the state file that an instance reached status.
+func (r *Rotator) checkpoint(
+	instanceGroup *InstanceGroup,
+	node *coreV1.Node,
+	phase Phase,
+	status InstanceStatus,
+	update func(*InstanceState),
+) error {
+	if err := r.state.record(instanceGroup.instanceId(), status, update); err != nil {
+		return &PhaseError{Phase: phase, InstanceID: instanceGroup.instanceId(), NodeName: node.Name, Err: err}
+	}
+	if status == StatusTerminated {
+		r.metrics.nodeRotated(instanceGroup.groupId())
+	}
+	return nil
+}
+
+// rotateNode runs the steps of an instance's rotation that progress doesn't
+// record as done, checkpointing each completed step in the state file.
+func (r *Rotator) rotateNode(
+	ctx context.Context,
+	instanceGroup *InstanceGroup,
+	node *coreV1.Node,
+	progress InstanceState,
+) error {
+	instanceId := instanceGroup.instanceId()
+	groupId := instanceGroup.groupId()
+	status := progress.Status
+
+	if status == StatusCordoned && !instanceGroup.attached() {
+		logf(ctx, "Instance '%s' was already detached from ASG '%s'.", instanceId, groupId)
+		status = StatusDetached
+	}
+	if status == StatusCordoned && r.lifecycleHook != "" && instanceGroup.terminating() {
+		logf(ctx, "Instance '%s' is already terminating.", instanceId)
+		status = StatusDetached
+	}
+	checkpoint := func(phase Phase, status InstanceStatus, update func(*InstanceState)) error {
+		return r.checkpoint(instanceGroup, node, phase, status, update)
 	}
 
-	if !removeNode {
-		if err := AwaitNewNodeReady(ctx, r.k8s, nodeSet); err != nil {
+	if !status.reached(StatusDrained) {
+		// A node is uncordoned when its rotation fails, so cordon it again
+		// when resuming.
+		err := r.runPhase(ctx, PhaseCordon, instanceGroup, node.Name, func(ctx context.Context) error {
+			return CordonNode(ctx, r.k8s, node)
+		})
+		if err != nil {
 			return err
 		}
+		if !status.reached(StatusCordoned) {
+			if err := checkpoint(PhaseCordon, StatusCordoned, nil); err != nil {
+				return err
+			}
+		}
 	}
 
-	if err := DrainNode(ctx, r.k8s, node); err != nil {
-		return err
+	var activities sets.String
+	if !status.reached(StatusDetached) {
+		var activitiesUntil time.Time
+		err := r.runPhase(ctx, PhaseDetach, instanceGroup, node.Name, func(ctx context.Context) error {
+			var err error
+			activities, activitiesUntil, err = GetScalingActivityIDs(ctx, r.asg, groupId)
+			if err != nil {
+				return err
+			}
+			if r.lifecycleHook != "" {
+				return r.holdForTermination(ctx, groupId, instanceId, false)
+			}
+			return DetachInstance(ctx, r.asg, groupId, instanceId, false)
+		})
+		if err != nil {
+			return err
+		}
+		err = checkpoint(PhaseDetach, StatusDetached, func(s *InstanceState) { s.ActivitiesUntil = &activitiesUntil })
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.lifecycleHook != "" {
+		stop := r.keepLifecycleActionAlive(ctx, groupId, instanceId)
+		defer stop()
+	}
+
+	if !status.reached(StatusReplacementReady) {
+		var replacement *Replacement
+		var newNode *coreV1.Node
+		err := r.runPhase(ctx, PhaseJoin, instanceGroup, node.Name, func(ctx context.Context) error {
+			var err error
+			if activities == nil {
+				// Resuming, so tell the replacement apart by time: either from
+				// the activities recorded before detaching or, if the detach
+				// was never recorded, from when the node was cordoned.
+				until := progress.UpdatedAt
+				if progress.ActivitiesUntil != nil {
+					until = *progress.ActivitiesUntil
+				}
+				activities, err = GetScalingActivityIDsUntil(ctx, r.asg, groupId, until)
+				if err != nil {
+					return err
+				}
+			}
+			replacement, err = AwaitReplacementInstance(ctx, r.asg, groupId, instanceGroup.zone(), activities)
+			if err != nil {
+				return err
+			}
+			r.checkReplacementZone(ctx, instanceGroup, replacement)
+			newNode, err = awaitReplacementJoin(ctx, r.k8s, replacement)
+			return err
+		})
+		if err != nil {
+			return r.diagnose(ctx, err, groupId, activities, replacement)
+		}
+		err = r.runPhase(ctx, PhaseReady, instanceGroup, node.Name, func(ctx context.Context) error {
+			return awaitNodeReadiness(ctx, r.k8s, newNode)
+		})
+		if err != nil {
+			return r.diagnose(ctx, err, groupId, activities, replacement)
+		}
+		err = checkpoint(PhaseReady, StatusReplacementReady, func(s *InstanceState) { s.Replacement = replacement.InstanceID })
+		if err != nil {
+			return err
+		}
 	}
-	if err := TerminateInstanceByID(r.ec2, instanceId); err != nil {
+
+	if !status.reached(StatusDrained) {
+		err := r.drainWithSlot(ctx, func() error {
+			return r.runPhase(ctx, PhaseDrain, instanceGroup, node.Name, func(ctx context.Context) error {
+				return DrainNode(ctx, r.k8s, node, r.drain, r.timeouts.Drain, r.podEvicted(groupId))
+			})
+		})
+		if err != nil {
+			return err
+		}
+		if err := checkpoint(PhaseDrain, StatusDrained, nil); err != nil {
+			return err
+		}
+	}
+
+	err := r.runPhase(ctx, PhaseTerminate, instanceGroup, node.Name, func(ctx context.Context) error {
+		if r.lifecycleHook != "" {
+			return r.releaseInstance(ctx, groupId, instanceId)
+		}
+		return TerminateInstanceByID(ctx, r.ec2, instanceId)
+	})
+	if err != nil {
 		return err
 	}
-	return nil
+	return checkpoint(PhaseTerminate, StatusTerminated, nil)
+}
+
+func (r *Rotator) endpoint() string {
+	if r.k8sConfig == nil {
+		return ""
+	}
+	return r.k8sConfig.Host
+}
+
+// recoverFromFailure leaves the cluster in a safe state after a failed
+// rotation: unless the old node was already drained, it is uncordoned so it
+// keeps serving workloads. Instances that were already detached from their
+// ASG are left running and reported for manual cleanup, unless the rotation
+// is rolled back because the replacement never became Ready.
+func (r *Rotator) recoverFromFailure(ctx context.Context, err error, instanceGroup *InstanceGroup, node *coreV1.Node) {
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) {
+		return
+	}
+	logf(ctx, "Rotation of instance '%s' failed during the %s phase.", phaseErr.InstanceID, phaseErr.Phase)
+	if phaseErr.Phase == PhaseTerminate {
+		logf(ctx, "Node '%s' was drained and remains cordoned; instance '%s' must be terminated manually.",
+			node.Name, phaseErr.InstanceID)
+		return
+	}
+
+	if r.lifecycleHook != "" && phaseErr.Phase != PhaseCordon && phaseErr.Phase != PhaseDetach {
+		// The ASG can't be stopped from terminating the instance, so keep new
+		// pods off its node.
+		logf(ctx, "Node '%s' remains cordoned: lifecycle hook '%s' holds instance '%s', which terminates when the hook times out.",
+			node.Name, r.lifecycleHook, phaseErr.InstanceID)
+		if r.state != nil {
+			logf(ctx, "Progress was saved to '%s'; run again with --resume before then to drain the node first.", r.stateFile)
+		}
+		return
+	}
+
+	if r.rollback && (phaseErr.Phase == PhaseJoin || phaseErr.Phase == PhaseReady) {
+		r.rollBack(ctx, phaseErr, instanceGroup, node)
+		if r.state != nil {
+			logf(ctx, "Progress was saved to '%s'; run again with --resume to retry the rotation.", r.stateFile)
+		}
+		return
+	}
+
+	// The rotation context may be what failed, so clean up with a fresh one.
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+	if err := UncordonNode(ctx, r.k8s, node); err != nil {
+		logf(ctx, "Failed to uncordon node '%s', uncordon it manually: %s", node.Name, err)
+	}
+	if phaseErr.Phase != PhaseCordon && phaseErr.Phase != PhaseDetach {
+		logf(ctx, "Instance '%s' is detached from ASG '%s' but still running; re-attach or terminate it manually.",
+			phaseErr.InstanceID, instanceGroup.groupId())
+	}
+	if r.state != nil {
+		logf(ctx, "Progress was saved to '%s'; run again with --resume to finish the rotation.", r.stateFile)
+	}
 }
@@ -0,0 +1,201 @@
+package rotator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	coreV1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/tenjin/rotate-eks-asg/internal/pkg/rotator/fake"
+)
+
+func TestMain(m *testing.M) {
+	ScalingActivityPollInterval = 10 * time.Millisecond
+	LifecycleStatePollInterval = 10 * time.Millisecond
+	NodeJoinPollInterval = 10 * time.Millisecond
+	NodeReadinessPollInterval = 10 * time.Millisecond
+	GatePollInterval = 10 * time.Millisecond
+	HoldPollInterval = 10 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+// testCluster is a fake AWS account running one ASG, whose instances are
+// the nodes of a simulated cluster.
+type testCluster struct {
+	cloud  *fake.Cloud
+	sim    *fake.Simulator
+	client *k8sfake.Clientset
+	group  string
+	// original are the IDs of the instances the ASG started with.
+	original []string
+}
+
+func newTestCluster(t *testing.T, size int) *testCluster {
+	c := &testCluster{cloud: fake.NewCloud(), client: k8sfake.NewSimpleClientset(), group: "ng-1"}
+	c.cloud.AddGroup(c.group, size, []string{"us-east-1a", "us-east-1b"}, nil)
+	var err error
+	if c.sim, err = fake.NewSimulator(c.cloud, c.client); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.sim.Close)
+	c.original = c.instances()
+	return c
+}
+
+// rotator returns a rotator of the cluster. Unless opts say otherwise, drains
+// delete pods, so PodDisruptionBudgets don't apply.
+func (c *testCluster) rotator(opts Options) *Rotator {
+	if opts.Drain == nil {
+		drain := DefaultDrainOptions
+		drain.DisableEviction = true
+		opts.Drain = &drain
+	}
+	return NewRotatorWithClients(opts, c.cloud.AutoScaling(), c.cloud.EC2(), c.cloud.EKS(), nil, c.client)
+}
+
+// instances returns the sorted IDs of the instances the ASG runs.
+func (c *testCluster) instances() []string {
+	return c.instancesOf(c.group)
+}
+
+// instancesOf returns the sorted IDs of the instances the named ASG runs.
+func (c *testCluster) instancesOf(group string) []string {
+	var ids []string
+	for _, i := range c.cloud.Group(group).Instances {
+		ids = append(ids, aws.StringValue(i.InstanceId))
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// awaitNodes waits until the node of every running instance is Ready.
+func (c *testCluster) awaitNodes(t *testing.T) {
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		for _, i := range c.cloud.RunningInstances() {
+			node, err := GetNodeByInstanceID(context.Background(), c.client, aws.StringValue(i.InstanceId))
+			if err != nil || !isNodeReady(node) {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("nodes didn't get Ready: %v", err)
+	}
+}
+
+// capacity returns the desired capacity and max size of the ASG.
+func (c *testCluster) capacity() (int64, int64) {
+	group := c.cloud.Group(c.group)
+	return aws.Int64Value(group.DesiredCapacity), aws.Int64Value(group.MaxSize)
+}
+
+// launches counts the instances the ASG launched, the original ones
+// included.
+func (c *testCluster) launches(t *testing.T) int {
+	out, err := c.cloud.AutoScaling().DescribeScalingActivitiesWithContext(context.Background(), &autoscaling.DescribeScalingActivitiesInput{
+		AutoScalingGroupName: aws.String(c.group),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(launchedBy(out.Activities, nil))
+}
+
+// running tells which of ids the ASG still runs.
+func (c *testCluster) running(ids ...string) []string {
+	return c.runningIn(c.group, ids...)
+}
+
+// runningIn tells which of ids the named ASG still runs.
+func (c *testCluster) runningIn(group string, ids ...string) []string {
+	in := map[string]bool{}
+	for _, id := range c.instancesOf(group) {
+		in[id] = true
+	}
+	var running []string
+	for _, id := range ids {
+		if in[id] {
+			running = append(running, id)
+		}
+	}
+	return running
+}
+
+func stateFile(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "state.json")
+}
+
+// captureLog returns what is logged until the test ends.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	out := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(out) })
+	return &buf
+}
+
+func TestRotateReplacesEachNode(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.sim.JoinDelay = 20 * time.Millisecond
+	c.sim.ReadyDelay = 20 * time.Millisecond
+	ctx := context.Background()
+	for n, id := range c.original {
+		node, err := GetNodeByInstanceID(ctx, c.client, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pod := &coreV1.Pod{
+			ObjectMeta: v1.ObjectMeta{Name: fmt.Sprintf("web-%d", n), Namespace: "default"},
+			Spec:       coreV1.PodSpec{NodeName: node.Name},
+		}
+		if _, err := c.client.CoreV1().Pods("default").Create(ctx, pod, v1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := c.rotator(Options{StateFile: stateFile(t)})
+
+	if err := r.Rotate(ctx, c.group); err != nil {
+		t.Fatal(err)
+	}
+	if left := c.running(c.original...); len(left) > 0 {
+		t.Errorf("old instances %v still run", left)
+	}
+	if desired, _ := c.capacity(); desired != 3 {
+		t.Errorf("desired capacity is %d, want 3", desired)
+	}
+	nodes, err := c.client.CoreV1().Nodes().List(ctx, v1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes.Items) != 3 {
+		t.Errorf("cluster has %d nodes, want 3", len(nodes.Items))
+	}
+	for _, node := range nodes.Items {
+		if !isNodeReady(&node) || node.Spec.Unschedulable {
+			t.Errorf("node '%s' is not Ready and schedulable", node.Name)
+		}
+	}
+	pods, err := c.client.CoreV1().Pods("default").List(ctx, v1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) > 0 {
+		t.Errorf("%d pods were not drained", len(pods.Items))
+	}
+	if unfinished := r.state.Unfinished(); len(unfinished) > 0 {
+		t.Errorf("instances %v are not finished in the state file", unfinished)
+	}
+}
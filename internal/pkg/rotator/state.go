@@ -0,0 +1,255 @@
+package rotator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// InstanceStatus is the last step of an instance's rotation that completed.
+type InstanceStatus string
+
+const (
+	StatusPending          InstanceStatus = "pending"
+	StatusCordoned         InstanceStatus = "cordoned"
+	StatusDetached         InstanceStatus = "detached"
+	StatusReplacementReady InstanceStatus = "replacement-ready"
+	StatusDrained          InstanceStatus = "drained"
+	// StatusRemoved is a drain-first rotation's instance that was terminated
+	// while its replacement is awaited.
+	StatusRemoved    InstanceStatus = "removed"
+	StatusTerminated InstanceStatus = "terminated"
+	// StatusNotAttempted is a pending instance the rotation didn't get to
+	// because it halted after too many failed replacements.
+	StatusNotAttempted InstanceStatus = "not-attempted"
+	// StatusSkipped is an instance skipped in step mode, which is left as it
+	// is and not resumed.
+	StatusSkipped InstanceStatus = "skipped"
+)
+
+var statusOrder = map[InstanceStatus]int{
+	StatusPending:          0,
+	StatusNotAttempted:     0,
+	StatusSkipped:          0,
+	StatusCordoned:         1,
+	StatusDetached:         2,
+	StatusReplacementReady: 3,
+	StatusDrained:          4,
+	StatusRemoved:          5,
+	StatusTerminated:       6,
+}
+
+// reached tells whether the rotation has progressed to at least status.
+func (s InstanceStatus) reached(status InstanceStatus) bool {
+	return statusOrder[s] >= statusOrder[status]
+}
+
+type InstanceState struct {
+	Status InstanceStatus `json:"status"`
+	// ActivitiesUntil is the start time of the newest scaling activity of the
+	// ASG before the instance was detached; the replacement is launched by a
+	// later activity.
+	ActivitiesUntil *time.Time `json:"activitiesUntil,omitempty"`
+	// Replacement is the instance the ASG launched in place of this one.
+	Replacement string    `json:"replacement,omitempty"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// GroupCapacity is the capacity an ASG had before a surge rotation raised it.
+type GroupCapacity struct {
+	DesiredCapacity int64 `json:"desiredCapacity"`
+	MaxSize         int64 `json:"maxSize"`
+}
+
+// State is the progress of a rotation, persisted to a JSON file after every
+// step so an interrupted rotation can be resumed.
+type State struct {
+	Plan      Plan                      `json:"plan"`
+	Instances map[string]*InstanceState `json:"instances"`
+	// Capacities holds the original capacity of the ASGs a surge rotation
+	// has raised and not restored yet.
+	Capacities map[string]GroupCapacity `json:"capacities,omitempty"`
+
+	mu   sync.Mutex
+	path string
+}
+
+// NewState starts tracking plan in the state file at path. It refuses to
+// overwrite the state of an unfinished rotation.
+func NewState(path string, plan *Plan) (*State, error) {
+	existing, err := LoadState(path)
+	if err == nil && len(existing.Unfinished()) > 0 {
+		return nil, fmt.Errorf("state file '%s' holds an unfinished rotation; resume it with --resume or remove the file", path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	s := &State{
+		Plan:      *plan,
+		Instances: map[string]*InstanceState{},
+		path:      path,
+	}
+	now := time.Now()
+	for _, i := range plan.Instances {
+		s.Instances[i.InstanceID] = &InstanceState{Status: StatusPending, UpdatedAt: now}
+	}
+	return s, s.save()
+}
+
+func LoadState(path string) (*State, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &State{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("reading state file '%s': %v", path, err)
+	}
+	s.path = path
+	if s.Instances == nil {
+		s.Instances = map[string]*InstanceState{}
+	}
+	return s, nil
+}
+
+// Unfinished returns the planned instances that were neither terminated nor
+// skipped.
+func (s *State) Unfinished() []PlannedInstance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var unfinished []PlannedInstance
+	for _, i := range s.Plan.Instances {
+		if state, ok := s.Instances[i.InstanceID]; !ok || state.Status != StatusTerminated && state.Status != StatusSkipped {
+			unfinished = append(unfinished, i)
+		}
+	}
+	return unfinished
+}
+
+// Instance returns a copy of the progress recorded for an instance.
+func (s *State) Instance(id string) InstanceState {
+	if s == nil {
+		return InstanceState{Status: StatusPending}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, ok := s.Instances[id]; ok {
+		return *state
+	}
+	return InstanceState{Status: StatusPending}
+}
+
+// replacements returns the replacement instances recorded for all instances.
+func (s *State) replacements() sets.String {
+	ids := sets.NewString()
+	if s == nil {
+		return ids
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, state := range s.Instances {
+		if state.Replacement != "" {
+			ids.Insert(state.Replacement)
+		}
+	}
+	return ids
+}
+
+// nodeName returns the name the plan recorded for an instance's node.
+func (s *State) nodeName(id string) string {
+	if s == nil {
+		return ""
+	}
+	for _, i := range s.Plan.Instances {
+		if i.InstanceID == id {
+			return i.NodeName
+		}
+	}
+	return ""
+}
+
+// Capacity returns the original capacity recorded for an ASG, if any.
+func (s *State) Capacity(group string) (GroupCapacity, bool) {
+	if s == nil {
+		return GroupCapacity{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	capacity, ok := s.Capacities[group]
+	return capacity, ok
+}
+
+// recordCapacity saves the original capacity of an ASG, or forgets it once
+// restored if capacity is nil. A nil State records nothing.
+func (s *State) recordCapacity(group string, capacity *GroupCapacity) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if capacity == nil {
+		delete(s.Capacities, group)
+	} else {
+		if s.Capacities == nil {
+			s.Capacities = map[string]GroupCapacity{}
+		}
+		s.Capacities[group] = *capacity
+	}
+	return s.saveLocked()
+}
+
+// record notes that an instance reached status, applies update if given, and
+// saves the state. A nil State records nothing.
+func (s *State) record(id string, status InstanceStatus, update func(*InstanceState)) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.Instances[id]
+	if !ok {
+		state = &InstanceState{}
+		s.Instances[id] = state
+	}
+	state.Status = status
+	if update != nil {
+		update(state)
+	}
+	state.UpdatedAt = time.Now()
+	return s.saveLocked()
+}
+
+func (s *State) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saveLocked()
+}
+
+// saveLocked writes the state to a temporary file first, so an interruption
+// never leaves a truncated state file behind.
+func (s *State) saveLocked() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
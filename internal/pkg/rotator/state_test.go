@@ -0,0 +1,77 @@
+package rotator
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// TestResumeAfterKill resumes a rotation whose process was killed right after
+// detaching an instance, so its replacement is launched but was never seen.
+func TestResumeAfterKill(t *testing.T) {
+	c := newTestCluster(t, 3)
+	opts := Options{StateFile: stateFile(t)}
+	ctx := context.Background()
+
+	killed := c.rotator(opts)
+	igs, err := DescribeAutoScalingGroup(killed.asg, killed.ec2, c.group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := killed.newPlan(ctx, igs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if killed.state, err = NewState(killed.stateFile, plan); err != nil {
+		t.Fatal(err)
+	}
+	detached := igs[0]
+	node, err := GetNodeByInstanceID(ctx, c.client, detached.instanceId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CordonNode(ctx, c.client, node); err != nil {
+		t.Fatal(err)
+	}
+	_, until, err := GetScalingActivityIDs(ctx, killed.asg, c.group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DetachInstance(ctx, killed.asg, c.group, detached.instanceId(), false); err != nil {
+		t.Fatal(err)
+	}
+	err = killed.state.record(detached.instanceId(), StatusDetached, func(s *InstanceState) { s.ActivitiesUntil = &until })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewState(killed.stateFile, plan); err == nil {
+		t.Error("a new rotation overwrote the state of the unfinished one")
+	}
+	r := c.rotator(opts)
+	if err := r.Resume(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if left := c.running(c.original...); len(left) > 0 {
+		t.Errorf("old instances %v still run", left)
+	}
+	if state := aws.StringValue(c.cloud.Instance(detached.instanceId()).State.Name); state != ec2.InstanceStateNameTerminated {
+		t.Errorf("detached instance '%s' is %s, want it terminated", detached.instanceId(), state)
+	}
+	if desired, _ := c.capacity(); desired != 3 {
+		t.Errorf("desired capacity is %d, want 3", desired)
+	}
+	// The replacement launched before the kill is the detached instance's.
+	if launches := c.launches(t); launches != 6 {
+		t.Errorf("ASG launched %d instances, want 6", launches)
+	}
+	state, err := LoadState(r.stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unfinished := state.Unfinished(); len(unfinished) > 0 {
+		t.Errorf("instances %v are left to resume, want none", unfinished)
+	}
+}
@@ -0,0 +1,63 @@
+package rotator
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Strategy is how a rotation replaces nodes.
+type Strategy string
+
+const (
+	// StrategyDetach replaces one node at a time: its instance is detached
+	// from the ASG, which launches a replacement.
+	StrategyDetach Strategy = "detach"
+	// StrategySurge raises the ASG's desired capacity to launch a batch of new
+	// nodes first, then drains and terminates as many old ones.
+	StrategySurge Strategy = "surge"
+	// StrategyDrainFirst drains and terminates one node at a time before the
+	// ASG launches its replacement, for ASGs that can't grow.
+	StrategyDrainFirst Strategy = "drain-first"
+)
+
+var Strategies = []string{string(StrategyDetach), string(StrategySurge), string(StrategyDrainFirst)}
+
+// ParseStrategies parses strategies given as "surge", or "<asg>=surge" to set
+// the strategy of one ASG only. It returns the strategy for all other ASGs,
+// which is empty if none was given.
+func ParseStrategies(values []string) (Strategy, map[string]Strategy, error) {
+	var strategy Strategy
+	groups := map[string]Strategy{}
+	for _, v := range values {
+		group, value := "", v
+		if n := strings.LastIndex(v, "="); n >= 0 {
+			group, value = v[:n], v[n+1:]
+		}
+		if !isStrategy(value) {
+			return "", nil, fmt.Errorf("invalid strategy '%s', expected one of %s", value, strings.Join(Strategies, ", "))
+		}
+		if group == "" {
+			strategy = Strategy(value)
+		} else {
+			groups[group] = Strategy(value)
+		}
+	}
+	return strategy, groups, nil
+}
+
+func isStrategy(s string) bool {
+	for _, strategy := range Strategies {
+		if s == strategy {
+			return true
+		}
+	}
+	return false
+}
+
+// strategyFor returns the strategy the instances of an ASG are rotated with.
+func (r *Rotator) strategyFor(groupId string) Strategy {
+	if strategy, ok := r.groupStrategies[groupId]; ok {
+		return strategy
+	}
+	return r.strategy
+}
@@ -0,0 +1,557 @@
+package rotator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// BatchSize is a number of instances, or a percentage of the instances of an
+// ASG that are rotated.
+type BatchSize struct {
+	Count   int
+	Percent int
+}
+
+// ParseBatchSize parses a batch size such as "3" or "25%".
+func ParseBatchSize(s string) (BatchSize, error) {
+	if p := strings.TrimSuffix(s, "%"); p != s {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > 100 {
+			return BatchSize{}, fmt.Errorf("invalid batch size '%s': expected a percentage from 1%% to 100%%", s)
+		}
+		return BatchSize{Percent: n}, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return BatchSize{}, fmt.Errorf("invalid batch size '%s': expected a positive number or a percentage", s)
+	}
+	return BatchSize{Count: n}, nil
+}
+
+func (b BatchSize) String() string {
+	if b.Percent > 0 {
+		return fmt.Sprintf("%d%%", b.Percent)
+	}
+	return strconv.Itoa(b.Count)
+}
+
+// of returns the number of instances in a batch when rotating n instances.
+// Percentages are rounded up, and a batch holds at least one instance.
+func (b BatchSize) of(n int) int {
+	size := b.Count
+	if b.Percent > 0 {
+		size = (n*b.Percent + 99) / 100
+	}
+	if size < 1 {
+		size = 1
+	}
+	if size > n {
+		size = n
+	}
+	return size
+}
+
+// BatchSizes is the surge batch size of each ASG.
+type BatchSizes struct {
+	Default BatchSize
+	Groups  map[string]BatchSize
+}
+
+func (b BatchSizes) forGroup(name string) BatchSize {
+	if size, ok := b.Groups[name]; ok {
+		return size
+	}
+	return b.Default
+}
+
+// ParseBatchSizes parses batch sizes given as "3", "25%", or "<asg>=3" to set
+// the size for one ASG only.
+func ParseBatchSizes(values []string) (BatchSizes, error) {
+	sizes := BatchSizes{Groups: map[string]BatchSize{}}
+	for _, v := range values {
+		group, value := "", v
+		if n := strings.LastIndex(v, "="); n >= 0 {
+			group, value = v[:n], v[n+1:]
+		}
+		size, err := ParseBatchSize(value)
+		if err != nil {
+			return BatchSizes{}, err
+		}
+		if group == "" {
+			sizes.Default = size
+		} else {
+			sizes.Groups[group] = size
+		}
+	}
+	return sizes, nil
+}
+
+// surgeGroup rotates the instances of an ASG in batches: for each batch the
+// ASG is scaled up, the new nodes are awaited, and then the old nodes are
+// drained and terminated, scaling the ASG back down.
+func (r *Rotator) surgeGroup(ctx context.Context, groupId string, instanceGroups InstanceGroups) error {
+	size := r.batchSizes.forGroup(groupId).of(len(instanceGroups))
+	if r.dryrun {
+		for start := 0; start < len(instanceGroups); start += size {
+			batch := instanceGroups[start:minInt(start+size, len(instanceGroups))]
+			ids := make([]string, 0, len(batch))
+			for _, ig := range batch {
+				ids = append(ids, ig.instanceId())
+			}
+			logf(ctx, "Would add %d nodes to ASG '%s', then drain and terminate instances %s.",
+				len(batch), groupId, strings.Join(ids, ", "))
+		}
+		logln(ctx, "DRY RUN is enabled. Skipping rotate.")
+		return nil
+	}
+
+	// A rotation that was interrupted may have left the capacity raised, so
+	// prefer the original capacity the state file recorded.
+	original, ok := r.state.Capacity(groupId)
+	if !ok {
+		group, err := getAutoScalingGroup(r.asg, groupId)
+		if err != nil {
+			return err
+		}
+		original = GroupCapacity{
+			DesiredCapacity: aws.Int64Value(group.DesiredCapacity),
+			MaxSize:         aws.Int64Value(group.MaxSize),
+		}
+		if err := r.state.recordCapacity(groupId, &original); err != nil {
+			return err
+		}
+	}
+	defer r.restoreCapacity(ctx, groupId, original)
+
+	logf(ctx, "Rotating %d nodes of ASG '%s' in batches of %d.", len(instanceGroups), groupId, size)
+	for start := 0; start < len(instanceGroups); start += size {
+		if err := r.awaitRelease(ctx, instanceGroups[start].instanceId()); err != nil {
+			return err
+		}
+		if r.isHalted() {
+			return errHalted
+		}
+		batch := instanceGroups[start:minInt(start+size, len(instanceGroups))]
+		if !r.step(ctx, groupId, batch) {
+			continue
+		}
+		err := r.attempt(ctx, groupId, batch, func() error {
+			return r.rotateGated(ctx, batch, func() error {
+				return r.surgeBatch(ctx, groupId, batch, original)
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batch is a set of old instances of one ASG that are replaced together.
+type batch struct {
+	groupId   string
+	instances InstanceGroups
+	nodes     []*coreV1.Node
+	progress  []InstanceState
+	// launched are the instances the ASG launched for the batch, in the
+	// order of the instances they replace; nil until seen.
+	launched []*Replacement
+	// known are the scaling activities of the ASG before it launched the
+	// replacements still awaited, and ignore the instances those activities
+	// launched for other purposes.
+	known  sets.String
+	ignore sets.String
+}
+
+func (r *Rotator) surgeBatch(ctx context.Context, groupId string, instanceGroups InstanceGroups, original GroupCapacity) error {
+	b := &batch{
+		groupId:   groupId,
+		instances: instanceGroups,
+		nodes:     make([]*coreV1.Node, len(instanceGroups)),
+		progress:  make([]InstanceState, len(instanceGroups)),
+		launched:  make([]*Replacement, len(instanceGroups)),
+	}
+	for n, ig := range instanceGroups {
+		var err error
+		b.progress[n] = r.state.Instance(ig.instanceId())
+		b.nodes[n], err = r.nodeForInstance(ctx, ig, r.state.nodeName(ig.instanceId()), b.progress[n])
+		if err != nil {
+			return err
+		}
+		logf(ctx, "Rotating node '%s' (instance '%s').\n", b.nodes[n].Name, ig.instanceId())
+	}
+	if err := r.replaceBatch(ctx, b); err != nil {
+		r.recoverBatch(ctx, err, b, original)
+		return err
+	}
+	return nil
+}
+
+// replaceBatch replaces the old nodes of a batch, skipping the steps their
+// progress records as done.
+func (r *Rotator) replaceBatch(ctx context.Context, b *batch) error {
+	first, firstNode := b.instances[0], b.nodes[0].Name
+	err := r.runPhase(ctx, PhaseScaleUp, first, firstNode, func(ctx context.Context) error {
+		return r.scaleUpBatch(ctx, b)
+	})
+	if err != nil {
+		return err
+	}
+	var newNodes []*coreV1.Node
+	// failed is the launched instance whose node was being awaited when
+	// the join or ready phase failed.
+	var failed *Replacement
+	err = r.runPhase(ctx, PhaseJoin, first, firstNode, func(ctx context.Context) error {
+		if err := r.awaitBatchLaunches(ctx, b); err != nil {
+			return err
+		}
+		r.checkBatchZones(ctx, b.groupId, b.instances, b.launched)
+		for _, l := range b.launched {
+			failed = l
+			node, err := awaitReplacementJoin(ctx, r.k8s, l)
+			if err != nil {
+				return err
+			}
+			newNodes = append(newNodes, node)
+		}
+		return nil
+	})
+	if err != nil {
+		return r.diagnose(ctx, err, b.groupId, b.known, failed)
+	}
+	err = r.runPhase(ctx, PhaseReady, first, firstNode, func(ctx context.Context) error {
+		for n, node := range newNodes {
+			failed = b.launched[n]
+			if err := awaitNodeReadiness(ctx, r.k8s, node); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return r.diagnose(ctx, err, b.groupId, b.known, failed)
+	}
+
+	// Cordon the whole batch first, so pods evicted from one old node aren't
+	// scheduled onto another.
+	for n, ig := range b.instances {
+		if b.progress[n].Status.reached(StatusDrained) {
+			continue
+		}
+		node := b.nodes[n]
+		err := r.runPhase(ctx, PhaseCordon, ig, node.Name, func(ctx context.Context) error {
+			return CordonNode(ctx, r.k8s, node)
+		})
+		if err != nil {
+			return err
+		}
+		if err := r.checkpoint(ig, node, PhaseCordon, StatusCordoned, nil); err != nil {
+			return err
+		}
+		b.progress[n].Status = StatusCordoned
+	}
+	for n, ig := range b.instances {
+		if b.progress[n].Status.reached(StatusDrained) {
+			continue
+		}
+		node := b.nodes[n]
+		err := r.drainWithSlot(ctx, func() error {
+			return r.runPhase(ctx, PhaseDrain, ig, node.Name, func(ctx context.Context) error {
+				return DrainNode(ctx, r.k8s, node, r.drain, r.timeouts.Drain, r.podEvicted(ig.groupId()))
+			})
+		})
+		if err != nil {
+			return err
+		}
+		if err := r.checkpoint(ig, node, PhaseDrain, StatusDrained, nil); err != nil {
+			return err
+		}
+		b.progress[n].Status = StatusDrained
+	}
+	for n, ig := range b.instances {
+		node := b.nodes[n]
+		err := r.runPhase(ctx, PhaseTerminate, ig, node.Name, func(ctx context.Context) error {
+			return r.terminateInGroup(ctx, b.groupId, ig.instanceId(), true)
+		})
+		if err != nil {
+			return err
+		}
+		b.progress[n].Status = StatusTerminated
+		if err := r.checkpoint(ig, node, PhaseTerminate, StatusTerminated, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scaleUpBatch raises the desired capacity of the ASG by the replacements
+// the batch still needs. A rotation that was interrupted may have raised it
+// already: replacements recorded in the state file that are still running
+// are reused, and so are launches since the recorded activities, so resuming
+// never launches more instances than the batch needs.
+func (r *Rotator) scaleUpBatch(ctx context.Context, b *batch) error {
+	group, err := getAutoScalingGroup(r.asg, b.groupId)
+	if err != nil {
+		return err
+	}
+	running := map[string]*autoscaling.Instance{}
+	for _, i := range group.Instances {
+		if !strings.HasPrefix(aws.StringValue(i.LifecycleState), "Terminating") {
+			running[aws.StringValue(i.InstanceId)] = i
+		}
+	}
+
+	need := 0
+	var until *time.Time
+	for n, progress := range b.progress {
+		if i, ok := running[progress.Replacement]; ok {
+			b.launched[n] = &Replacement{InstanceID: progress.Replacement, AvailabilityZone: aws.StringValue(i.AvailabilityZone)}
+			logf(ctx, "Reusing instance '%s' launched for instance '%s'.", progress.Replacement, b.instances[n].instanceId())
+			continue
+		}
+		need++
+		if t := progress.ActivitiesUntil; t != nil && (until == nil || t.Before(*until)) {
+			until = t
+		}
+	}
+	if need == 0 {
+		return nil
+	}
+
+	if until != nil {
+		b.known, err = GetScalingActivityIDsUntil(ctx, r.asg, b.groupId, *until)
+	} else {
+		var latest time.Time
+		b.known, latest, err = GetScalingActivityIDs(ctx, r.asg, b.groupId)
+		until = &latest
+	}
+	if err != nil {
+		return err
+	}
+	for n, ig := range b.instances {
+		if b.launched[n] != nil {
+			continue
+		}
+		b.progress[n].ActivitiesUntil = until
+		err := r.state.record(ig.instanceId(), b.progress[n].Status, func(s *InstanceState) {
+			s.ActivitiesUntil = until
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Instances launched since then that replace other instances, or that are
+	// gone, are not the batch's.
+	launches, err := GetLaunchedInstances(ctx, r.asg, b.groupId, b.known)
+	if err != nil {
+		return err
+	}
+	assigned := r.state.replacements()
+	b.ignore = sets.NewString()
+	launched := 0
+	for _, l := range launches {
+		if _, ok := running[l.InstanceID]; !ok || assigned.Has(l.InstanceID) {
+			b.ignore.Insert(l.InstanceID)
+			continue
+		}
+		launched++
+	}
+	desired := aws.Int64Value(group.DesiredCapacity)
+	launching := desired - int64(len(running))
+	if launching < 0 {
+		launching = 0
+	}
+	extra := int64(need-launched) - launching
+	if extra <= 0 {
+		logf(ctx, "ASG '%s' already launched or is launching the %d instances the batch needs.", b.groupId, need)
+		return nil
+	}
+	max := aws.Int64Value(group.MaxSize)
+	if desired+extra > max {
+		max = desired + extra
+	}
+	return SetGroupCapacity(ctx, r.asg, b.groupId, desired+extra, max)
+}
+
+// awaitBatchLaunches waits for the replacements of the batch that were not
+// launched yet, and records each in the state file as the replacement of the
+// instance it stands in for.
+func (r *Rotator) awaitBatchLaunches(ctx context.Context, b *batch) error {
+	need := 0
+	for _, l := range b.launched {
+		if l == nil {
+			need++
+		}
+	}
+	if need == 0 {
+		return nil
+	}
+	launches, err := AwaitLaunchedInstances(ctx, r.asg, b.groupId, need, b.known, b.ignore)
+	for n, ig := range b.instances {
+		if b.launched[n] != nil || len(launches) == 0 {
+			continue
+		}
+		l := launches[0]
+		launches = launches[1:]
+		b.launched[n] = l
+		b.progress[n].Replacement = l.InstanceID
+		err := r.state.record(ig.instanceId(), b.progress[n].Status, func(s *InstanceState) {
+			s.Replacement = l.InstanceID
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// restoreCapacity sets the max size of an ASG back to what it was before the
+// surge. The desired capacity is only ever lowered by terminating instances
+// with a decrement, never by letting the ASG pick instances to scale in. If
+// it is still above the original because replacements were kept for old
+// nodes left to rotate, the original capacity stays recorded for --resume.
+func (r *Rotator) restoreCapacity(ctx context.Context, groupId string, original GroupCapacity) {
+	// The rotation context may have been cancelled, so restore with a fresh one.
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+	group, err := getAutoScalingGroup(r.asg, groupId)
+	if err != nil {
+		logf(ctx, "Failed to restore the max size of ASG '%s' to %d, restore it manually: %s",
+			groupId, original.MaxSize, err)
+		return
+	}
+	desired, max := aws.Int64Value(group.DesiredCapacity), original.MaxSize
+	if desired > max {
+		max = desired
+	}
+	if aws.Int64Value(group.MaxSize) != max {
+		if err := SetGroupCapacity(ctx, r.asg, groupId, desired, max); err != nil {
+			logf(ctx, "Failed to restore the max size of ASG '%s' to %d, restore it manually: %s",
+				groupId, max, err)
+			return
+		}
+	}
+	if desired > original.DesiredCapacity {
+		logf(ctx, "ASG '%s' keeps a desired capacity of %d, above its original %d, for the replacements of nodes left to rotate.",
+			groupId, desired, original.DesiredCapacity)
+		return
+	}
+	if err := r.state.recordCapacity(groupId, nil); err != nil {
+		logf(ctx, "Failed to update state file '%s': %s", r.stateFile, err)
+	}
+}
+
+// recoverBatch leaves the cluster in a safe state after a failed batch, and
+// terminates whatever the ASG runs in excess explicitly, so it never scales
+// in instances of its own choosing. Old nodes that were drained are
+// terminated; the others are uncordoned so they keep serving workloads. If
+// draining hadn't started, the instances launched for the batch are
+// terminated instead, and launches still pending are cancelled; otherwise
+// they are kept as the replacements of the old nodes left to rotate.
+func (r *Rotator) recoverBatch(ctx context.Context, err error, b *batch, original GroupCapacity) {
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) {
+		return
+	}
+	logf(ctx, "Rotation of instance '%s' failed during the %s phase.", phaseErr.InstanceID, phaseErr.Phase)
+
+	// The rotation context may be what failed, so clean up with a fresh one.
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+	draining := phaseErr.Phase == PhaseDrain || phaseErr.Phase == PhaseTerminate
+	restored := true
+	for n, ig := range b.instances {
+		node := b.nodes[n]
+		status := b.progress[n].Status
+		switch {
+		case status == StatusTerminated:
+		case status.reached(StatusDrained):
+			draining = true
+			// A drained node serves nothing, so it is the one to go.
+			if err := r.terminateInGroup(ctx, b.groupId, ig.instanceId(), true); err != nil {
+				logf(ctx, "Failed to terminate drained instance '%s', terminate it manually: %s", ig.instanceId(), err)
+				restored = false
+				continue
+			}
+			b.progress[n].Status = StatusTerminated
+			if err := r.checkpoint(ig, node, PhaseTerminate, StatusTerminated, nil); err != nil {
+				logf(ctx, "Failed to update state file '%s': %s", r.stateFile, err)
+			}
+		default:
+			if err := UncordonNode(ctx, r.k8s, node); err != nil {
+				logf(ctx, "Failed to uncordon node '%s', uncordon it manually: %s", node.Name, err)
+				restored = false
+			}
+		}
+	}
+	if draining {
+		logf(ctx, "ASG '%s' keeps the instances launched for the old nodes that were not drained.", b.groupId)
+	} else {
+		for n, ig := range b.instances {
+			if l := b.launched[n]; l != nil {
+				if err := r.terminateInGroup(ctx, b.groupId, l.InstanceID, true); err != nil {
+					logf(ctx, "Failed to terminate instance '%s' launched for the batch, terminate it manually: %s",
+						l.InstanceID, err)
+					restored = false
+					continue
+				}
+			}
+			err := r.state.record(ig.instanceId(), b.progress[n].Status, func(s *InstanceState) {
+				s.ActivitiesUntil = nil
+				s.Replacement = ""
+			})
+			if err != nil {
+				logf(ctx, "Failed to update state file '%s': %s", r.stateFile, err)
+			}
+		}
+		if err := r.cancelLaunches(ctx, b.groupId, original); err != nil {
+			logf(ctx, "Failed to cancel the launches pending in ASG '%s', check its capacity manually: %s", b.groupId, err)
+			restored = false
+		}
+		phaseErr.RolledBack = restored
+	}
+	if r.state != nil {
+		logf(ctx, "Progress was saved to '%s'; run again with --resume to finish the rotation.", r.stateFile)
+	}
+}
+
+// cancelLaunches lowers the desired capacity of an ASG that is still raised
+// to the number of instances it runs, or to the original capacity if more,
+// so it stops launching instances without terminating any.
+func (r *Rotator) cancelLaunches(ctx context.Context, groupId string, original GroupCapacity) error {
+	group, err := getAutoScalingGroup(r.asg, groupId)
+	if err != nil {
+		return err
+	}
+	running := int64(0)
+	for _, i := range group.Instances {
+		if !strings.HasPrefix(aws.StringValue(i.LifecycleState), "Terminating") {
+			running++
+		}
+	}
+	desired := original.DesiredCapacity
+	if running > desired {
+		desired = running
+	}
+	if aws.Int64Value(group.DesiredCapacity) <= desired {
+		return nil
+	}
+	return SetGroupCapacity(ctx, r.asg, groupId, desired, aws.Int64Value(group.MaxSize))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
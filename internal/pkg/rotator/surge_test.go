@@ -0,0 +1,188 @@
+package rotator
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/tenjin/rotate-eks-asg/internal/pkg/rotator/fake"
+)
+
+func surgeOptions(batch int) Options {
+	return Options{
+		Strategy:   StrategySurge,
+		BatchSizes: BatchSizes{Default: BatchSize{Count: batch}},
+	}
+}
+
+func TestSurgeReplacesAllNodes(t *testing.T) {
+	c := newTestCluster(t, 3)
+	r := c.rotator(surgeOptions(2))
+	if err := r.Rotate(context.Background(), c.group); err != nil {
+		t.Fatal(err)
+	}
+	if left := c.running(c.original...); len(left) > 0 {
+		t.Errorf("old instances %v still run", left)
+	}
+	if desired, max := c.capacity(); desired != 3 || max != 3 {
+		t.Errorf("capacity is %d (max %d), want 3 (max 3)", desired, max)
+	}
+	if launches := c.launches(t); launches != 6 {
+		t.Errorf("ASG launched %d instances, want 6", launches)
+	}
+}
+
+// TestSurgeResumeAfterKill resumes a surge rotation whose process was killed
+// after scaling the ASG up, without the cleanup an error gets.
+func TestSurgeResumeAfterKill(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// seen tells whether the rotator saw the launches before it was
+		// killed, recording them as replacements.
+		seen bool
+	}{
+		{name: "before the launches were seen"},
+		{name: "after the launches were seen", seen: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCluster(t, 3)
+			path := stateFile(t)
+			opts := surgeOptions(2)
+			opts.StateFile = path
+			ctx := context.Background()
+
+			killed := c.rotator(opts)
+			igs, err := DescribeAutoScalingGroup(killed.asg, killed.ec2, c.group)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plan, err := killed.newPlan(ctx, igs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if killed.state, err = NewState(path, plan); err != nil {
+				t.Fatal(err)
+			}
+			if err := killed.state.recordCapacity(c.group, &GroupCapacity{DesiredCapacity: 3, MaxSize: 3}); err != nil {
+				t.Fatal(err)
+			}
+			b := &batch{
+				groupId:   c.group,
+				instances: igs[:2],
+				progress:  make([]InstanceState, 2),
+				launched:  make([]*Replacement, 2),
+			}
+			if err := killed.scaleUpBatch(ctx, b); err != nil {
+				t.Fatal(err)
+			}
+			if tc.seen {
+				if err := killed.awaitBatchLaunches(ctx, b); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			resumeCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			if err := c.rotator(opts).Resume(resumeCtx); err != nil {
+				t.Fatal(err)
+			}
+			if left := c.running(c.original...); len(left) > 0 {
+				t.Errorf("old instances %v still run", left)
+			}
+			if desired, max := c.capacity(); desired != 3 || max != 3 {
+				t.Errorf("capacity is %d (max %d), want 3 (max 3)", desired, max)
+			}
+			// The killed run's launches replace the first batch.
+			if launches := c.launches(t); launches != 6 {
+				t.Errorf("ASG launched %d instances, want 6", launches)
+			}
+		})
+	}
+}
+
+func TestSurgeFailureBeforeDrainTerminatesLaunchedInstances(t *testing.T) {
+	c := newTestCluster(t, 3)
+	c.sim.Faults = func(string, *ec2.Instance) fake.Fault { return fake.NeverReady }
+	opts := surgeOptions(2)
+	opts.Timeouts = Timeouts{Ready: 200 * time.Millisecond}
+	r := c.rotator(opts)
+
+	err := r.Rotate(context.Background(), c.group)
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) || phaseErr.Phase != PhaseReady {
+		t.Fatalf("rotation failed with %v, want a ready phase error", err)
+	}
+	if !phaseErr.RolledBack {
+		t.Error("batch was not rolled back")
+	}
+	if got := c.instances(); strings.Join(got, ",") != strings.Join(c.original, ",") {
+		t.Errorf("ASG runs %v, want the original %v", got, c.original)
+	}
+	if desired, max := c.capacity(); desired != 3 || max != 3 {
+		t.Errorf("capacity is %d (max %d), want 3 (max 3)", desired, max)
+	}
+}
+
+func TestSurgeFailureWhileDrainingKeepsReplacements(t *testing.T) {
+	c := newTestCluster(t, 3)
+	opts := surgeOptions(2)
+	opts.StateFile = stateFile(t)
+	r := c.rotator(opts)
+	igs, err := DescribeAutoScalingGroup(r.asg, r.ec2, c.group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rotation goes oldest first, so the second node of the first batch
+	// fails to drain.
+	sort.Sort(ByAge{igs})
+	stuck := fake.NodeName(igs[1].instance)
+	failDrain := true
+	c.client.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		selector := action.(k8stesting.ListAction).GetListRestrictions().Fields
+		if node, _ := selector.RequiresExactMatch("spec.nodeName"); failDrain && node == stuck {
+			return true, nil, errors.New("API unavailable")
+		}
+		return false, nil, nil
+	})
+
+	err = r.Rotate(context.Background(), c.group)
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) || phaseErr.Phase != PhaseDrain {
+		t.Fatalf("rotation failed with %v, want a drain phase error", err)
+	}
+	drained, undrained := igs[0].instanceId(), igs[1].instanceId()
+	if left := c.running(drained, undrained); len(left) != 1 || left[0] != undrained {
+		t.Errorf("ASG runs old instances %v, want only the undrained '%s'", left, undrained)
+	}
+	node, err := GetNodeByInstanceID(context.Background(), c.client, undrained)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Spec.Unschedulable {
+		t.Errorf("node '%s' that wasn't drained is still cordoned", stuck)
+	}
+	if desired, max := c.capacity(); desired != 4 || max != 4 {
+		t.Errorf("capacity is %d (max %d), want 4 (max 4) for the kept replacements", desired, max)
+	}
+
+	failDrain = false
+	if err := c.rotator(opts).Resume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if left := c.running(c.original...); len(left) > 0 {
+		t.Errorf("old instances %v still run", left)
+	}
+	if desired, max := c.capacity(); desired != 3 || max != 3 {
+		t.Errorf("capacity is %d (max %d), want 3 (max 3)", desired, max)
+	}
+	if launches := c.launches(t); launches != 6 {
+		t.Errorf("ASG launched %d instances, want 6", launches)
+	}
+}
@@ -0,0 +1,121 @@
+package rotator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Order is the order instances are rotated in.
+type Order string
+
+const (
+	// OrderAge rotates the oldest instances first.
+	OrderAge Order = "age"
+	// OrderZone takes turns between availability zones and, within each
+	// zone, between ASGs, so consecutive rotations hit different zones.
+	// Each zone and ASG still rotates its oldest instances first. ASGs
+	// rotated with StrategySurge are replaced in batches once the rotation
+	// gets to their first instance, so their instances don't take turns.
+	OrderZone Order = "zone"
+)
+
+var Orders = []string{string(OrderAge), string(OrderZone)}
+
+// ZoneMismatch is what to do when an ASG launches a replacement in another
+// availability zone than the instance it replaces.
+type ZoneMismatch string
+
+const (
+	// ZoneMismatchWarn only logs a warning.
+	ZoneMismatchWarn ZoneMismatch = "warn"
+	// ZoneMismatchPause stops the rotation once the current node is
+	// replaced, so it can be resumed after checking the ASG.
+	ZoneMismatchPause ZoneMismatch = "pause"
+)
+
+var ZoneMismatches = []string{string(ZoneMismatchWarn), string(ZoneMismatchPause)}
+
+// bucketBy splits instances by key, keeping their order within each bucket.
+// Buckets are in the order of their first instance.
+func bucketBy(instanceGroups InstanceGroups, key func(*InstanceGroup) string) []InstanceGroups {
+	index := map[string]int{}
+	var buckets []InstanceGroups
+	for _, ig := range instanceGroups {
+		k := key(ig)
+		n, ok := index[k]
+		if !ok {
+			n = len(buckets)
+			index[k] = n
+			buckets = append(buckets, nil)
+		}
+		buckets[n] = append(buckets[n], ig)
+	}
+	return buckets
+}
+
+// roundRobin merges buckets by taking one instance from each in turn.
+func roundRobin(buckets []InstanceGroups) InstanceGroups {
+	var merged InstanceGroups
+	for n := 0; ; n++ {
+		added := false
+		for _, bucket := range buckets {
+			if n < len(bucket) {
+				merged = append(merged, bucket[n])
+				added = true
+			}
+		}
+		if !added {
+			return merged
+		}
+	}
+}
+
+// orderByZone interleaves instances sorted oldest first by availability zone
+// and, within each zone, by ASG.
+func orderByZone(instanceGroups InstanceGroups) InstanceGroups {
+	zones := bucketBy(instanceGroups, func(ig *InstanceGroup) string { return ig.zone() })
+	for n := range zones {
+		zones[n] = roundRobin(bucketBy(zones[n], func(ig *InstanceGroup) string { return ig.groupId() }))
+	}
+	return roundRobin(zones)
+}
+
+// checkReplacementZone warns if an ASG launched the replacement of an
+// instance in another availability zone.
+func (r *Rotator) checkReplacementZone(ctx context.Context, instanceGroup *InstanceGroup, replacement *Replacement) {
+	want, got := instanceGroup.zone(), replacement.AvailabilityZone
+	if want == "" || got == "" || want == got {
+		return
+	}
+	r.zoneMismatched(ctx, instanceGroup.groupId(), fmt.Sprintf("replacement '%s' of instance '%s' was launched in '%s', not '%s'",
+		replacement.InstanceID, instanceGroup.instanceId(), got, want))
+}
+
+// checkBatchZones warns if an ASG launched the replacements of a batch of
+// instances in other availability zones than the instances.
+func (r *Rotator) checkBatchZones(ctx context.Context, groupId string, instanceGroups InstanceGroups, launched []*Replacement) {
+	var want, got []string
+	for _, ig := range instanceGroups {
+		want = append(want, ig.zone())
+	}
+	for _, l := range launched {
+		got = append(got, l.AvailabilityZone)
+	}
+	sort.Strings(want)
+	sort.Strings(got)
+	if strings.Join(want, ",") == strings.Join(got, ",") {
+		return
+	}
+	r.zoneMismatched(ctx, groupId, fmt.Sprintf("replacements were launched in '%s', not '%s'",
+		strings.Join(got, "', '"), strings.Join(want, "', '")))
+}
+
+func (r *Rotator) zoneMismatched(ctx context.Context, groupId, problem string) {
+	logf(ctx, "WARNING: %s; ASG '%s' may be rebalancing its availability zones.", problem, groupId)
+	if r.zoneMismatch == ZoneMismatchPause {
+		logln(ctx, "Pausing the rotation once the current node is replaced.")
+		r.pause(problem)
+	}
+}
@@ -0,0 +1,126 @@
+package rotator
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestOrderByZone(t *testing.T) {
+	instance := func(id, group, zone string) *InstanceGroup {
+		return &InstanceGroup{
+			group: &autoscaling.Group{AutoScalingGroupName: aws.String(group)},
+			instance: &ec2.Instance{
+				InstanceId: aws.String(id),
+				Placement:  &ec2.Placement{AvailabilityZone: aws.String(zone)},
+			},
+		}
+	}
+	// Oldest first.
+	igs := InstanceGroups{
+		instance("i-1", "ng-1", "us-east-1a"),
+		instance("i-2", "ng-1", "us-east-1a"),
+		instance("i-3", "ng-2", "us-east-1a"),
+		instance("i-4", "ng-1", "us-east-1b"),
+		instance("i-5", "ng-1", "us-east-1a"),
+		instance("i-6", "ng-2", "us-east-1c"),
+	}
+
+	var got []string
+	for _, ig := range orderByZone(igs) {
+		got = append(got, ig.instanceId())
+	}
+	want := []string{"i-1", "i-4", "i-6", "i-3", "i-2", "i-5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ordered %v, want %v", got, want)
+	}
+}
+
+// newZonedCluster returns a test cluster whose ASG launched its two oldest
+// instances in us-east-1a and the two newest in us-east-1b.
+func newZonedCluster(t *testing.T) *testCluster {
+	c := newTestCluster(t, 0)
+	for n, zone := range []string{"us-east-1a", "us-east-1b"} {
+		c.cloud.PinLaunchZone(c.group, zone)
+		size := int64(2 * (n + 1))
+		if err := SetGroupCapacity(context.Background(), c.cloud.AutoScaling(), c.group, size, size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.cloud.PinLaunchZone(c.group, "")
+	c.awaitNodes(t)
+	c.original = c.instances()
+	return c
+}
+
+func (c *testCluster) zoneOf(id string) string {
+	return aws.StringValue(c.cloud.Instance(id).Placement.AvailabilityZone)
+}
+
+func TestRotateByZone(t *testing.T) {
+	c := newZonedCluster(t)
+	logged := captureLog(t)
+	r := c.rotator(Options{Order: OrderZone})
+
+	if err := r.Rotate(context.Background(), c.group); err != nil {
+		t.Fatal(err)
+	}
+	var zones []string
+	for _, id := range c.detached(t) {
+		zones = append(zones, c.zoneOf(id))
+	}
+	if want := []string{"us-east-1a", "us-east-1b", "us-east-1a", "us-east-1b"}; !reflect.DeepEqual(zones, want) {
+		t.Errorf("rotated nodes in zones %v, want %v", zones, want)
+	}
+	if !strings.Contains(logged.String(), "Rotating 4 nodes, taking turns between availability zones.") {
+		t.Errorf("log doesn't tell the rotation order:\n%s", logged)
+	}
+}
+
+func TestZoneMismatchPause(t *testing.T) {
+	c := newZonedCluster(t)
+	opts := Options{ZoneMismatch: ZoneMismatchPause, StateFile: stateFile(t)}
+	// Every replacement lands in us-east-1b, while the oldest nodes are in
+	// us-east-1a.
+	c.cloud.PinLaunchZone(c.group, "us-east-1b")
+
+	err := c.rotator(opts).Rotate(context.Background(), c.group)
+	if err == nil || !strings.Contains(err.Error(), "rotation paused") || !strings.Contains(err.Error(), "--resume") {
+		t.Fatalf("rotation ended with %v, want it paused", err)
+	}
+	if detached := c.detached(t); len(detached) != 1 {
+		t.Fatalf("instances %v were rotated, want only the first", detached)
+	}
+	if left := c.running(c.original...); len(left) != 3 {
+		t.Errorf("ASG runs old instances %v, want 3", left)
+	}
+
+	c.cloud.PinLaunchZone(c.group, "")
+	if err := c.rotator(Options{StateFile: opts.StateFile}).Resume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if left := c.running(c.original...); len(left) > 0 {
+		t.Errorf("old instances %v still run", left)
+	}
+}
+
+func TestZoneMismatchWarns(t *testing.T) {
+	c := newZonedCluster(t)
+	logged := captureLog(t)
+	c.cloud.PinLaunchZone(c.group, "us-east-1b")
+
+	if err := c.rotator(Options{}).Rotate(context.Background(), c.group); err != nil {
+		t.Fatal(err)
+	}
+	if left := c.running(c.original...); len(left) > 0 {
+		t.Errorf("old instances %v still run", left)
+	}
+	if n := strings.Count(logged.String(), "may be rebalancing its availability zones"); n != 2 {
+		t.Errorf("log warns %d times about zones, want once per node moved from us-east-1a:\n%s", n, logged)
+	}
+}